@@ -0,0 +1,90 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AccessType is the git operation checked by SSH.CheckAccess and passed to
+// SSH.AuthorizeAccess
+type AccessType string
+
+const (
+	AccessRead    AccessType = "upload-pack"
+	AccessWrite   AccessType = "receive-pack"
+	AccessArchive AccessType = "upload-archive"
+)
+
+var (
+	errKeyRestricted = errors.New("key is restricted from this command")
+	errNotAuthorized = errors.New("key is not authorized for this repo")
+)
+
+// CheckAccess returns true if the key ID may run the operation on the repo,
+// as decided by AuthorizeAccess or Authorize. Use CheckKeyAccess to apply the restrictions of the
+// public key as well.
+func (s *SSH) CheckAccess(keyID string, repo string, op AccessType) (bool, error) {
+	return s.CheckKeyAccess(&PublicKey{Id: keyID}, repo, op)
+}
+
+// CheckKeyAccess returns true if the key may run the operation on the repo
+// over SSH, applying its forced command and restrictions before Authorize
+// without opening a session
+func (s *SSH) CheckKeyAccess(key *PublicKey, repo string, op AccessType) (bool, error) {
+	name, err := NormalizeRepoName(repo)
+	if err != nil {
+		return false, err
+	}
+
+	gitcmd := &GitCommand{Command: "git-" + string(op), Repo: name}
+	if !gitcmd.IsPack() && gitcmd.Verb() != "upload-archive" {
+		return false, fmt.Errorf("invalid access type: %q", op)
+	}
+
+	// Keys with a forced command only ever run that command
+	perms := key.permissions()
+	if forced := perms.Extensions["forced-command"]; forced != "" {
+		forcedCmd, err := ParseGitCommand(forced)
+		if err != nil {
+			return false, err
+		}
+		if forcedCmd.Verb() != gitcmd.Verb() || forcedCmd.Repo != gitcmd.Repo {
+			return false, nil
+		}
+	}
+
+	err = s.authorize(perms, key.Id, gitcmd)
+	if err == errKeyRestricted || err == errNotAuthorized {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// authorize checks the command against the key restrictions and
+// AuthorizeAccess or Authorize
+func (s *SSH) authorize(perms *ssh.Permissions, keyID string, gitcmd *GitCommand) error {
+	if !keyAllows(perms, gitcmd) {
+		return errKeyRestricted
+	}
+
+	repo := strings.TrimSuffix(gitcmd.Repo, ".git")
+	authorized := true
+	var err error
+	switch {
+	case s.AuthorizeAccess != nil:
+		authorized, err = s.AuthorizeAccess(keyID, repo, AccessType(gitcmd.Verb()))
+	case s.Authorize != nil:
+		authorized, err = s.Authorize(keyID, repo)
+	}
+
+	if err != nil {
+		return err
+	}
+	if !authorized {
+		return errNotAuthorized
+	}
+	return nil
+}
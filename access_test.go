@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSH_CheckAccess(t *testing.T) {
+	s := NewSSH(Config{})
+	s.Authorize = func(keyID string, repo string) (bool, error) {
+		if repo == "broken" {
+			return false, fmt.Errorf("backend unavailable")
+		}
+		return keyID == "admin" || repo != "private", nil
+	}
+
+	examples := []struct {
+		key     *PublicKey
+		repo    string
+		op      AccessType
+		allowed bool
+	}{
+		{&PublicKey{Id: "dev"}, "app", AccessWrite, true},
+		{&PublicKey{Id: "dev"}, "private.git", AccessRead, false},
+		{&PublicKey{Id: "admin"}, "private", AccessRead, true},
+		{&PublicKey{Id: "deploy", AllowedOps: []string{"upload-pack"}}, "app", AccessRead, true},
+		{&PublicKey{Id: "deploy", AllowedOps: []string{"upload-pack"}}, "app", AccessWrite, false},
+		{&PublicKey{Id: "ci", AllowedRepos: []string{"team/*"}}, "team/app", AccessWrite, true},
+		{&PublicKey{Id: "ci", AllowedRepos: []string{"team/*"}}, "app", AccessWrite, false},
+		{&PublicKey{Id: "mirror", ForcedCommand: &GitCommand{Command: "git-upload-pack", Repo: "app.git"}}, "app", AccessRead, true},
+		{&PublicKey{Id: "mirror", ForcedCommand: &GitCommand{Command: "git-upload-pack", Repo: "app.git"}}, "other", AccessRead, false},
+		{&PublicKey{Id: "mirror", ForcedCommand: &GitCommand{Command: "git-upload-pack", Repo: "app.git"}}, "app", AccessWrite, false},
+	}
+
+	for _, ex := range examples {
+		allowed, err := s.CheckKeyAccess(ex.key, ex.repo, ex.op)
+		assert.NoError(t, err, ex.repo)
+		assert.Equal(t, ex.allowed, allowed, "%s %s %s", ex.key.Id, ex.op, ex.repo)
+	}
+
+	allowed, err := s.CheckAccess("dev", "app", AccessArchive)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = s.CheckAccess("dev", "broken", AccessRead)
+	assert.Error(t, err)
+	assert.False(t, allowed)
+
+	_, err = s.CheckAccess("dev", "app", AccessType("shell"))
+	assert.Error(t, err)
+}
+
+func TestSSH_AuthorizeAccess(t *testing.T) {
+	s := NewSSH(Config{})
+	s.Authorize = func(string, string) (bool, error) {
+		return false, nil
+	}
+	s.AuthorizeAccess = func(keyID string, repo string, op AccessType) (bool, error) {
+		return keyID == "admin" || op == AccessRead, nil
+	}
+
+	examples := []struct {
+		keyID   string
+		op      AccessType
+		allowed bool
+	}{
+		{"deploy", AccessRead, true},
+		{"deploy", AccessWrite, false},
+		{"deploy", AccessArchive, false},
+		{"admin", AccessWrite, true},
+	}
+
+	for _, ex := range examples {
+		allowed, err := s.CheckAccess(ex.keyID, "app", ex.op)
+		assert.NoError(t, err)
+		assert.Equal(t, ex.allowed, allowed, "%s %s", ex.keyID, ex.op)
+	}
+
+	// LFS uploads need write access
+	gitcmd, _, _ := parseLFSCommand("git-lfs-authenticate 'app.git' upload")
+	assert.Equal(t, errNotAuthorized, s.authorize(nil, "deploy", gitcmd))
+	gitcmd, _, _ = parseLFSCommand("git-lfs-authenticate 'app.git' download")
+	assert.NoError(t, s.authorize(nil, "deploy", gitcmd))
+}
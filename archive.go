@@ -0,0 +1,147 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Owner is a user and group ID applied to extracted files
+type Owner struct {
+	UID int
+	GID int
+}
+
+// extractArchive writes the entries of a tar stream created by git archive
+// into dir. Ownership stored in the archive is ignored, files belong to the
+// current user unless owner is set. Symlinks are created once all other
+// entries are written, and entries below a symlink or with a duplicate path
+// are refused, so a crafted tree can't write outside of dir.
+func extractArchive(r io.Reader, dir string, owner *Owner) error {
+	reader := tar.NewReader(r)
+	dir = filepath.Clean(dir)
+
+	if owner != nil {
+		if err := os.Lchown(dir, owner.UID, owner.GID); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{}
+	links := map[string]bool{}
+	symlinks := []*tar.Header{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeSymlink {
+			// Global headers carry the commit ID
+			continue
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if err := checkExtractPath(dir, target); err != nil {
+			return fmt.Errorf("invalid path in archive: %q: %v", header.Name, err)
+		}
+		if seen[target] {
+			return fmt.Errorf("duplicate path in archive: %q", header.Name)
+		}
+		seen[target] = true
+		for parent := filepath.Dir(target); parent != dir; parent = filepath.Dir(parent) {
+			if links[parent] {
+				return fmt.Errorf("invalid path in archive: %q is below a symlink", header.Name)
+			}
+		}
+
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeArchiveFile(target, reader, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			links[target] = true
+			symlinks = append(symlinks, header)
+			continue
+		}
+
+		if owner != nil {
+			if err := os.Lchown(target, owner.UID, owner.GID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, header := range symlinks {
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if err := checkExtractPath(dir, target); err != nil {
+			return fmt.Errorf("invalid path in archive: %q: %v", header.Name, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return err
+		}
+		if owner != nil {
+			if err := os.Lchown(target, owner.UID, owner.GID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkExtractPath returns an error unless path is in dir and none of the
+// directories between them is a symlink
+func checkExtractPath(dir string, path string) error {
+	if path == dir {
+		return nil
+	}
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return fmt.Errorf("outside of %s", dir)
+	}
+
+	for parent := filepath.Dir(path); parent != dir; parent = filepath.Dir(parent) {
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", parent)
+		}
+	}
+	return nil
+}
+
+func writeArchiveFile(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,55 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Max number of arguments accepted by git upload-archive
+const maxArchiveArgs = 64
+
+// readArchiveArgs reads the "argument <arg>" pkt-lines git archive --remote
+// sends to upload-archive, up to the flush packet
+func readArchiveArgs(r *bufio.Reader) ([]string, error) {
+	args := []string{}
+
+	for {
+		header, payload, err := readPktLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if header == "0000" {
+			return args, nil
+		}
+
+		line := strings.TrimSuffix(string(payload), "\n")
+		if !strings.HasPrefix(line, "argument ") {
+			return nil, fmt.Errorf("invalid archive argument: %q", line)
+		}
+		if len(args) == maxArchiveArgs {
+			return nil, fmt.Errorf("too many archive arguments")
+		}
+		args = append(args, strings.TrimPrefix(line, "argument "))
+	}
+}
+
+// archiveArgsRequest encodes the arguments the way git archive sends them
+func archiveArgsRequest(args []string) []byte {
+	buf := &bytes.Buffer{}
+	for _, arg := range args {
+		packLine(buf, "argument "+arg+"\n")
+	}
+	packFlush(buf)
+	return buf.Bytes()
+}
+
+// writeArchiveNack reports a refused archive, git archive prints the message
+func writeArchiveNack(w io.Writer, message string) error {
+	if err := packLine(w, "NACK "+message+"\n"); err != nil {
+		return err
+	}
+	return packFlush(w)
+}
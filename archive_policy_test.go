@@ -0,0 +1,107 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readArchiveArgs(t *testing.T) {
+	request := archiveArgsRequest([]string{"--format=tar", "HEAD", "docs"})
+	assert.Equal(t, "001aargument --format=tar\n0012argument HEAD\n0012argument docs\n0000", string(request))
+
+	args, err := readArchiveArgs(bufio.NewReader(bytes.NewReader(request)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"--format=tar", "HEAD", "docs"}, args)
+
+	_, err = readArchiveArgs(bufio.NewReader(strings.NewReader("0009HEAD\n0000")))
+	assert.Error(t, err)
+
+	_, err = readArchiveArgs(bufio.NewReader(strings.NewReader("0012argument HEAD\n")))
+	assert.Error(t, err)
+}
+
+func TestSSH_UploadArchivePolicy(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	dir := t.TempDir()
+	s := NewSSH(Config{
+		Dir:    dir + "/repos",
+		KeyDir: dir + "/keys",
+		UploadArchivePolicy: func(keyID string, repo string, args []string) ([]string, error) {
+			for _, arg := range args {
+				if arg == "secret" {
+					return nil, fmt.Errorf("secret is not available")
+				}
+			}
+			return append([]string{"--prefix=" + repo + "/"}, args...), nil
+		},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", s.config.repoStore().Path("app"), work).Run())
+	assert.NoError(t, os.MkdirAll(filepath.Join(work, "docs"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(work, "secret"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(work, "docs", "index.md"), []byte("docs"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(work, "secret", "key"), []byte("key"), 0644))
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	git := func(stdout io.Writer, args ...string) (string, error) {
+		stderr := &bytes.Buffer{}
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		return stderr.String(), err
+	}
+
+	for _, args := range [][]string{
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:refs/heads/master"},
+	} {
+		out, err := git(nil, args...)
+		assert.NoError(t, err, out)
+	}
+
+	archive := &bytes.Buffer{}
+	out, err := git(archive, "archive", "--remote=ssh://git@127.0.0.1/app.git", "master", "docs")
+	assert.NoError(t, err, out)
+
+	names := []string{}
+	reader := tar.NewReader(archive)
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		if header.Typeflag != tar.TypeXGlobalHeader {
+			names = append(names, header.Name)
+		}
+	}
+	assert.Equal(t, []string{"app/", "app/docs/", "app/docs/index.md"}, names)
+
+	out, err = git(io.Discard, "archive", "--remote=ssh://git@127.0.0.1/app.git", "master", "secret")
+	assert.Error(t, err)
+	assert.Contains(t, out, "secret is not available")
+}
@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tarStream(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	w := tar.NewWriter(buf)
+	for _, header := range headers {
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(header.Name))
+		}
+		assert.NoError(t, w.WriteHeader(header))
+		if header.Typeflag == tar.TypeReg {
+			w.Write([]byte(header.Name))
+		}
+	}
+	assert.NoError(t, w.Close())
+	return buf
+}
+
+func Test_extractArchive(t *testing.T) {
+	dir := t.TempDir()
+	stream := tarStream(t,
+		&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "e285100b"}},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "bin/", Mode: 0775, Uid: 12345},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "bin/run", Mode: 0775, Uid: 12345},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "README", Mode: 0664},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "run", Linkname: "bin/run", Mode: 0777},
+	)
+
+	owner := &Owner{UID: os.Getuid(), GID: os.Getgid()}
+	assert.NoError(t, extractArchive(stream, dir, owner))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "run"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bin/run", string(content))
+
+	info, err := os.Stat(filepath.Join(dir, "bin", "run"))
+	assert.NoError(t, err)
+	assert.NotZero(t, info.Mode().Perm()&0100)
+	assert.Equal(t, uint32(os.Getuid()), info.Sys().(*syscall.Stat_t).Uid)
+
+	stream = tarStream(t, &tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0644})
+	assert.Error(t, extractArchive(stream, dir, nil))
+	_, err = os.Stat(filepath.Join(dir, "..", "escape"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Trees with duplicate entries make git archive write a file below a symlink
+	outside := t.TempDir()
+	for name, headers := range map[string][]*tar.Header{
+		"duplicate": {
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outside, Mode: 0777},
+			{Typeflag: tar.TypeDir, Name: "a/", Mode: 0775},
+			{Typeflag: tar.TypeReg, Name: "a/pwned", Mode: 0664},
+		},
+		"below symlink": {
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outside, Mode: 0777},
+			{Typeflag: tar.TypeReg, Name: "a/pwned", Mode: 0664},
+		},
+		"symlink after file": {
+			{Typeflag: tar.TypeReg, Name: "a/pwned", Mode: 0664},
+			{Typeflag: tar.TypeSymlink, Name: "a", Linkname: outside, Mode: 0777},
+		},
+	} {
+		assert.Error(t, extractArchive(tarStream(t, headers...), t.TempDir(), nil), name)
+		_, err = os.Lstat(filepath.Join(outside, "pwned"))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// Existing symlinks in dir are not followed either
+	dir = t.TempDir()
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "a")))
+	assert.Error(t, extractArchive(tarStream(t, &tar.Header{Typeflag: tar.TypeReg, Name: "a/pwned", Mode: 0664}), dir, nil))
+	_, err = os.Lstat(filepath.Join(outside, "pwned"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,103 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authorizedKeys indexes the keys of an authorized_keys file by Content
+type authorizedKeys struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    map[string]*PublicKey
+	refused map[string]error
+}
+
+// AuthorizedKeysFile returns a PublicKeyLookupFunc for the keys of an OpenSSH
+// authorized_keys file. The file is read again once it has been modified.
+// Keys get the comment of their line as Id and Name, or the SHA256
+// fingerprint if there is no comment. The command and from options restrict
+// the key as described in ParsePublicKey, keys with other options are refused
+// and invalid lines are ignored.
+func AuthorizedKeysFile(path string) func(string) (*PublicKey, error) {
+	keys := &authorizedKeys{path: path}
+	return keys.lookup
+}
+
+func (a *authorizedKeys) lookup(content string) (*PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+
+	if err, ok := a.refused[content]; ok {
+		return nil, fmt.Errorf("key in %s is refused: %v", a.path, err)
+	}
+	key, ok := a.keys[content]
+	if !ok {
+		return nil, fmt.Errorf("key is not in %s", a.path)
+	}
+	found := *key
+	return &found, nil
+}
+
+// reload reads the file if it changed since it has been read last
+func (a *authorizedKeys) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return fmt.Errorf("cant read authorized keys: %v", err)
+	}
+	if a.keys != nil && info.ModTime().Equal(a.modTime) && info.Size() == a.size {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("cant read authorized keys: %v", err)
+	}
+
+	keys := map[string]*PublicKey{}
+	refused := map[string]error{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		content, err := NormalizeAuthorizedKey(line)
+		if err != nil {
+			continue
+		}
+		key, err := ParsePublicKey(line)
+		if err != nil {
+			refused[content] = err
+			continue
+		}
+		key.Id = key.Name
+		if key.Id == "" {
+			key.Id = key.Fingerprint
+		}
+		keys[key.Content] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cant read authorized keys: %v", err)
+	}
+
+	a.keys = keys
+	a.refused = refused
+	a.modTime = info.ModTime()
+	a.size = info.Size()
+	return nil
+}
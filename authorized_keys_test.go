@@ -0,0 +1,73 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAuthorizedKeysFile(t *testing.T) {
+	newKey := func() string {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		assert.NoError(t, err)
+		return authorizedKeyString(key)
+	}
+	alice, deploy, ci, restricted, bob := newKey(), newKey(), newKey(), newKey(), newKey()
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	content := "# Developers\n" + alice + " alice@laptop\n\n" +
+		`command="git-upload-pack 'app'" ` + deploy + "\n" +
+		`from="10.0.0.0/8,192.168.1.5" ` + ci + " ci\n" +
+		`restrict,command="git-upload-pack 'app'" ` + restricted + "\n" +
+		"ssh-ed25519 garbage\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	lookup := AuthorizedKeysFile(path)
+
+	key, err := lookup(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice@laptop", key.Id)
+	assert.Equal(t, "alice@laptop", key.Name)
+	assert.Equal(t, alice, key.Content)
+
+	key, err = lookup(deploy)
+	assert.NoError(t, err)
+	assert.Equal(t, key.Fingerprint, key.Id)
+	assert.Equal(t, &GitCommand{Command: "git-upload-pack", Repo: "app.git", Original: "git-upload-pack 'app'"}, key.ForcedCommand)
+
+	key, err = lookup(ci)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.5"}, key.AllowedSources)
+	assert.Nil(t, key.ForcedCommand)
+
+	// Options that can't be enforced refuse the key instead of being dropped
+	_, err = lookup(restricted)
+	assert.EqualError(t, err, "key in "+path+` is refused: unsupported key option "restrict"`)
+
+	_, err = lookup(bob)
+	assert.EqualError(t, err, "key is not in "+path)
+
+	// Changes of the file are picked up
+	assert.NoError(t, ioutil.WriteFile(path, []byte(bob+" bob\n"), 0600))
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, future, future))
+
+	key, err = lookup(bob)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", key.Id)
+	_, err = lookup(alice)
+	assert.Error(t, err)
+
+	assert.NoError(t, os.Remove(path))
+	_, err = lookup(bob)
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// CloneURL returns the SSH clone URL of the repo, e.g. git@example.com:app.git,
+// built from ExternalHost, ExternalPort and GitUser. It is empty if the repo
+// name is invalid.
+func (c *Config) CloneURL(repo string) string {
+	return c.sshCloneURL(c.ExternalHost, c.ExternalPort, repo)
+}
+
+// HTTPCloneURL returns the HTTP clone URL of the repo below ExternalHTTPURL,
+// e.g. https://example.com/git/app.git. It is empty if ExternalHTTPURL is not
+// set or the repo name is invalid.
+func (c *Config) HTTPCloneURL(repo string) string {
+	if c.ExternalHTTPURL == "" {
+		return ""
+	}
+
+	name, err := NormalizeRepoName(repo)
+	if err != nil {
+		return ""
+	}
+
+	base, err := url.Parse(c.ExternalHTTPURL)
+	if err != nil {
+		return ""
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/" + name
+	return base.String()
+}
+
+// CloneURL returns the SSH clone URL of the repo like Config.CloneURL, falling
+// back to the listener's address if ExternalHost is not set
+func (s *SSH) CloneURL(repo string) string {
+	if s.config.ExternalHost != "" {
+		return s.config.CloneURL(repo)
+	}
+
+	host, portStr, err := net.SplitHostPort(s.Address())
+	if err != nil {
+		return ""
+	}
+	port, _ := strconv.Atoi(portStr)
+	if s.config.ExternalPort != 0 {
+		port = s.config.ExternalPort
+	}
+
+	return s.config.sshCloneURL(host, port, repo)
+}
+
+func (c *Config) sshCloneURL(host string, port int, repo string) string {
+	name, err := NormalizeRepoName(repo)
+	if err != nil || host == "" {
+		return ""
+	}
+
+	user := c.GitUser
+	if user == "" {
+		user = "git"
+	}
+
+	// The scp-like syntax can not hold a port or an IPv6 address
+	if (port == 0 || port == 22) && !strings.Contains(host, ":") {
+		return fmt.Sprintf("%s@%s:%s", user, host, name)
+	}
+	if port == 0 {
+		port = 22
+	}
+	return fmt.Sprintf("ssh://%s@%s/%s", user, net.JoinHostPort(host, strconv.Itoa(port)), name)
+}
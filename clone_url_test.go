@@ -0,0 +1,46 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_CloneURL(t *testing.T) {
+	c := &Config{ExternalHost: "git.example.com"}
+	assert.Equal(t, "git@git.example.com:app.git", c.CloneURL("app"))
+	assert.Equal(t, "git@git.example.com:org/app.git", c.CloneURL("/../org/app.git"))
+	assert.Equal(t, "", c.CloneURL("-app"))
+
+	c = &Config{ExternalHost: "git.example.com", ExternalPort: 2222, GitUser: "deploy"}
+	assert.Equal(t, "ssh://deploy@git.example.com:2222/app.git", c.CloneURL("app"))
+
+	c = &Config{ExternalHost: "::1"}
+	assert.Equal(t, "ssh://git@[::1]:22/app.git", c.CloneURL("app"))
+
+	assert.Equal(t, "", (&Config{}).CloneURL("app"))
+}
+
+func TestConfig_HTTPCloneURL(t *testing.T) {
+	assert.Equal(t, "", (&Config{}).HTTPCloneURL("app"))
+
+	c := &Config{ExternalHTTPURL: "https://example.com/git/"}
+	assert.Equal(t, "https://example.com/git/org/app.git", c.HTTPCloneURL("org/app"))
+	assert.Equal(t, "", c.HTTPCloneURL(""))
+}
+
+func TestSSH_CloneURL(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys"})
+	assert.Equal(t, "", s.CloneURL("app"))
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	defer s.Stop()
+	assert.Equal(t, "ssh://git@"+s.Address()+"/app.git", s.CloneURL("app"))
+
+	s.config.ExternalPort = 22
+	assert.Equal(t, "git@127.0.0.1:app.git", s.CloneURL("app"))
+
+	s.config.ExternalHost = "git.example.com"
+	assert.Equal(t, "git@git.example.com:app.git", s.CloneURL("app"))
+}
@@ -1,102 +1,551 @@
 package gitkit
 
 import (
-	"io/fs"
-	"io/ioutil"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
+// DefaultMaxChannelsPerConnection is used if Config.MaxChannelsPerConnection is not set.
+// Git clients open a single session per connection.
+const DefaultMaxChannelsPerConnection = 4
+
+// DefaultShutdownGracePeriod is used if Config.ShutdownGracePeriod is not set.
+const DefaultShutdownGracePeriod = 30 * time.Second
+
 type Config struct {
 	KeyDir     string       // Directory for server ssh keys. Only used in SSH strategy.
 	Dir        string       // Directory that contains repositories
 	GitPath    string       // Path to git binary
 	GitUser    string       // User for ssh connections
-	AutoCreate bool         // Automatically create repostories
+	AutoCreate bool         // Automatically create repostories on push
 	AutoHooks  bool         // Automatically setup git hooks
 	Hooks      *HookScripts // Scripts for hooks/* directory
 	Auth       bool         // Require authentication
+	Store      RepoStore    // Repository storage, defaults to bare repositories in Dir
+
+	AllowUserMismatch bool // Accept any SSH username instead of only GitUser
+
+	// CAs signing the SSH user certificates accepted without
+	// PublicKeyLookupFunc. The first principal of a certificate is its key ID.
+	TrustedUserCAKeys []ssh.PublicKey
+
+	AuthFailureLockout AuthFailureLockout // Lock out client IPs after repeated failed key lookups
+	ReceiveRateLimit   ReceiveRateLimit   // Limit pushes per key and client IP
+
+	// Quotas of SSH sessions keyed by PublicKey.Tenant, tenants without an
+	// entry are unlimited
+	TenantLimits map[string]TenantLimit
+
+	ServerVersion     string    // SSH identification string, defaults to SSH-2.0-gitkit <version>
+	Banner            string    // Message shown to SSH clients before authentication, e.g. a notice of a move
+	HostKeyPassphrase string    // Passphrase of encrypted host keys in KeyDir, keys are not generated if set
+	HostKeys          []string  // Paths of private host keys to load instead of KeyDir, e.g. mounted from a secret
+	HostKeyTypes      []string  // Types of host keys in KeyDir, rsa and ed25519 by default
+	KeyFormat         KeyFormat // Format of generated host keys, defaults to PKCS#8
+
+	// Adjusts the SSH server config after it has been built with the host
+	// keys, e.g. to restrict KeyExchanges, Ciphers and MACs for compliance.
+	// Called again on Reload.
+	SSHConfig func(*ssh.ServerConfig)
+
+	ExternalHost    string // Host name used in SSH clone URLs, e.g. git.example.com
+	ExternalPort    int    // SSH port used in clone URLs, defaults to 22
+	ExternalHTTPURL string // Base URL used in HTTP clone URLs, e.g. https://example.com/git
+
+	// Decides whether a missing repo may be created on push, e.g. only under
+	// scratch/. Takes precedence over AutoCreate when set.
+	AutoCreateFunc func(repo string) bool
+
+	// Max SSH sessions running git at the same time, zero means unlimited.
+	// Connections are not accepted while the limit is reached and further
+	// sessions are rejected as busy, instead of failing once the process
+	// runs out of file descriptors.
+	MaxOpenSessions int
+
+	// Max open SSH connections in total and per client IP, zero means
+	// unlimited. Further connections are closed before the SSH handshake.
+	MaxConcurrentConnections int
+	MaxConnectionsPerIP      int
+
+	// Connections are closed if the SSH handshake takes longer than
+	// HandshakeTimeout or if there is no traffic for IdleTimeout, zero means
+	// no timeout
+	HandshakeTimeout time.Duration
+	IdleTimeout      time.Duration
+
+	// Period of TCP keepalive probes on accepted SSH connections, e.g. to
+	// keep them open through NAT gateways. Zero keeps the system default.
+	KeepAlivePeriod time.Duration
+
+	// Interval of SSH keepalive requests, zero means none are sent.
+	// Connections are closed after ClientAliveCountMax unanswered requests
+	// in a row, 3 by default. Like any traffic, keepalives reset IdleTimeout.
+	ClientAliveInterval time.Duration
+	ClientAliveCountMax int
+
+	// Read a PROXY protocol v1 or v2 header from every SSH connection to get
+	// the client address behind a load balancer. Connections without one
+	// are rejected.
+	ProxyProtocol bool
+
+	// Permissions of the socket file created by SSH.Listen for unix:// binds,
+	// defaults to 0660
+	SocketMode os.FileMode
+
+	// How long SSH.ServeContext waits for open connections to finish once
+	// its context is done, before they are closed
+	ShutdownGracePeriod time.Duration
+
+	// Max repos initialized at the same time in Dir, zero means unlimited.
+	// Limits the disk load of bursts of pushes to new repos.
+	MaxConcurrentInits int
+
+	// Returns the working directory and repository argument of git commands
+	// run for SSH sessions, e.g. the repo path and "." for jailed layouts.
+	// By default git runs without a working directory on the full repo path.
+	ResolveRepoDir func(repo string) (dir string, arg string, err error)
+
+	// Called after a repository has been created with the creator's identity,
+	// e.g. to record its provenance
+	OnRepoCreated func(RepoCreated)
+
+	// Check all repos with git fsck --connectivity-only during Setup and
+	// refuse to start if any is broken. Slow for large repos.
+	ValidateReposOnStart bool
+
+	HookTemplateDir string            // Directory copied into hooks/* of every repo, Hooks scripts take precedence
+	TemplateDir     string            // Template of new repos passed to git init --template, e.g. with HEAD, config and info/exclude
+	RepoConfig      map[string]string // Git config set in new repos, e.g. receive.denyNonFastForwards
+
+	// Shared hooks directory written once by Setup and set as core.hooksPath
+	// of every repo instead of copying hooks into each repo. Its contents are
+	// replaced by the managed hooks.
+	CentralHooksPath string
+
+	DumbHTTP                 bool // Serve the read-only dumb HTTP protocol for clients without smart HTTP
+	StrictCommandForm        bool // Only accept the dashed git-<command> form over SSH
+	AcceptOriginalCommand    bool // Run the command sent in SSH_ORIGINAL_COMMAND for empty exec or shell requests, e.g. from gateways using ForceCommand
+	MaxChannelsPerConnection int  // Max open sessions per SSH connection, defaults to 4, negative means unlimited
+	AllowPartialClone        bool // Allow partial clones, e.g. --filter=blob:none, for all repos
+	MaxRefsPerPush           int  // Max refs updated by a single push over SSH or HTTP, zero means unlimited
+	CopyBufferSize           int  // Buffer size for streaming git data to and from clients, defaults to 32KB
+	CleanEnv                 bool // Run git with PATH, HOME and GIT_*/GITKIT_* vars only, hiding the server environment from hooks
+
+	// Git config passed to every git command over SSH and HTTP, and to its
+	// hooks, with GIT_CONFIG_COUNT. Overrides repo and global config, e.g.
+	// uploadpack.allowFilter=false or transfer.fsckObjects=true. Needs git 2.31.
+	ForcedGitConfig map[string]string
+
+	UploadPackArgs  []string // Extra flags for git-upload-pack, e.g. --timeout=60
+	ReceivePackArgs []string // Extra flags for git-receive-pack
+
+	// Validates a one-time code, e.g. TOTP, for pushes and LFS uploads over SSH.
+	// Clients enter the code with keyboard-interactive auth before offering
+	// their key. Clones and fetches are never asked for it. Needs Auth.
+	SecondFactor func(keyID string, code string) (bool, error)
+
+	// Commands run over SSH in addition to git, keyed by name, e.g. an info
+	// command printing the server version. The func writes its output to ch
+	// and returns the exit status.
+	CustomCommands map[string]func(keyID string, args []string, ch io.ReadWriter) (int, error)
+
+	// Rewrites logged commands, env vars and payloads, e.g. to mask tokens
+	// sent as push options
+	RedactLog func(s string) string
+	LogLevel  LogLevel // Set to LogLevelError to suppress per-connection and per-request lines
+	Logger    Logger   // Receives log lines instead of the standard logger
+
+	// Called when accepting a connection fails, returns whether to keep
+	// serving. By default only temporary errors, e.g. EMFILE, are retried.
+	OnAcceptError func(error) bool
+
+	// Called when a git command fails or the repo can not be created. Errors
+	// caused by a full disk wrap ErrDiskFull.
+	OnError func(repo string, err error)
+
+	// Called for every ref updated by a push over SSH or HTTP, e.g. to keep a
+	// central audit log. Deleted and created refs have ZeroSHA as old or new rev.
+	RefLogFunc func(repo, ref, oldRev, newRev, keyID string, t time.Time)
+
+	UploadPackTimeout  time.Duration // Max duration of upload-pack (clone, fetch), zero means no timeout
+	ReceivePackTimeout time.Duration // Max duration of receive-pack (push), zero means no timeout
+	PostReceiveTimeout time.Duration // Max duration of PostReceiveFunc, zero means no timeout
+
+	// Called when a git command run over SSH has finished with its outcome
+	// and duration, e.g. to track latency and error rates per verb
+	OnOperation func(Operation)
+
+	// Called by SSH.Listen and HTTP.Listen with the bound address once the
+	// listener is ready, before connections are accepted
+	OnReady func(addr string)
+
+	// Called with the capabilities a client requested from upload-pack or
+	// receive-pack, e.g. thin-pack, ofs-delta, "filter blob:none" or "deepen 1"
+	OnNegotiation func(repo string, caps []string)
+
+	// Returns the only ref upload-pack advertises and serves for a repo, e.g.
+	// refs/tags/v1.0 for reproducible CI fetches. HEAD and all other refs are
+	// hidden, archives and dumb HTTP are refused and pinned repos are never
+	// proxied to an UploadPackBackend. Pushes are not affected.
+	PinRef func(repo string) (ref string, ok bool)
+
+	// Returns the restrictions for fetches and clones of a repo by a client,
+	// enforced for upload-pack over SSH and HTTP. Git can not force clients
+	// to fetch shallow, so violating fetches are refused with a message.
+	UploadPackPolicy func(repo string, remote net.Addr) (UploadPolicy, error)
+
+	// Inspects or rewrites the arguments of git archive --remote before
+	// upload-archive runs over SSH, e.g. to force a --prefix or limit the
+	// pathspec. Errors deny the archive and are shown to the client.
+	UploadArchivePolicy func(keyID string, repo string, args []string) ([]string, error)
+
+	// Wraps the stream of a push that follows the ref updates and carries the
+	// pack, before it is passed to git-receive-pack over SSH and HTTP. The
+	// returned reader may inspect or transform the pack. Errors of the func or
+	// of reads abort the push, git is terminated and the error is shown to
+	// the client. The repo name has no .git suffix.
+	PackInspector func(repo string, pack io.Reader) (io.Reader, error)
+
+	// Accept thin packs, whose deltas refer to objects the server already
+	// has. Nil means true. If false, pushes of thin packs over SSH and HTTP
+	// are rejected and clients have to push with --no-thin.
+	AllowThinPack *bool
+
+	// Called for every thin pack pushed over SSH or HTTP, whether it is
+	// accepted or not. The repo name has no .git suffix.
+	OnThinPack func(repo string)
+
+	// Selects a backend SSH server to proxy upload-pack sessions to, e.g. the
+	// nearest fresh mirror. An empty address serves the session locally.
+	// Timeouts, stats, OnNegotiation and GIT_PROTOCOL apply like for local sessions.
+	UploadPackBackend      func(repo string, remote net.Addr) (string, error)
+	BackendHostKeyCallback ssh.HostKeyCallback // Verifies backend host keys, required for proxying
+	BackendClientKey       ssh.Signer          // Key the server authenticates to backends with, required for proxying
 }
 
-// HookScripts represents all repository server-size git hooks
+// HookScripts represents all repository server-side git hooks, written to the
+// hooks directory of every repo. Unlike the receive hooks, which read the
+// updated refs from stdin, the update script is run once per ref with
+// "<ref> <old-rev> <new-rev>" as arguments, see ReadUpdateHookArgs.
 type HookScripts struct {
 	PreReceive  string
 	Update      string
 	PostReceive string
 }
 
-// Configure hook scripts in the repo base directory
-func (c *HookScripts) setupInDir(path string) error {
-	basePath := filepath.Join(path, "hooks")
-	scripts := map[string]string{
-		"pre-receive":  c.PreReceive,
-		"update":       c.Update,
-		"post-receive": c.PostReceive,
+func (c *Config) KeyPath(keyType string) string {
+	return filepath.Join(c.KeyDir, "gitkit"+"."+keyType)
+}
+
+// commandEnv returns the environment for git commands run on behalf of clients
+func (c *Config) commandEnv() []string {
+	env := os.Environ()
+	if !c.CleanEnv {
+		return c.withForcedConfig(env)
 	}
 
-	// Cleanup any existing hooks first
-	hookFiles, err := ioutil.ReadDir(basePath)
-	if err == nil {
-		for _, file := range hookFiles {
-			if err := os.Remove(filepath.Join(basePath, file.Name())); err != nil {
-				return err
-			}
+	clean := []string{}
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if name == "PATH" || name == "HOME" || strings.HasPrefix(name, "GIT_") || strings.HasPrefix(name, "GITKIT_") {
+			clean = append(clean, kv)
+		}
+	}
+	return c.withForcedConfig(clean)
+}
+
+// maxChannelsPerConnection returns the session limit per connection, zero means unlimited
+func (c *Config) maxChannelsPerConnection() int {
+	switch {
+	case c.MaxChannelsPerConnection == 0:
+		return DefaultMaxChannelsPerConnection
+	case c.MaxChannelsPerConnection < 0:
+		return 0
+	}
+	return c.MaxChannelsPerConnection
+}
+
+// hostKeyTypes returns the types of host keys in KeyDir
+func (c *Config) hostKeyTypes() ([]string, error) {
+	if len(c.HostKeyTypes) == 0 {
+		return []string{"rsa", "ed25519"}, nil
+	}
+	for _, keyType := range c.HostKeyTypes {
+		if hostKeyGenerators[keyType] == nil {
+			return nil, fmt.Errorf("unsupported host key type %q", keyType)
 		}
 	}
+	return c.HostKeyTypes, nil
+}
+
+func (c *Config) shutdownGracePeriod() time.Duration {
+	if c.ShutdownGracePeriod <= 0 {
+		return DefaultShutdownGracePeriod
+	}
+	return c.ShutdownGracePeriod
+}
+
+// autoCreate returns true if the missing repo should be created
+func (c *Config) autoCreate(repo string) bool {
+	if c.AutoCreateFunc != nil {
+		return c.AutoCreateFunc(strings.TrimSuffix(repo, ".git"))
+	}
+	return c.AutoCreate
+}
+
+// commandTimeout returns the configured timeout for a git subcommand
+func (c *Config) commandTimeout(verb string) time.Duration {
+	switch verb {
+	case "upload-pack":
+		return c.UploadPackTimeout
+	case "receive-pack":
+		return c.ReceivePackTimeout
+	}
+	return 0
+}
+
+// commandArgs returns the arguments to run a git subcommand against a repo,
+// including the configured extra flags. Upload-pack of a pinned repo is
+// restricted to the pinned ref.
+func (c *Config) commandArgs(verb string, repoPath string, pinned string, flags ...string) []string {
+	args := []string{}
+
+	// Set for existing repos too, which may lack the repo config
+	if verb == "upload-pack" && c.AllowPartialClone {
+		args = append(args, c.configArgs(partialCloneConfig...)...)
+	}
+
+	// Added last, so they take precedence over the options above, e.g.
+	// uploadpack.allowAnySHA1InWant of partial clones
+	if verb == "upload-pack" {
+		args = append(args, pinRefArgs(pinned)...)
+	}
+
+	args = append(args, verb)
+	args = append(args, flags...)
+
+	switch verb {
+	case "upload-pack":
+		args = append(args, c.UploadPackArgs...)
+	case "receive-pack":
+		args = append(args, c.ReceivePackArgs...)
+	case "upload-archive":
+		// Takes exactly one argument and does not parse options
+		return append(args, repoPath)
+	}
 
-	// Write new hook files
-	for name, script := range scripts {
-		fullPath := filepath.Join(basePath, name)
+	return append(args, "--", repoPath)
+}
+
+// allowThinPack returns AllowThinPack, defaulting to true
+func (c *Config) allowThinPack() bool {
+	return c.AllowThinPack == nil || *c.AllowThinPack
+}
+
+// pinnedRef returns the ref upload-pack is restricted to, empty if the repo is not pinned
+func (c *Config) pinnedRef(repo string) (string, error) {
+	if c.PinRef == nil {
+		return "", nil
+	}
 
-		// Dont create hook if there's no script content
-		if script == "" {
+	ref, ok := c.PinRef(strings.TrimSuffix(repo, ".git"))
+	if !ok {
+		return "", nil
+	}
+	if !strings.HasPrefix(ref, "refs/") {
+		return "", fmt.Errorf("pinned ref %q of repo %s is not a full ref name", ref, repo)
+	}
+	return ref, nil
+}
+
+// pinRefArgs returns the git options hiding all refs but the pinned one from
+// upload-pack. Wants are limited to advertised tips, so objects only
+// reachable from hidden refs can not be fetched by their id.
+func pinRefArgs(ref string) []string {
+	if ref == "" {
+		return nil
+	}
+	return []string{
+		"-c", "uploadpack.hideRefs=refs",
+		"-c", "uploadpack.hideRefs=HEAD",
+		"-c", "uploadpack.hideRefs=!" + ref,
+		"-c", "uploadpack.allowTipSHA1InWant=false",
+		"-c", "uploadpack.allowReachableSHA1InWant=false",
+		"-c", "uploadpack.allowAnySHA1InWant=false",
+	}
+}
+
+// configArgs returns the -c options for the settings, leaving out keys of
+// ForcedGitConfig as -c options take precedence over the environment
+func (c *Config) configArgs(settings ...[2]string) []string {
+	args := []string{}
+	for _, setting := range settings {
+		if _, forced := c.ForcedGitConfig[setting[0]]; forced {
 			continue
 		}
+		args = append(args, "-c", setting[0]+"="+setting[1])
+	}
+	return args
+}
 
-		if err := ioutil.WriteFile(fullPath, []byte(script), 0755); err != nil {
-			logError("hook-update", err)
-			return err
+// withForcedConfig appends ForcedGitConfig to the GIT_CONFIG_* variables of
+// the environment, keeping config already passed by the server's environment
+func (c *Config) withForcedConfig(env []string) []string {
+	if len(c.ForcedGitConfig) == 0 {
+		return env
+	}
+
+	count := 0
+	result := []string{}
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GIT_CONFIG_COUNT=") {
+			count, _ = strconv.Atoi(strings.TrimPrefix(kv, "GIT_CONFIG_COUNT="))
+			continue
 		}
+		result = append(result, kv)
+	}
+
+	keys := make([]string, 0, len(c.ForcedGitConfig))
+	for key := range c.ForcedGitConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		result = append(result,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", count, key),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, c.ForcedGitConfig[key]),
+		)
+		count++
 	}
 
+	return append(result, fmt.Sprintf("GIT_CONFIG_COUNT=%d", count))
+}
+
+// userAllowed returns true if clients may authenticate as the SSH user
+func (c *Config) userAllowed(user string) bool {
+	return c.AllowUserMismatch || c.GitUser == "" || user == c.GitUser
+}
+
+// banner returns Banner with CRLF line endings, as the message is written to
+// the client's terminal
+func (c *Config) banner() string {
+	if c.Banner == "" {
+		return ""
+	}
+	banner := strings.ReplaceAll(strings.ReplaceAll(c.Banner, "\r\n", "\n"), "\n", "\r\n")
+	if !strings.HasSuffix(banner, "\r\n") {
+		banner += "\r\n"
+	}
+	return banner
+}
+
+// checkRefUpdates rejects receive-pack requests updating more than MaxRefsPerPush refs
+func (c *Config) checkRefUpdates(req *clientRequest) error {
+	if c.MaxRefsPerPush <= 0 {
+		return nil
+	}
+	if req.refUpdates() > c.MaxRefsPerPush {
+		return fmt.Errorf("push updates more than %d refs", c.MaxRefsPerPush)
+	}
 	return nil
 }
 
-func (c *Config) KeyPath(keyType string) string {
-	return filepath.Join(c.KeyDir, "gitkit"+"."+keyType)
+// Git config required to serve partial clones
+var partialCloneConfig = [][2]string{
+	{"uploadpack.allowFilter", "true"},
+	{"uploadpack.allowAnySHA1InWant", "true"},
 }
 
-func (c *Config) Setup() error {
-	if _, err := os.Stat(c.Dir); err != nil {
-		if err = os.Mkdir(c.Dir, 0755); err != nil {
-			return err
-		}
+// repoConfig returns the git config of new repos, RepoConfig takes precedence
+// over settings implied by other options
+func (c *Config) repoConfig() map[string]string {
+	if !c.AllowPartialClone {
+		return c.RepoConfig
 	}
 
-	if c.AutoHooks == true {
-		return c.setupHooks()
+	config := map[string]string{}
+	for _, setting := range partialCloneConfig {
+		config[setting[0]] = setting[1]
 	}
+	for key, value := range c.RepoConfig {
+		config[key] = value
+	}
+	return config
+}
 
+// resolveRepoDir returns the working directory and repository argument of
+// git commands for the repo
+func (c *Config) resolveRepoDir(repo string, repoPath string) (string, string, error) {
+	if c.ResolveRepoDir == nil {
+		return "", repoPath, nil
+	}
+
+	dir, arg, err := c.ResolveRepoDir(repo)
+	if err != nil {
+		return "", "", err
+	}
+	if arg == "" {
+		return "", "", fmt.Errorf("empty repository argument for %s", repo)
+	}
+	return dir, arg, nil
+}
+
+// validatePackArgs makes sure extra args are flags and can not add positional arguments
+func validatePackArgs(args []string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || arg == "-" || arg == "--" {
+			return fmt.Errorf("invalid git argument %q, only flags are allowed", arg)
+		}
+	}
 	return nil
 }
 
-func (c *Config) setupHooks() error {
-	walk := func(s string, d fs.DirEntry, err error) error {
-		if err != nil {
+func (c *Config) Setup() error {
+	if err := validatePackArgs(c.UploadPackArgs); err != nil {
+		return err
+	}
+	if err := validatePackArgs(c.ReceivePackArgs); err != nil {
+		return err
+	}
+	if err := c.checkTemplateDir(); err != nil {
+		return err
+	}
+	for key := range c.ForcedGitConfig {
+		if !strings.Contains(strings.Trim(key, "."), ".") {
+			return fmt.Errorf("invalid forced git config key %q", key)
+		}
+	}
+
+	if _, err := os.Stat(c.Dir); err != nil {
+		if err = os.Mkdir(c.Dir, 0755); err != nil {
 			return err
 		}
-		if d.IsDir() && strings.HasSuffix(d.Name(), ".git") {
-			if err := c.Hooks.setupInDir(s); err != nil {
-				return err
-			}
+	}
+
+	if c.ValidateReposOnStart {
+		if err := c.validateRepos(); err != nil {
+			return err
 		}
-		return nil
 	}
 
-	if err := filepath.WalkDir(c.Dir, walk); err != nil {
-		return err
+	if c.AutoHooks && c.hasHooks() {
+		return c.setupHooks()
 	}
 
 	return nil
 }
+
+func (c *Config) setupHooks() error {
+	_, err := SyncHooks(c)
+	return err
+}
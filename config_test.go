@@ -0,0 +1,184 @@
+package gitkit
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_commandEnv(t *testing.T) {
+	os.Setenv("GITKIT_TEST_SECRET", "visible")
+	os.Setenv("API_TOKEN_FOR_TEST", "hidden")
+	defer os.Unsetenv("GITKIT_TEST_SECRET")
+	defer os.Unsetenv("API_TOKEN_FOR_TEST")
+
+	env := (&Config{}).commandEnv()
+	assert.Contains(t, env, "API_TOKEN_FOR_TEST=hidden")
+
+	env = (&Config{CleanEnv: true}).commandEnv()
+	assert.Contains(t, env, "GITKIT_TEST_SECRET=visible")
+	assert.Contains(t, env, "PATH="+os.Getenv("PATH"))
+	assert.NotContains(t, env, "API_TOKEN_FOR_TEST=hidden")
+}
+
+func TestConfig_commandArgs(t *testing.T) {
+	c := &Config{UploadPackArgs: []string{"--timeout=60"}}
+
+	assert.Equal(t, []string{"upload-pack", "--stateless-rpc", "--timeout=60", "--", "/repos/a.git"}, c.commandArgs("upload-pack", "/repos/a.git", "", "--stateless-rpc"))
+	assert.Equal(t, []string{"receive-pack", "--", "/repos/a.git"}, c.commandArgs("receive-pack", "/repos/a.git", ""))
+	assert.Equal(t, []string{"upload-archive", "/repos/a.git"}, c.commandArgs("upload-archive", "/repos/a.git", ""))
+
+	c = &Config{AllowPartialClone: true}
+	assert.Equal(t, []string{"-c", "uploadpack.allowFilter=true", "-c", "uploadpack.allowAnySHA1InWant=true", "upload-pack", "--", "/repos/a.git"}, c.commandArgs("upload-pack", "/repos/a.git", ""))
+	assert.Equal(t, []string{"receive-pack", "--", "/repos/a.git"}, c.commandArgs("receive-pack", "/repos/a.git", ""))
+
+	// The pinned ref takes precedence over the partial clone config
+	args := c.commandArgs("upload-pack", "/repos/a.git", "refs/tags/v1")
+	assert.Equal(t, []string{"-c", "uploadpack.allowAnySHA1InWant=false", "upload-pack", "--", "/repos/a.git"}, args[len(args)-5:])
+}
+
+func TestConfig_repoConfig(t *testing.T) {
+	c := &Config{RepoConfig: map[string]string{"receive.denyNonFastForwards": "true"}}
+	assert.Equal(t, c.RepoConfig, c.repoConfig())
+
+	c.AllowPartialClone = true
+	c.RepoConfig["uploadpack.allowAnySHA1InWant"] = "false"
+	assert.Equal(t, map[string]string{
+		"receive.denyNonFastForwards":   "true",
+		"uploadpack.allowFilter":        "true",
+		"uploadpack.allowAnySHA1InWant": "false",
+	}, c.repoConfig())
+}
+
+func Test_validatePackArgs(t *testing.T) {
+	assert.NoError(t, validatePackArgs(nil))
+	assert.NoError(t, validatePackArgs([]string{"--timeout=60", "--strict"}))
+	assert.Error(t, validatePackArgs([]string{"--timeout", "60"}))
+	assert.Error(t, validatePackArgs([]string{"--"}))
+	assert.Error(t, validatePackArgs([]string{"other.git"}))
+}
+
+func TestConfig_maxChannelsPerConnection(t *testing.T) {
+	assert.Equal(t, DefaultMaxChannelsPerConnection, (&Config{}).maxChannelsPerConnection())
+	assert.Equal(t, 1, (&Config{MaxChannelsPerConnection: 1}).maxChannelsPerConnection())
+	assert.Equal(t, 0, (&Config{MaxChannelsPerConnection: -1}).maxChannelsPerConnection())
+}
+
+func TestConfig_autoCreate(t *testing.T) {
+	assert.False(t, (&Config{}).autoCreate("app.git"))
+	assert.True(t, (&Config{AutoCreate: true}).autoCreate("app.git"))
+
+	c := &Config{AutoCreate: true, AutoCreateFunc: func(repo string) bool {
+		return strings.HasPrefix(repo, "scratch/")
+	}}
+	assert.True(t, c.autoCreate("scratch/test.git"))
+	assert.False(t, c.autoCreate("app.git"))
+}
+
+func TestConfig_resolveRepoDir(t *testing.T) {
+	dir, arg, err := (&Config{}).resolveRepoDir("app.git", "/repos/app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "", dir)
+	assert.Equal(t, "/repos/app.git", arg)
+
+	c := &Config{ResolveRepoDir: func(repo string) (string, string, error) {
+		return "/jail/" + repo, ".", nil
+	}}
+	dir, arg, err = c.resolveRepoDir("org/app.git", "/repos/org/app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "/jail/org/app.git", dir)
+	assert.Equal(t, ".", arg)
+
+	c.ResolveRepoDir = func(repo string) (string, string, error) { return "/jail", "", nil }
+	_, _, err = c.resolveRepoDir("app.git", "/repos/app.git")
+	assert.Error(t, err)
+}
+
+func TestConfig_pinnedRef(t *testing.T) {
+	ref, err := (&Config{}).pinnedRef("app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "", ref)
+
+	c := &Config{PinRef: func(repo string) (string, bool) {
+		switch repo {
+		case "app":
+			return "refs/tags/v1", true
+		case "short":
+			return "v1", true
+		}
+		return "", false
+	}}
+
+	ref, err = c.pinnedRef("app.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "refs/tags/v1", ref)
+
+	ref, err = c.pinnedRef("other.git")
+	assert.NoError(t, err)
+	assert.Equal(t, "", ref)
+
+	_, err = c.pinnedRef("short.git")
+	assert.EqualError(t, err, `pinned ref "v1" of repo short.git is not a full ref name`)
+
+	assert.Nil(t, pinRefArgs(""))
+	assert.Contains(t, pinRefArgs("refs/tags/v1"), "uploadpack.hideRefs=!refs/tags/v1")
+}
+
+func TestConfig_withForcedConfig(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, []string{"PATH=/bin"}, c.withForcedConfig([]string{"PATH=/bin"}))
+
+	c.ForcedGitConfig = map[string]string{
+		"uploadpack.allowFilter": "false",
+		"transfer.fsckObjects":   "true",
+	}
+	assert.Equal(t, []string{
+		"PATH=/bin",
+		"GIT_CONFIG_KEY_0=core.pager",
+		"GIT_CONFIG_VALUE_0=cat",
+		"GIT_CONFIG_KEY_1=transfer.fsckObjects",
+		"GIT_CONFIG_VALUE_1=true",
+		"GIT_CONFIG_KEY_2=uploadpack.allowFilter",
+		"GIT_CONFIG_VALUE_2=false",
+		"GIT_CONFIG_COUNT=3",
+	}, c.withForcedConfig([]string{"PATH=/bin", "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=core.pager", "GIT_CONFIG_VALUE_0=cat"}))
+
+	// Forced values are not overridden by -c options
+	c.AllowPartialClone = true
+	assert.Equal(t, []string{"-c", "uploadpack.allowAnySHA1InWant=true", "upload-pack", "--", "/repos/a.git"}, c.commandArgs("upload-pack", "/repos/a.git", ""))
+}
+
+func TestConfig_ForcedGitConfig(t *testing.T) {
+	requireGit(t)
+
+	repoDir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "-q", "--bare", repoDir).Run())
+	assert.NoError(t, exec.Command("git", "--git-dir", repoDir, "config", "uploadpack.allowFilter", "true").Run())
+
+	cmd := exec.Command("git", "--git-dir", repoDir, "config", "uploadpack.allowFilter")
+	cmd.Env = (&Config{ForcedGitConfig: map[string]string{"uploadpack.allowFilter": "false"}}).commandEnv()
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "false\n", string(out))
+
+	assert.EqualError(t, (&Config{Dir: t.TempDir(), ForcedGitConfig: map[string]string{"fsck": "true"}}).Setup(), `invalid forced git config key "fsck"`)
+}
+
+func TestConfig_banner(t *testing.T) {
+	assert.Equal(t, "", (&Config{}).banner())
+	assert.Equal(t, "Moving to git2.example.com\r\n", (&Config{Banner: "Moving to git2.example.com"}).banner())
+	assert.Equal(t, "Line 1\r\nLine 2\r\n", (&Config{Banner: "Line 1\nLine 2\n"}).banner())
+	assert.Equal(t, "Line 1\r\nLine 2\r\n", (&Config{Banner: "Line 1\r\nLine 2"}).banner())
+}
+
+func TestConfig_commandTimeout(t *testing.T) {
+	cfg := Config{UploadPackTimeout: time.Minute, ReceivePackTimeout: time.Hour}
+	assert.Equal(t, time.Minute, cfg.commandTimeout("upload-pack"))
+	assert.Equal(t, time.Hour, cfg.commandTimeout("receive-pack"))
+	assert.Equal(t, time.Duration(0), cfg.commandTimeout("upload-archive"))
+	assert.Equal(t, time.Duration(0), (&Config{}).commandTimeout("upload-pack"))
+}
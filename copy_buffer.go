@@ -0,0 +1,32 @@
+package gitkit
+
+import (
+	"io"
+	"sync"
+)
+
+// DefaultCopyBufferSize is used if Config.CopyBufferSize is not set, same as io.Copy
+const DefaultCopyBufferSize = 32 * 1024
+
+// Buffer pools keyed by buffer size
+var copyBufferPools sync.Map
+
+// copyBuffer copies from src to dst with a pooled buffer of the given size
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = DefaultCopyBufferSize
+	}
+
+	pool, _ := copyBufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	})
+	buf := pool.(*sync.Pool).Get().(*[]byte)
+	defer pool.(*sync.Pool).Put(buf)
+
+	// Hide ReaderFrom and WriterTo, which would bypass the buffer, e.g. with
+	// the 4KB buffer of a bufio.Reader
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
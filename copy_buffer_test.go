@@ -0,0 +1,43 @@
+package gitkit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readSizeRecorder records the largest buffer passed to Read
+type readSizeRecorder struct {
+	io.Reader
+	max int
+}
+
+func (r *readSizeRecorder) Read(p []byte) (int, error) {
+	if len(p) > r.max {
+		r.max = len(p)
+	}
+	return r.Reader.Read(p)
+}
+
+func Test_copyBuffer(t *testing.T) {
+	data := bytes.Repeat([]byte("gitkit"), 100000)
+
+	for _, size := range []int{0, 1024, 256 * 1024} {
+		src := &readSizeRecorder{Reader: bytes.NewReader(data)}
+		dst := &bytes.Buffer{}
+
+		n, err := copyBuffer(dst, src, size)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, dst.Bytes())
+
+		expected := size
+		if size == 0 {
+			expected = DefaultCopyBufferSize
+		}
+		assert.Equal(t, expected, src.max)
+	}
+
+}
@@ -3,16 +3,26 @@ package gitkit
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 type Credential struct {
 	Username string
 	Password string
+	Token    string // Bearer token, set instead of Username and Password
 }
 
 func getCredential(req *http.Request) (Credential, error) {
 	cred := Credential{}
 
+	if header := req.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		cred.Token = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if cred.Token == "" {
+			return cred, fmt.Errorf("authentication failed")
+		}
+		return cred, nil
+	}
+
 	user, pass, ok := req.BasicAuth()
 	if !ok {
 		return cred, fmt.Errorf("authentication failed")
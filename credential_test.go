@@ -21,3 +21,16 @@ func Test_getCredential(t *testing.T) {
 	assert.Equal(t, "Alladin", cred.Username)
 	assert.Equal(t, "OpenSesame", cred.Password)
 }
+
+func Test_getCredentialToken(t *testing.T) {
+	req, _ := http.NewRequest("get", "http://localhost", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	cred, err := getCredential(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, Credential{Token: "s3cret"}, cred)
+
+	req.Header.Set("Authorization", "Bearer ")
+	_, err = getCredential(req)
+	assert.Error(t, err)
+}
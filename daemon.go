@@ -0,0 +1,147 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Daemon bundles the SSH and HTTP servers behind a single config, sharing
+// authentication, authorization and push handlers between both transports.
+type Daemon struct {
+	SSH      *SSH
+	HTTP     *HTTP
+	Receiver *Receiver // Optional receiver to run for every pushed ref
+
+	PublicKeyLookupFunc func(string) (*PublicKey, error)                 // SSH key lookup
+	AuthFunc            func(Credential, *Request) (bool, error)         // HTTP Basic credential check
+	TokenAuthFunc       func(token string, req *Request) (string, error) // HTTP bearer token check, returns the identity
+	Authorize           func(id string, repo string) (bool, error)       // Repo access check for both transports
+
+	mu       sync.Mutex
+	handlers []func(*Push) error
+	started  bool
+}
+
+func NewDaemon(config Config) *Daemon {
+	return &Daemon{
+		SSH:  NewSSH(config),
+		HTTP: NewHTTP(config),
+	}
+}
+
+// HandlePush registers a handler that is called after every successful push
+func (d *Daemon) HandlePush(fn func(*Push) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.handlers = append(d.handlers, fn)
+}
+
+// Start starts the SSH listener and, if httpBind is not empty, the HTTP listener.
+// Both servers run in the background until Shutdown is called.
+func (d *Daemon) Start(sshBind string, httpBind string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.started {
+		return ErrAlreadyStarted
+	}
+
+	d.SSH.PublicKeyLookupFunc = d.PublicKeyLookupFunc
+	d.SSH.Authorize = d.Authorize
+	d.SSH.PostReceiveFunc = d.dispatchPush
+	// HTTP credentials are only accepted once AuthFunc or TokenAuthFunc
+	// verified them, Authorize alone never grants access
+	d.HTTP.AuthFunc = d.AuthFunc
+	d.HTTP.TokenAuthFunc = d.TokenAuthFunc
+	d.HTTP.Authorize = d.Authorize
+	d.HTTP.PostReceiveFunc = d.dispatchPush
+	if d.Receiver != nil && d.Receiver.Logger == nil {
+		d.Receiver.Logger = d.SSH.logger()
+	}
+
+	if err := d.SSH.Listen(sshBind); err != nil {
+		return err
+	}
+
+	if httpBind != "" {
+		if err := d.HTTP.Listen(httpBind); err != nil {
+			d.SSH.Stop()
+			return err
+		}
+
+		go func() {
+			// A Shutdown before Serve leaves no listener to serve
+			if err := d.HTTP.Serve(); err != nil && err != http.ErrServerClosed && err != ErrNoListener {
+				d.SSH.logger().Errorf("daemon: http server failed: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		if err := d.SSH.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			d.SSH.logger().Errorf("daemon: ssh server failed: %v", err)
+		}
+	}()
+
+	d.started = true
+	return nil
+}
+
+// Shutdown stops both servers. In-flight HTTP requests and SSH sessions are
+// given until the context is done to complete.
+func (d *Daemon) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.started {
+		d.mu.Unlock()
+		return nil
+	}
+	d.started = false
+	d.mu.Unlock()
+
+	sshErr := make(chan error, 1)
+	go func() {
+		sshErr <- d.SSH.Shutdown(ctx)
+	}()
+
+	if err := d.HTTP.Shutdown(ctx); err != nil {
+		return err
+	}
+
+	return <-sshErr
+}
+
+// SSHAddress returns the bound address of the SSH listener
+func (d *Daemon) SSHAddress() string {
+	return d.SSH.Address()
+}
+
+// HTTPAddress returns the bound address of the HTTP listener, if any
+func (d *Daemon) HTTPAddress() string {
+	return d.HTTP.Address()
+}
+
+func (d *Daemon) dispatchPush(push *Push) error {
+	d.mu.Lock()
+	handlers := d.handlers
+	d.mu.Unlock()
+
+	if d.Receiver != nil {
+		for _, hook := range push.Refs {
+			if err := d.Receiver.HandleHook(hook); err != nil {
+				d.SSH.logger().Errorf("daemon: receiver failed for %s %s: %v", push.RepoName, hook.Ref, err)
+			}
+		}
+	}
+
+	for _, handler := range handlers {
+		if err := handler(push); err != nil {
+			d.SSH.logger().Errorf("daemon: push handler failed for %s: %v", push.RepoName, err)
+		}
+	}
+
+	return nil
+}
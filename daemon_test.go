@@ -0,0 +1,53 @@
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDaemon_HTTPAuth(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	d := NewDaemon(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true})
+	d.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "dev"}, nil
+	}
+	d.Authorize = func(id string, repo string) (bool, error) {
+		return true, nil
+	}
+	assert.NoError(t, InitRepo("app", &d.HTTP.config))
+
+	status := func(user, pass, token string) int {
+		req, err := http.NewRequest("GET", "http://"+d.HTTPAddress()+"/app.git/info/refs?service=git-upload-pack", nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			req.SetBasicAuth(user, pass)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Authorize alone does not verify credentials
+	assert.NoError(t, d.Start("127.0.0.1:0", "127.0.0.1:0"))
+	assert.Equal(t, http.StatusUnauthorized, status("alice", "anything", ""))
+	assert.Equal(t, http.StatusUnauthorized, status("", "", "token"))
+	assert.NoError(t, d.Shutdown(context.Background()))
+
+	d.AuthFunc = func(cred Credential, req *Request) (bool, error) {
+		return cred.Username == "alice" && cred.Password == "right", nil
+	}
+	assert.NoError(t, d.Start("127.0.0.1:0", "127.0.0.1:0"))
+	defer d.Shutdown(context.Background())
+
+	assert.Equal(t, http.StatusUnauthorized, status("alice", "wrong", ""))
+	assert.Equal(t, http.StatusOK, status("alice", "right", ""))
+	assert.Equal(t, http.StatusUnauthorized, status("", "", "token"))
+}
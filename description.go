@@ -0,0 +1,52 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Written by git init, treated as no description
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// GetDescription returns the description of the repository, as shown by
+// gitweb or cgit. It is empty if the description has not been set.
+func GetDescription(name string, config *Config) (string, error) {
+	path, err := descriptionPath(name, config)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	description := strings.TrimSpace(string(content))
+	if description == defaultDescription {
+		return "", nil
+	}
+	return description, nil
+}
+
+// SetDescription replaces the description of the repository
+func SetDescription(name string, config *Config, description string) error {
+	path, err := descriptionPath(name, config)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.TrimSpace(description)+"\n"), 0644)
+}
+
+func descriptionPath(name string, config *Config) (string, error) {
+	repoPath, err := existingRepoPath(name, config)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(repoPath, "description"), nil
+}
@@ -0,0 +1,26 @@
+package gitkit
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescription(t *testing.T) {
+	requireGit(t)
+
+	config := &Config{Dir: t.TempDir(), GitPath: "git"}
+	assert.NoError(t, InitRepo("app", config))
+
+	description, err := GetDescription("app", config)
+	assert.NoError(t, err)
+	assert.Equal(t, "", description)
+
+	assert.NoError(t, SetDescription("app.git", config, "Main application\n"))
+	description, err = GetDescription("/app", config)
+	assert.NoError(t, err)
+	assert.Equal(t, "Main application", description)
+
+	assert.Equal(t, os.ErrNotExist, SetDescription("missing", config, "test"))
+}
@@ -0,0 +1,108 @@
+package gitkit
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DiskFullExitStatus is sent to SSH clients when a command fails because the
+// server ran out of disk space. It matches the ENOSPC errno.
+const DiskFullExitStatus = 28
+
+// ErrDiskFull is passed to Config.OnError when git fails because the disk is full
+var ErrDiskFull = errors.New("server out of disk space")
+
+// Message printed by git and libc when writing to a full disk
+var diskFullMessage = []byte("No space left on device")
+
+// diskFullWriter forwards writes and records whether the output reports a full disk
+type diskFullWriter struct {
+	found bool
+	tail  []byte // End of the previous write, in case the message is split
+}
+
+func (w *diskFullWriter) Write(p []byte) (int, error) {
+	if !w.found {
+		data := append(w.tail, p...)
+		w.found = bytes.Contains(data, diskFullMessage)
+
+		if keep := len(diskFullMessage) - 1; len(data) > keep {
+			data = data[len(data)-keep:]
+		}
+		w.tail = append([]byte{}, data...)
+	}
+	return len(p), nil
+}
+
+// isDiskFull returns true if the error was caused by a full disk
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// receiveOutput follows the pkt-lines receive-pack writes to stdout. It
+// records whether the report-status rejected the pack and looks for a full
+// disk only in the progress and error channels of the sideband, so the data
+// of the push itself is never scanned.
+type receiveOutput struct {
+	unpackFailed bool
+	diskFull     diskFullWriter
+
+	buf     []byte // Incomplete pkt-line of the output
+	report  []byte // Incomplete pkt-line of the report-status in sideband channel 1
+	invalid bool   // Output is not made of pkt-lines, e.g. after a fatal error
+}
+
+func (o *receiveOutput) Write(p []byte) (int, error) {
+	if o.invalid {
+		return len(p), nil
+	}
+
+	o.buf = append(o.buf, p...)
+	o.buf = o.splitPktLines(o.buf, func(payload []byte) {
+		if len(payload) == 0 {
+			return
+		}
+		switch payload[0] {
+		case 1:
+			o.report = o.splitPktLines(append(o.report, payload[1:]...), o.checkReport)
+		case 2, 3:
+			o.diskFull.Write(payload[1:])
+		default:
+			o.checkReport(payload)
+		}
+	})
+	return len(p), nil
+}
+
+// splitPktLines calls fn with the payload of every complete pkt-line in data
+// and returns the remaining bytes
+func (o *receiveOutput) splitPktLines(data []byte, fn func([]byte)) []byte {
+	for len(data) >= 4 {
+		size, err := strconv.ParseUint(string(data[:4]), 16, 16)
+		if err != nil {
+			o.invalid = true
+			return nil
+		}
+		if size < 4 {
+			data = data[4:]
+			continue
+		}
+		if uint64(len(data)) < size {
+			break
+		}
+		fn(data[4:size])
+		data = data[size:]
+	}
+	return data
+}
+
+// checkReport records a failed unpack status, e.g. "unpack index-pack abnormal exit"
+func (o *receiveOutput) checkReport(line []byte) {
+	status := strings.TrimSuffix(string(line), "\n")
+	if strings.HasPrefix(status, "unpack ") && status != "unpack ok" {
+		o.unpackFailed = true
+	}
+}
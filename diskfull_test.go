@@ -0,0 +1,54 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_diskFullWriter(t *testing.T) {
+	w := &diskFullWriter{}
+	fmt.Fprint(w, "remote: unpack failed\n")
+	assert.False(t, w.found)
+
+	fmt.Fprint(w, "error: unable to write file: No space ")
+	fmt.Fprint(w, "left on device\n")
+	assert.True(t, w.found)
+}
+
+func Test_isDiskFull(t *testing.T) {
+	assert.True(t, isDiskFull(&os.PathError{Op: "write", Path: "/repos/a.git", Err: syscall.ENOSPC}))
+	assert.False(t, isDiskFull(os.ErrNotExist))
+}
+
+func Test_receiveOutput(t *testing.T) {
+	sideband := func(band byte, data string) string {
+		return pktStream(string([]byte{band}) + data)
+	}
+
+	// Pushed data, e.g. ref names, is not checked for a full disk
+	o := &receiveOutput{}
+	fmt.Fprint(o, pktStream("0000000000000000000000000000000000000000 capabilities^{}\x00report-status side-band-64k\n"))
+	fmt.Fprint(o, sideband(1, pktStream("unpack ok\n", "ok refs/heads/No space left on device\n")))
+	assert.False(t, o.unpackFailed)
+	assert.False(t, o.diskFull.found)
+
+	// Messages of the error and progress channels are checked
+	o = &receiveOutput{}
+	report := sideband(1, pktStream("unpack index-pack abnormal exit\n", "ng refs/heads/main unpacker error\n"))
+	data := sideband(2, "error: unable to write file: No space left on device\n") + report + "0000"
+	for i := range data {
+		fmt.Fprint(o, data[i:i+1])
+	}
+	assert.True(t, o.unpackFailed)
+	assert.True(t, o.diskFull.found)
+
+	// Clients without sideband support get the report-status directly
+	o = &receiveOutput{}
+	fmt.Fprint(o, pktStream("unpack error\n"))
+	assert.True(t, o.unpackFailed)
+	assert.False(t, o.diskFull.found)
+}
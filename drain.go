@@ -0,0 +1,207 @@
+package gitkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// File descriptors used by a running session, the connection and the pipes to git
+const sessionFDs = 4
+
+// ErrGracePeriodExceeded is returned by ServeContext if connections had to be
+// closed after Config.ShutdownGracePeriod
+var ErrGracePeriodExceeded = errors.New("connections closed after the shutdown grace period")
+
+var (
+	errShuttingDown       = errors.New("server is shutting down")
+	errServerBusy         = errors.New("too many open sessions")
+	errTooManyConnections = errors.New("too many open connections")
+)
+
+// connTracker tracks open connections and the goroutines serving them
+type connTracker struct {
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	hosts  map[string]int // Open connections by client IP
+	closed chan struct{}  // Closed by closeAll
+}
+
+// add tracks the connection unless it exceeds the limits of open connections
+// in total or from its client IP, zero means unlimited
+func (t *connTracker) add(conn net.Conn, maxTotal int, maxPerIP int) error {
+	host := lockoutKey(conn.RemoteAddr())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if maxTotal > 0 && len(t.conns) >= maxTotal {
+		return errTooManyConnections
+	}
+	if maxPerIP > 0 && t.hosts[host] >= maxPerIP {
+		return fmt.Errorf("too many connections from %s", host)
+	}
+
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+		t.hosts = map[string]int{}
+	}
+	t.conns[conn] = struct{}{}
+	t.hosts[host]++
+	t.wg.Add(1)
+	return nil
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	host := lockoutKey(conn.RemoteAddr())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, conn)
+	if t.hosts[host]--; t.hosts[host] <= 0 {
+		delete(t.hosts, host)
+	}
+	t.wg.Done()
+}
+
+// closing returns a channel that is closed once closeAll is called
+func (t *connTracker) closing() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed == nil {
+		t.closed = make(chan struct{})
+	}
+	return t.closed
+}
+
+// closeAll closes all open connections and returns their number
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed != nil {
+		close(t.closed)
+		t.closed = nil
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	return len(t.conns)
+}
+
+// ServeContext works like Serve until the context is done. It then stops
+// accepting connections and commands and waits for open connections to
+// finish, e.g. a running push. Connections still open after
+// Config.ShutdownGracePeriod are closed and ErrGracePeriodExceeded is returned.
+func (s *SSH) ServeContext(ctx context.Context) error {
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	atomic.StoreInt32(&s.draining, 1)
+	s.Stop()
+
+	// Serve returns before the wait group is waited on, so that no
+	// connections are added while waiting
+	drained := make(chan struct{})
+	go func() {
+		<-served
+		s.conns.wg.Wait()
+		close(drained)
+	}()
+
+	grace := time.NewTimer(s.config.shutdownGracePeriod())
+	defer grace.Stop()
+
+	select {
+	case <-drained:
+		return nil
+	case <-grace.C:
+	}
+
+	s.logger().Infof("ssh: closing %d connections after the shutdown grace period", s.conns.closeAll())
+	<-drained
+	return ErrGracePeriodExceeded
+}
+
+// ActiveSessions returns the number of sessions running a command
+func (s *SSH) ActiveSessions() int {
+	active, _ := s.stats.watchSessions()
+	return active
+}
+
+// Shutdown stops accepting connections and commands, then waits for running
+// sessions to finish. If the context is done first, its error is returned
+// and the remaining sessions keep running.
+func (s *SSH) Shutdown(ctx context.Context) error {
+	return s.ShutdownWithProgress(ctx, nil)
+}
+
+// ShutdownWithProgress works like Shutdown and calls progress with the
+// number of remaining sessions, once at the start and after every change,
+// e.g. to extend the grace period while a large clone is running.
+func (s *SSH) ShutdownWithProgress(ctx context.Context, progress func(remaining int)) error {
+	atomic.StoreInt32(&s.draining, 1)
+	err := s.Stop()
+
+	last := -1
+	for {
+		active, changed := s.stats.watchSessions()
+		if progress != nil && active != last {
+			progress(active)
+			last = active
+		}
+		if active == 0 {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// startSession counts a session as running unless the server is shutting
+// down or busy and returns the func to call once it is done
+func (s *SSH) startSession() (func(), error) {
+	done, ok := s.stats.sessionStarted(s.config.MaxOpenSessions)
+	if !ok {
+		return nil, errServerBusy
+	}
+	if atomic.LoadInt32(&s.draining) == 1 {
+		done()
+		return nil, errShuttingDown
+	}
+	return done, nil
+}
+
+// checkSessionLimit warns if MaxOpenSessions exceeds what the open file
+// limit of the process allows
+func (s *SSH) checkSessionLimit() {
+	if s.config.MaxOpenSessions <= 0 {
+		return
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return
+	}
+	if uint64(s.config.MaxOpenSessions)*sessionFDs > limit.Cur {
+		s.logger().Errorf("ssh: %d sessions may exceed the open file limit of %d", s.config.MaxOpenSessions, limit.Cur)
+	}
+}
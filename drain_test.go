@@ -0,0 +1,214 @@
+package gitkit
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_ShutdownWithProgress(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+		"wait": func(string, []string, io.ReadWriter) (int, error) {
+			<-release
+			return 0, nil
+		},
+	}})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	finished := make(chan error, 1)
+	go func() { finished <- session.Run("wait") }()
+
+	for i := 0; i < 100 && s.ActiveSessions() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, s.ActiveSessions())
+
+	// The context ends before the session
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+
+	// New commands are refused while draining
+	rejected, err := conn.NewSession()
+	assert.NoError(t, err)
+	stderr, err := rejected.StderrPipe()
+	assert.NoError(t, err)
+	rejected.Run("wait")
+	message, _ := ioutil.ReadAll(stderr)
+	assert.Equal(t, "Server is shutting down, please try again later.\r\n", string(message))
+
+	progress := []int{}
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ShutdownWithProgress(context.Background(), func(remaining int) {
+			progress = append(progress, remaining)
+			if len(progress) == 1 {
+				close(started)
+			}
+		})
+	}()
+
+	<-started
+	close(release)
+	assert.NoError(t, <-finished)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []int{1, 0}, progress)
+	assert.Equal(t, 0, s.ActiveSessions())
+}
+
+func TestSSH_MaxOpenSessions(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", MaxOpenSessions: 1, CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+		"wait": func(string, []string, io.ReadWriter) (int, error) {
+			<-release
+			return 0, nil
+		},
+	}})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	config := &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn, err := ssh.Dial("tcp", s.Address(), config)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	finished := make(chan error, 1)
+	go func() { finished <- session.Run("wait") }()
+
+	for i := 0; i < 100 && s.ActiveSessions() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, s.ActiveSessions())
+
+	// Sessions of open connections are rejected
+	rejected, err := conn.NewSession()
+	assert.NoError(t, err)
+	stderr, err := rejected.StderrPipe()
+	assert.NoError(t, err)
+	rejected.Run("wait")
+	message, _ := ioutil.ReadAll(stderr)
+	assert.Equal(t, "Server is busy, please try again later.\r\n", string(message))
+
+	// New connections wait until a session has finished
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := ssh.Dial("tcp", s.Address(), config)
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	select {
+	case err := <-dialed:
+		t.Fatalf("connection accepted while busy: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NoError(t, <-finished)
+	select {
+	case err := <-dialed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
+
+func TestSSH_ServeContext(t *testing.T) {
+	dir := t.TempDir()
+	release := make(chan struct{})
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", ShutdownGracePeriod: 200 * time.Millisecond, CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+		"wait": func(string, []string, io.ReadWriter) (int, error) {
+			<-release
+			return 0, nil
+		},
+		"read": func(_ string, _ []string, rw io.ReadWriter) (int, error) {
+			_, err := ioutil.ReadAll(rw)
+			return 0, err
+		},
+	}})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.ServeContext(ctx) }()
+
+	config := &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn, err := ssh.Dial("tcp", s.Address(), config)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	finished := make(chan error, 1)
+	go func() {
+		finished <- session.Run("wait")
+		conn.Close()
+	}()
+
+	for i := 0; i < 100 && s.ActiveSessions() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	// Running sessions finish within the grace period
+	select {
+	case err := <-served:
+		t.Fatalf("returned before the session finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.NoError(t, <-finished)
+	assert.NoError(t, <-served)
+	assert.Equal(t, 0, s.ActiveSessions())
+
+	// Connections still open after the grace period are closed
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { served <- s.ServeContext(ctx) }()
+
+	conn, err = ssh.Dial("tcp", s.Address(), config)
+	assert.NoError(t, err)
+	defer conn.Close()
+	session, err = conn.NewSession()
+	assert.NoError(t, err)
+	_, err = session.StdinPipe()
+	assert.NoError(t, err)
+	go func() { finished <- session.Run("read") }()
+
+	for i := 0; i < 100 && s.ActiveSessions() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, ErrGracePeriodExceeded, <-served)
+	assert.Error(t, <-finished)
+}
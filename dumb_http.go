@@ -0,0 +1,94 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+// Files of the dumb HTTP protocol, relative to the repository
+var (
+	dumbFileRegex    = regexp.MustCompile(`^(.*)/(HEAD|objects/info/(?:packs|alternates|http-alternates)|objects/[0-9a-f]{2}/[0-9a-f]{38,62}|objects/pack/pack-[0-9a-f]{40,64}\.(?:pack|idx))$`)
+	looseObjectRegex = regexp.MustCompile(`^objects/[0-9a-f]{2}/`)
+)
+
+// findDumbFile returns the repository path and file of a dumb HTTP request
+func findDumbFile(urlPath string) (string, string, bool) {
+	matches := dumbFileRegex.FindStringSubmatch(urlPath)
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
+// dumbContentType returns the content type git http-backend uses for the file
+func dumbContentType(file string) string {
+	switch {
+	case looseObjectRegex.MatchString(file):
+		return "application/x-git-loose-object"
+	case filepath.Ext(file) == ".pack":
+		return "application/x-git-packed-objects"
+	case filepath.Ext(file) == ".idx":
+		return "application/x-git-packed-objects-toc"
+	}
+	return "text/plain"
+}
+
+// getDumbFile serves a repository file for clients of the dumb HTTP protocol
+func (s *Server) getDumbFile(file string, w http.ResponseWriter, r *Request) {
+	context := "get-dumb-file"
+
+	// Files expose all refs and objects, pinned repos are only served by upload-pack
+	if pinned, err := s.config.pinnedRef(r.RepoName); pinned != "" || err != nil {
+		http.NotFound(w, r.Request)
+		return
+	}
+
+	// Dumb clients always fetch full history
+	policy, ok := s.checkUploadPolicy(context, w, r)
+	if !ok {
+		return
+	}
+	if policy.checksRequest() {
+		http.Error(w, "Repository can only be fetched shallow, use smart HTTP.", http.StatusForbidden)
+		return
+	}
+
+	// Lists of refs and packs are generated on demand
+	if file == "info/refs" || file == "objects/info/packs" {
+		cmd := exec.Command(s.config.GitPath, "update-server-info")
+		cmd.Dir = r.RepoPath
+		if out, err := cmd.CombinedOutput(); err != nil {
+			s.fail500(w, context, fmt.Errorf("update-server-info failed: %s", out))
+			return
+		}
+	}
+
+	f, err := os.Open(filepath.Join(r.RepoPath, filepath.FromSlash(file)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r.Request)
+			return
+		}
+		s.fail500(w, context, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", dumbContentType(file))
+	if dumbContentType(file) == "text/plain" {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		// Objects and packs never change
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	}
+	w.WriteHeader(200)
+
+	if _, err := io.Copy(w, f); err != nil {
+		s.logError(context, err)
+	}
+}
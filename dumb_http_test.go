@@ -0,0 +1,28 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_findDumbFile(t *testing.T) {
+	examples := map[string]string{
+		"/app.git/HEAD":                   "/app.git,HEAD,text/plain",
+		"/org/app.git/objects/info/packs": "/org/app.git,objects/info/packs,text/plain",
+		"/app.git/objects/e2/85100b636ac67fa28d85685072158edaa01685":               "/app.git,objects/e2/85100b636ac67fa28d85685072158edaa01685,application/x-git-loose-object",
+		"/app.git/objects/pack/pack-e285100b636ac67fa28d85685072158edaa01685.pack": "/app.git,objects/pack/pack-e285100b636ac67fa28d85685072158edaa01685.pack,application/x-git-packed-objects",
+		"/app.git/objects/pack/pack-e285100b636ac67fa28d85685072158edaa01685.idx":  "/app.git,objects/pack/pack-e285100b636ac67fa28d85685072158edaa01685.idx,application/x-git-packed-objects-toc",
+	}
+
+	for urlPath, expected := range examples {
+		repo, file, ok := findDumbFile(urlPath)
+		assert.True(t, ok, urlPath)
+		assert.Equal(t, expected, repo+","+file+","+dumbContentType(file))
+	}
+
+	for _, urlPath := range []string{"/app.git/config", "/app.git/hooks/pre-receive", "/app.git/objects/../config", "/app.git/info/refs"} {
+		_, _, ok := findDumbFile(urlPath)
+		assert.False(t, ok, urlPath)
+	}
+}
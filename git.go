@@ -1,51 +1,512 @@
 package gitkit
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
+// InitOptions holds optional settings for new repositories
+type InitOptions struct {
+	Alternates []string // Object directories to borrow objects from, e.g. of the forked repo
+
+	// Creator of the repository, passed to Config.OnRepoCreated
+	KeyID  string // SSH key ID or HTTP username
+	Remote string // Client address
+	Source string // How the repo was created, e.g. ssh or http, defaults to init
+}
+
+// RepoCreated describes a new repository, see Config.OnRepoCreated
+type RepoCreated struct {
+	Repo    string    // Normalized repository name
+	Path    string    // Full path to the repository
+	KeyID   string    // SSH key ID or HTTP username of the creator, empty for API calls
+	Remote  string    // Client address, empty for API calls
+	Source  string    // init, import, clone, ssh or http
+	Created time.Time // Time of creation
+}
+
+// repoCreated passes the new repository to OnRepoCreated
+func (c *Config) repoCreated(name string, source string, opts InitOptions) {
+	if c.OnRepoCreated == nil {
+		return
+	}
+
+	if opts.Source != "" {
+		source = opts.Source
+	}
+
+	c.OnRepoCreated(RepoCreated{
+		Repo:    name,
+		Path:    c.repoStore().Path(name),
+		KeyID:   opts.KeyID,
+		Remote:  opts.Remote,
+		Source:  source,
+		Created: time.Now(),
+	})
+}
+
+// NormalizeRepoName returns the canonical name of a repository: cleaned of
+// path traversal, without leading slash and with the .git suffix.
+// Empty names, control characters and path segments starting with a dash are rejected.
+func NormalizeRepoName(name string) (string, error) {
+	repo := cleanRepoName(name)
+
+	if repo == ".git" {
+		return "", fmt.Errorf("invalid repo name %q: name is empty", name)
+	}
+
+	for _, c := range repo {
+		if c < 0x20 || c == 0x7f {
+			return "", fmt.Errorf("invalid repo name %q: contains control characters", name)
+		}
+	}
+
+	for _, segment := range strings.Split(repo, "/") {
+		if strings.HasPrefix(segment, "-") {
+			return "", fmt.Errorf("invalid repo name %q: segments must not start with a dash", name)
+		}
+	}
+
+	return repo, nil
+}
+
+// cleanRepoName applies the canonical form without validating the name
+func cleanRepoName(name string) string {
+	// prevent path traversal
+	repo := strings.TrimPrefix(path.Clean(path.Join("/", name)), "/")
+
+	// allow to leave out the .git suffix
+	if !strings.HasSuffix(repo, ".git") {
+		repo = repo + ".git"
+	}
+
+	return repo
+}
+
 func InitRepo(name string, config *Config) error {
-	fullPath := path.Join(config.Dir, name)
+	return InitRepoWithOptions(name, config, InitOptions{})
+}
+
+func InitRepoWithOptions(name string, config *Config, opts InitOptions) error {
+	name, err := NormalizeRepoName(name)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockRepo(config.repoStore().Path(name))
+	defer unlock()
 
-	// allow to leave out the .git suffix in name
-	if !strings.HasSuffix(fullPath, ".git") {
-		fullPath = fullPath + ".git"
+	return initRepo(name, config, opts)
+}
+
+// initRepo creates the normalized repo, the caller holds its lock
+func initRepo(name string, config *Config, opts InitOptions) error {
+	if err := config.checkRepoPath(name); err != nil {
+		return err
+	}
+	if err := config.checkTemplateDir(); err != nil {
+		return err
 	}
+	store := config.repoStore()
 
-	if err := exec.Command(config.GitPath, "init", "--bare", "--initial-branch=main", fullPath).Run(); err != nil {
+	alternates, err := validateAlternates(opts.Alternates)
+	if err != nil {
 		return err
 	}
 
-	if config.AutoHooks && config.Hooks != nil {
-		return config.Hooks.setupInDir(fullPath)
+	release := acquireInitSlot(config)
+	defer release()
+
+	// Git reinitializes existing repos, which are not reported as created
+	existed := store.Exists(name)
+	if err := store.Create(name); err != nil {
+		return err
+	}
+	fullPath := store.Path(name)
+
+	if len(alternates) > 0 {
+		content := strings.Join(alternates, "\n") + "\n"
+		if err := ioutil.WriteFile(filepath.Join(fullPath, "objects", "info", "alternates"), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := config.applyRepoConfig(fullPath); err != nil {
+		return err
+	}
+
+	if config.AutoHooks && config.hasHooks() {
+		if err := config.setupHooksInDir(fullPath); err != nil {
+			return err
+		}
+	}
+
+	if !existed {
+		config.repoCreated(name, "init", opts)
+	}
+	return nil
+}
+
+// EnsureRepo creates the repository with hooks and RepoConfig unless it
+// already exists. It returns true if the repository has been created.
+func EnsureRepo(name string, config *Config) (bool, error) {
+	return ensureRepo(name, config, InitOptions{})
+}
+
+func ensureRepo(name string, config *Config, opts InitOptions) (bool, error) {
+	name, err := NormalizeRepoName(name)
+	if err != nil {
+		return false, err
+	}
+
+	unlock := lockRepo(config.repoStore().Path(name))
+	defer unlock()
+
+	if config.repoStore().Exists(name) {
+		return false, nil
+	}
+
+	if err := initRepo(name, config, opts); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Locks held while repositories are created, keyed by path
+var (
+	repoLocksMu sync.Mutex
+	repoLocks   = map[string]*repoLock{}
+)
+
+type repoLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockRepo serializes creation of a repository and returns the unlock func
+func lockRepo(path string) func() {
+	repoLocksMu.Lock()
+	lock, ok := repoLocks[path]
+	if !ok {
+		lock = &repoLock{}
+		repoLocks[path] = lock
+	}
+	lock.refs++
+	repoLocksMu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		repoLocksMu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(repoLocks, path)
+		}
+		repoLocksMu.Unlock()
+	}
+}
+
+// Semaphores of MaxConcurrentInits, keyed by Dir
+var (
+	initSlotsMu sync.Mutex
+	initSlots   = map[string]chan struct{}{}
+)
+
+// acquireInitSlot waits until fewer than MaxConcurrentInits repos are being
+// initialized in the directory and returns the release func
+func acquireInitSlot(config *Config) func() {
+	if config.MaxConcurrentInits <= 0 {
+		return func() {}
+	}
+
+	initSlotsMu.Lock()
+	slots, ok := initSlots[config.Dir]
+	if !ok || cap(slots) != config.MaxConcurrentInits {
+		slots = make(chan struct{}, config.MaxConcurrentInits)
+		initSlots[config.Dir] = slots
+	}
+	initSlotsMu.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+// applyRepoConfig sets the configured git config values in the repository
+func (c *Config) applyRepoConfig(repoPath string) error {
+	repoConfig := c.repoConfig()
+	keys := make([]string, 0, len(repoConfig))
+	for key := range repoConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		out, err := exec.Command(c.GitPath, "config", "--file", filepath.Join(repoPath, "config"), key, repoConfig[key]).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("cant set %s: %s", key, strings.TrimSpace(string(out)))
+		}
 	}
 
 	return nil
 }
 
+// validateAlternates checks that all alternates are existing object directories
+// and returns their absolute paths
+func validateAlternates(dirs []string) ([]string, error) {
+	result := make([]string, 0, len(dirs))
+
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sub := range []string{"info", "pack"} {
+			info, err := os.Stat(filepath.Join(absDir, sub))
+			if err != nil || !info.IsDir() {
+				return nil, fmt.Errorf("alternate %s is not an object directory", dir)
+			}
+		}
+
+		result = append(result, absDir)
+	}
+
+	return result, nil
+}
+
+// CloneRepo creates a bare repository from a remote url with hooks and RepoConfig
 func CloneRepo(name string, config *Config, url string) error {
-	fullPath := path.Join(config.Dir, name)
+	name, err := NormalizeRepoName(name)
+	if err != nil {
+		return err
+	}
+	if err := config.checkRepoPath(name); err != nil {
+		return err
+	}
+
+	store := config.repoStore()
+	fullPath := store.Path(name)
+
+	unlock := lockRepo(fullPath)
+	defer unlock()
 
-	// allow to leave out the .git suffix in name
-	if !strings.HasSuffix(fullPath, ".git") {
-		fullPath = fullPath + ".git"
+	if store.Exists(name) {
+		return fmt.Errorf("repo %s already exists", name)
 	}
 
-	if err := exec.Command(config.GitPath, "clone", "--bare", url, fullPath).Run(); err != nil {
+	release := acquireInitSlot(config)
+	defer release()
+
+	cmd := exec.Command(config.GitPath, "clone", "--bare", "--", url, fullPath)
+	cmd.Env = withoutRepoEnv(os.Environ())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cant clone %s: %s", url, strings.TrimSpace(string(out)))
+	}
+
+	if err := config.applyRepoConfig(fullPath); err != nil {
 		return err
 	}
 
-	if config.AutoHooks && config.Hooks != nil {
-		return config.Hooks.setupInDir(fullPath)
+	if config.AutoHooks && config.hasHooks() {
+		if err := config.setupHooksInDir(fullPath); err != nil {
+			return err
+		}
 	}
 
+	config.repoCreated(name, "clone", InitOptions{})
 	return nil
 }
 
+// ImportRepo copies an existing bare or non-bare repository from a local path
+// into a new bare repository with hooks and RepoConfig. Objects are hardlinked
+// if the source is on the same filesystem.
+func ImportRepo(name string, config *Config, sourcePath string) error {
+	name, err := NormalizeRepoName(name)
+	if err != nil {
+		return err
+	}
+	if err := config.checkRepoPath(name); err != nil {
+		return err
+	}
+
+	kind, err := repoKind(config.GitPath, sourcePath)
+	if err != nil {
+		return err
+	}
+	if kind == NotARepo {
+		return fmt.Errorf("%s is not a git repository", sourcePath)
+	}
+
+	store := config.repoStore()
+	fullPath := store.Path(name)
+
+	unlock := lockRepo(fullPath)
+	defer unlock()
+
+	if store.Exists(name) {
+		return fmt.Errorf("repo %s already exists", name)
+	}
+
+	release := acquireInitSlot(config)
+	defer release()
+
+	cmd := exec.Command(config.GitPath, "clone", "--bare", "--local", "--", sourcePath, fullPath)
+	cmd.Env = withoutRepoEnv(os.Environ())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cant import %s: %s", sourcePath, strings.TrimSpace(string(out)))
+	}
+
+	if err := config.applyRepoConfig(fullPath); err != nil {
+		return err
+	}
+
+	if config.AutoHooks && config.hasHooks() {
+		if err := config.setupHooksInDir(fullPath); err != nil {
+			return err
+		}
+	}
+
+	config.repoCreated(name, "import", InitOptions{})
+	return nil
+}
+
+// Kind describes what kind of git repository a directory holds
+type Kind int
+
+const (
+	NotARepo Kind = iota
+	Bare
+	NonBare
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Bare:
+		return "bare"
+	case NonBare:
+		return "non-bare"
+	default:
+		return "not a repository"
+	}
+}
+
+// Environment variables that point git at a specific repository
+var repoEnvVars = []string{
+	"GIT_DIR",
+	"GIT_WORK_TREE",
+	"GIT_COMMON_DIR",
+	"GIT_INDEX_FILE",
+	"GIT_OBJECT_DIRECTORY",
+	"GIT_ALTERNATE_OBJECT_DIRECTORIES",
+	"GIT_QUARANTINE_PATH",
+	"GIT_NAMESPACE",
+	"GIT_PREFIX",
+}
+
+// withoutRepoEnv removes repository specific git variables from the environment,
+// so that commands run from within hooks do not operate on the hook's repository.
+func withoutRepoEnv(env []string) []string {
+	result := make([]string, 0, len(env))
+
+outer:
+	for _, v := range env {
+		for _, name := range repoEnvVars {
+			if strings.HasPrefix(v, name+"=") {
+				continue outer
+			}
+		}
+		result = append(result, v)
+	}
+
+	return result
+}
+
+// RepoKind uses git to determine whether the directory is a bare repository,
+// a working tree with a .git directory, or not a repository at all.
+// Parent directories are never searched.
+func RepoKind(p string) (Kind, error) {
+	return repoKind("git", p)
+}
+
+// repoKind is RepoKind with the git binary of the config
+func repoKind(gitPath string, p string) (Kind, error) {
+	if gitPath == "" {
+		gitPath = "git"
+	}
+
+	dir, err := filepath.Abs(p)
+	if err != nil {
+		return NotARepo, err
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return NotARepo, nil
+		}
+		return NotARepo, err
+	}
+
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return NotARepo, err
+	}
+
+	cmd := exec.Command(gitPath, "rev-parse", "--is-bare-repository", "--absolute-git-dir")
+	cmd.Dir = dir
+	cmd.Env = append(withoutRepoEnv(os.Environ()), "GIT_CEILING_DIRECTORIES="+filepath.Dir(dir))
+
+	out, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return NotARepo, nil
+		}
+		return NotARepo, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return NotARepo, fmt.Errorf("unexpected rev-parse output: %q", out)
+	}
+
+	switch {
+	case lines[0] == "true" && lines[1] == dir:
+		return Bare, nil
+	case lines[0] == "false" && lines[1] == filepath.Join(dir, ".git"):
+		return NonBare, nil
+	}
+
+	return NotARepo, nil
+}
+
+// RepoExists returns true if git recognizes the path as a bare repository or
+// a working tree with a .git directory, see RepoKind
 func RepoExists(p string) bool {
-	_, err := os.Stat(path.Join(p, "objects"))
-	return err == nil
+	kind, err := RepoKind(p)
+	return err == nil && kind != NotARepo
+}
+
+// repoDirExists is the cheap check of the repo store and request handlers.
+// Only the layout is checked, without running git.
+func repoDirExists(p string) bool {
+	return isGitDir(p) || isGitDir(filepath.Join(p, ".git"))
+}
+
+// isGitDir returns true if the directory has the HEAD file, objects and refs
+// git requires of every repository
+func isGitDir(p string) bool {
+	for name, dir := range map[string]bool{"HEAD": false, "objects": true, "refs": true} {
+		info, err := os.Stat(filepath.Join(p, name))
+		if err != nil || info.IsDir() != dir {
+			return false
+		}
+	}
+	return true
 }
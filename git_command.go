@@ -2,12 +2,62 @@ package gitkit
 
 import (
 	"fmt"
-	"path"
 	"regexp"
 	"strings"
 )
 
-var gitCommandRegex = regexp.MustCompile(`^(git[-|\s]upload-pack|git[-|\s]upload-archive|git[-|\s]receive-pack) '(.*)'$`)
+// CommandForm is the spelling of a git command sent by the client
+type CommandForm int
+
+const (
+	DashedForm CommandForm = iota // git-upload-pack 'repo.git'
+	SpacedForm                    // git upload-pack 'repo.git'
+)
+
+// Git commands accepted over SSH. The executable may be prefixed with an
+// absolute path, as sent by some shims, e.g. /usr/bin/git-upload-pack 'repo.git'
+var (
+	dashedCommandRegex = regexp.MustCompile(`^(?:/\S*/)?(git-(?:upload-pack|upload-archive|receive-pack)) '(.*)'$`)
+	spacedCommandRegex = regexp.MustCompile(`^(?:/\S*/)?(git (?:upload-pack|upload-archive|receive-pack)) '(.*)'$`)
+	gitVerbRegex       = regexp.MustCompile(`^(?:/\S*/)?git[- ](upload-pack|upload-archive|receive-pack)(\s|$)`)
+)
+
+// CommandErrorReason categorizes why a command could not be parsed
+type CommandErrorReason string
+
+const (
+	CommandEmpty       CommandErrorReason = "empty"
+	CommandUnknownVerb CommandErrorReason = "unknown-verb"
+	CommandBadQuoting  CommandErrorReason = "bad-quoting"
+	CommandSpacedForm  CommandErrorReason = "spaced-form"
+	CommandBadRepo     CommandErrorReason = "bad-repo"
+)
+
+// CommandError is returned by ParseGitCommand for commands it does not accept
+type CommandError struct {
+	Command string
+	Reason  CommandErrorReason
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("invalid git command (%s): %q", e.Reason, e.Command)
+}
+
+// Message returns a short explanation suitable for the client
+func (e *CommandError) Message() string {
+	switch e.Reason {
+	case CommandEmpty:
+		return "No command provided. Interactive shells are not supported."
+	case CommandBadQuoting:
+		return "Invalid command. The repository must be a single-quoted argument."
+	case CommandBadRepo:
+		return "Invalid repository name."
+	case CommandSpacedForm:
+		return "Invalid command. Use the git-<command> form, e.g. git-upload-pack."
+	default:
+		return "Invalid command. Only git upload-pack, upload-archive and receive-pack are supported."
+	}
+}
 
 type GitCommand struct {
 	Command  string
@@ -15,26 +65,80 @@ type GitCommand struct {
 	Original string
 }
 
+// ParseGitCommand parses a git command in either dashed or spaced form
 func ParseGitCommand(cmd string) (*GitCommand, error) {
-	matches := gitCommandRegex.FindAllStringSubmatch(cmd, 1)
-	if len(matches) == 0 {
-		return nil, fmt.Errorf("invalid git command")
+	return parseGitCommand(cmd, DashedForm, SpacedForm)
+}
+
+// ParseGitCommandStrict only accepts the canonical dashed form, e.g. git-upload-pack
+func ParseGitCommandStrict(cmd string) (*GitCommand, error) {
+	return parseGitCommand(cmd, DashedForm)
+}
+
+func parseGitCommand(cmd string, forms ...CommandForm) (*GitCommand, error) {
+	var matches []string
+
+	for _, form := range forms {
+		regex := dashedCommandRegex
+		if form == SpacedForm {
+			regex = spacedCommandRegex
+		}
+		if matches = regex.FindStringSubmatch(cmd); matches != nil {
+			break
+		}
 	}
 
-	// prevent path traversal
-	safeRepo := path.Clean(path.Join("/", matches[0][2]))
-	safeRepo = strings.TrimPrefix(safeRepo, "/")
+	if matches == nil {
+		reason := CommandUnknownVerb
+		if strings.TrimSpace(cmd) == "" {
+			reason = CommandEmpty
+		} else if spacedCommandRegex.MatchString(cmd) {
+			reason = CommandSpacedForm
+		} else if gitVerbRegex.MatchString(cmd) {
+			reason = CommandBadQuoting
+		}
+		return nil, &CommandError{Command: cmd, Reason: reason}
+	}
 
-	// allow to leave out the .git suffix in remote
-	if !strings.HasSuffix(safeRepo, ".git") {
-		safeRepo = safeRepo + ".git"
+	safeRepo, err := NormalizeRepoName(matches[2])
+	if err != nil {
+		return nil, &CommandError{Command: cmd, Reason: CommandBadRepo}
 	}
 
 	result := &GitCommand{
 		Original: cmd,
-		Command:  matches[0][1],
+		Command:  matches[1],
 		Repo:     safeRepo,
 	}
 
 	return result, nil
 }
+
+// String returns the command as sent by git clients, e.g. git-upload-pack 'repo.git'
+func (c *GitCommand) String() string {
+	return fmt.Sprintf("%s '%s'", c.Command, c.Repo)
+}
+
+// Form returns whether the command was sent in dashed or spaced form
+func (c *GitCommand) Form() CommandForm {
+	if strings.HasPrefix(c.Command, "git ") {
+		return SpacedForm
+	}
+	return DashedForm
+}
+
+// Verb returns the git subcommand without the git prefix, e.g. upload-pack
+func (c *GitCommand) Verb() string {
+	return subCommand(strings.Replace(c.Command, " ", "-", 1))
+}
+
+// IsPack returns true if the command is upload-pack or receive-pack
+func (c *GitCommand) IsPack() bool {
+	verb := c.Verb()
+	return verb == "upload-pack" || verb == "receive-pack"
+}
+
+// IsReceivePack returns true if the command is a push
+func (c *GitCommand) IsReceivePack() bool {
+	return c.Verb() == "receive-pack"
+}
@@ -30,3 +30,52 @@ func TestParseGitCommand(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, cmd)
 }
+
+func TestParseGitCommandErrors(t *testing.T) {
+	examples := map[string]CommandErrorReason{
+		"":                                    CommandEmpty,
+		"   ":                                 CommandEmpty,
+		"git do-stuff":                        CommandUnknownVerb,
+		"git-lfs-authenticate 'hello' upload": CommandUnknownVerb,
+		"rm -rf /":                            CommandUnknownVerb,
+		"git-upload-pack hello.git":           CommandBadQuoting,
+		"git upload-pack \"hello.git\"":       CommandBadQuoting,
+		"git-receive-pack":                    CommandBadQuoting,
+	}
+
+	for s, expected := range examples {
+		cmd, err := ParseGitCommand(s)
+		assert.Nil(t, cmd)
+
+		cmdErr, ok := err.(*CommandError)
+		assert.True(t, ok, s)
+		assert.Equal(t, expected, cmdErr.Reason, s)
+		assert.Equal(t, s, cmdErr.Command)
+	}
+}
+
+func TestParseGitCommandForms(t *testing.T) {
+	examples := map[string]CommandForm{
+		"git-upload-pack 'hello.git'":                    DashedForm,
+		"git upload-pack 'hello.git'":                    SpacedForm,
+		"/usr/bin/git-upload-pack 'hello.git'":           DashedForm,
+		"/usr/lib/git-core/git-receive-pack 'hello.git'": DashedForm,
+		"/usr/bin/git receive-pack 'hello.git'":          SpacedForm,
+	}
+
+	for s, form := range examples {
+		cmd, err := ParseGitCommand(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, form, cmd.Form(), s)
+		assert.Equal(t, "hello.git", cmd.Repo)
+
+		cmd, err = ParseGitCommandStrict(s)
+		if form == DashedForm {
+			assert.NoError(t, err, s)
+			assert.Equal(t, DashedForm, cmd.Form())
+		} else {
+			assert.Nil(t, cmd)
+			assert.Equal(t, CommandSpacedForm, err.(*CommandError).Reason)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requireGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+}
+
+func TestRepoKind(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	assert.NoError(t, exec.Command("git", "init", "--bare", filepath.Join(dir, "bare.git")).Run())
+	assert.NoError(t, exec.Command("git", "init", filepath.Join(dir, "work")).Run())
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "work", "sub"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "broken", "objects"), 0755))
+
+	examples := map[string]Kind{
+		"bare.git":         Bare,
+		"bare.git/objects": NotARepo,
+		"work":             NonBare,
+		"work/sub":         NotARepo,
+		"broken":           NotARepo,
+		"missing":          NotARepo,
+	}
+
+	for name, expected := range examples {
+		kind, err := RepoKind(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, kind, name)
+		assert.Equal(t, expected != NotARepo, RepoExists(filepath.Join(dir, name)), name)
+	}
+
+	// Git verifies the contents, the layout is not enough
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "fake", "objects"), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "fake", "refs"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fake", "HEAD"), []byte("invalid"), 0644))
+	assert.False(t, RepoExists(filepath.Join(dir, "fake")))
+	assert.True(t, repoDirExists(filepath.Join(dir, "fake")))
+	kind, err := RepoKind(filepath.Join(dir, "fake"))
+	assert.NoError(t, err)
+	assert.Equal(t, NotARepo, kind)
+
+	_, err = repoKind(filepath.Join(dir, "missing-git"), filepath.Join(dir, "bare.git"))
+	assert.Error(t, err)
+}
+
+func TestInitRepoWithOptions(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	config := &Config{Dir: dir, GitPath: "git"}
+
+	assert.NoError(t, InitRepo("base", config))
+
+	objects := filepath.Join(dir, "base.git", "objects")
+	assert.NoError(t, InitRepoWithOptions("fork", config, InitOptions{Alternates: []string{objects}}))
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "fork.git", "objects", "info", "alternates"))
+	assert.NoError(t, err)
+	assert.Equal(t, objects+"\n", string(content))
+
+	err = InitRepoWithOptions("invalid", config, InitOptions{Alternates: []string{filepath.Join(dir, "base.git")}})
+	assert.Error(t, err)
+	assert.False(t, RepoExists(filepath.Join(dir, "invalid.git")))
+}
+
+func TestEnsureRepo(t *testing.T) {
+	requireGit(t)
+
+	config := &Config{
+		Dir:        t.TempDir(),
+		GitPath:    "git",
+		RepoConfig: map[string]string{"receive.denyNonFastForwards": "true"},
+	}
+
+	results := make(chan bool, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			created, err := EnsureRepo("app", config)
+			assert.NoError(t, err)
+			results <- created
+		}()
+	}
+
+	createdCount := 0
+	for i := 0; i < 4; i++ {
+		if <-results {
+			createdCount++
+		}
+	}
+	assert.Equal(t, 1, createdCount)
+
+	out, err := exec.Command("git", "config", "--file", filepath.Join(config.Dir, "app.git", "config"), "receive.denyNonFastForwards").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "true\n", string(out))
+
+	created, err := EnsureRepo("app.git", config)
+	assert.NoError(t, err)
+	assert.False(t, created)
+}
+
+// slowStore tracks the number of repos created at the same time
+type slowStore struct {
+	RepoStore
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (s *slowStore) Create(name string) error {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+	err := s.RepoStore.Create(name)
+
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	return err
+}
+
+func TestInitRepo_MaxConcurrentInits(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	store := &slowStore{RepoStore: NewFSRepoStore(dir, "git")}
+	config := &Config{Dir: dir, GitPath: "git", Store: store, MaxConcurrentInits: 2}
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			assert.NoError(t, InitRepo(name, config))
+		}(name)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 2, store.maxActive)
+	repos, err := store.List()
+	assert.NoError(t, err)
+	assert.Len(t, repos, 6)
+}
+
+func TestImportRepo(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	config := &Config{
+		Dir:        filepath.Join(dir, "repos"),
+		GitPath:    "git",
+		AutoHooks:  true,
+		Hooks:      &HookScripts{PreReceive: "echo hello"},
+		RepoConfig: map[string]string{"receive.denyNonFastForwards": "true"},
+	}
+
+	work := filepath.Join(dir, "work")
+	for _, args := range [][]string{
+		{"init", "-q", work},
+		{"-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		assert.NoError(t, exec.Command("git", args...).Run())
+	}
+
+	assert.NoError(t, ImportRepo("org/app", config, work))
+
+	repoPath := filepath.Join(config.Dir, "org", "app.git")
+	kind, err := RepoKind(repoPath)
+	assert.NoError(t, err)
+	assert.Equal(t, Bare, kind)
+	assert.FileExists(t, filepath.Join(repoPath, "hooks", "pre-receive"))
+
+	out, err := exec.Command("git", "-C", repoPath, "config", "receive.denyNonFastForwards").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "true\n", string(out))
+
+	out, err = exec.Command("git", "-C", repoPath, "rev-list", "--count", "HEAD").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", string(out))
+
+	assert.EqualError(t, ImportRepo("org/app", config, work), "repo org/app.git already exists")
+	assert.Error(t, ImportRepo("other", config, dir))
+	assert.False(t, RepoExists(filepath.Join(config.Dir, "other.git")))
+
+	// Clones are set up like imported repos
+	assert.NoError(t, CloneRepo("org/mirror", config, work))
+	mirrorPath := filepath.Join(config.Dir, "org", "mirror.git")
+	assert.FileExists(t, filepath.Join(mirrorPath, "hooks", "pre-receive"))
+	out, err = exec.Command("git", "-C", mirrorPath, "config", "receive.denyNonFastForwards").Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "true\n", string(out))
+}
+
+func TestConfig_OnRepoCreated(t *testing.T) {
+	requireGit(t)
+
+	created := []RepoCreated{}
+	config := &Config{Dir: t.TempDir(), GitPath: "git", OnRepoCreated: func(repo RepoCreated) {
+		created = append(created, repo)
+	}}
+
+	assert.NoError(t, InitRepo("app", config))
+	assert.NoError(t, InitRepo("app", config))
+	_, err := ensureRepo("org/app", config, InitOptions{KeyID: "alice", Remote: "10.0.0.1:4022", Source: "ssh"})
+	assert.NoError(t, err)
+	_, err = ensureRepo("org/app", config, InitOptions{KeyID: "bob", Source: "ssh"})
+	assert.NoError(t, err)
+	assert.NoError(t, ImportRepo("copy", config, filepath.Join(config.Dir, "app.git")))
+	assert.NoError(t, CloneRepo("mirror", config, filepath.Join(config.Dir, "app.git")))
+	assert.EqualError(t, CloneRepo("mirror", config, filepath.Join(config.Dir, "app.git")), "repo mirror.git already exists")
+
+	if assert.Len(t, created, 4) {
+		assert.Equal(t, "app.git", created[0].Repo)
+		assert.Equal(t, filepath.Join(config.Dir, "app.git"), created[0].Path)
+		assert.Equal(t, "init", created[0].Source)
+		assert.Equal(t, "", created[0].KeyID)
+		assert.False(t, created[0].Created.IsZero())
+
+		assert.Equal(t, "org/app.git", created[1].Repo)
+		assert.Equal(t, "alice", created[1].KeyID)
+		assert.Equal(t, "10.0.0.1:4022", created[1].Remote)
+		assert.Equal(t, "ssh", created[1].Source)
+
+		assert.Equal(t, "copy.git", created[2].Repo)
+		assert.Equal(t, "import", created[2].Source)
+
+		assert.Equal(t, "mirror.git", created[3].Repo)
+		assert.Equal(t, "clone", created[3].Source)
+	}
+}
+
+func TestNormalizeRepoName(t *testing.T) {
+	examples := map[string]string{
+		"app":                 "app.git",
+		"app.git":             "app.git",
+		"/app.git":            "app.git",
+		"org/app":             "org/app.git",
+		"//org//app.git":      "org/app.git",
+		"../../etc/app":       "etc/app.git",
+		"org/../app":          "app.git",
+		"org/./team/app.git/": "org/team/app.git",
+	}
+
+	for name, expected := range examples {
+		repo, err := NormalizeRepoName(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, repo, name)
+	}
+
+	for _, name := range []string{"", "/", "..", "-app", "org/--upload-pack=x", "app\n.git"} {
+		_, err := NormalizeRepoName(name)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,43 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// ErrHandlerTimeout is returned if a handler does not finish in time
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// callHandler runs fn and turns panics into errors, so a buggy handler can not
+// take down the session. If timeout is set, the handler is abandoned once the
+// deadline is reached. It keeps running in the background since Go can not
+// stop it. Panics are logged with their stack trace to logger.
+func callHandler(logger Logger, name string, timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Errorf("%s: panic: %v\n%s", name, r, debug.Stack())
+				done <- fmt.Errorf("%s panicked: %v", name, r)
+			}
+		}()
+		done <- fn()
+	}()
+
+	if timeout <= 0 {
+		return <-done
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("%s did not finish within %v: %w", name, timeout, ErrHandlerTimeout)
+	}
+}
@@ -0,0 +1,32 @@
+package gitkit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_callHandler(t *testing.T) {
+	failed := errors.New("failed")
+	assert.NoError(t, callHandler(stdLogger{}, "handler", 0, func() error { return nil }))
+	assert.Equal(t, failed, callHandler(stdLogger{}, "handler", time.Second, func() error { return failed }))
+
+	logger := &recordingLogger{}
+	err := callHandler(logger, "handler", 0, func() error { panic("boom") })
+	assert.EqualError(t, err, "handler panicked: boom")
+	if assert.Len(t, logger.recorded(), 1) {
+		assert.True(t, strings.HasPrefix(logger.recorded()[0], "error handler: panic: boom\n"))
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	err = callHandler(stdLogger{}, "handler", 10*time.Millisecond, func() error {
+		<-release
+		return nil
+	})
+	assert.True(t, errors.Is(err, ErrHandlerTimeout))
+	assert.EqualError(t, err, "handler did not finish within 10ms: handler timed out")
+}
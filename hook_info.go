@@ -27,36 +27,159 @@ type HookInfo struct {
 	Ref      string
 	RefType  string
 	RefName  string
+
+	ChangedFiles []string // Paths changed by the push, set if Receiver.DetectChanges is enabled
+
+	// SSH key ID or HTTP username of the pusher, read from GITKIT_KEY in hooks
+	KeyID string
+}
+
+// Defaults of HookInputLimits
+const (
+	DefaultMaxHookLineLength = 4096
+	DefaultMaxHookRefs       = 10000
+)
+
+// HookInputLimits bounds the hook input, which is read from external processes
+type HookInputLimits struct {
+	MaxLineLength int // Max length of a ref update line, defaults to 4096 bytes
+	MaxRefs       int // Max number of ref updates, defaults to 10000
+}
+
+func (l HookInputLimits) maxLineLength() int {
+	if l.MaxLineLength <= 0 {
+		return DefaultMaxHookLineLength
+	}
+	return l.MaxLineLength
+}
+
+func (l HookInputLimits) maxRefs() int {
+	if l.MaxRefs <= 0 {
+		return DefaultMaxHookRefs
+	}
+	return l.MaxRefs
+}
+
+// scanner returns a line scanner that fails on lines above the limit
+func (l HookInputLimits) scanner(input io.Reader) *bufio.Scanner {
+	// The max token size is the larger of the limit and the initial buffer
+	size := l.maxLineLength() + 1
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, size), size)
+	return scanner
+}
+
+func (l HookInputLimits) scanErr(err error) error {
+	if err == bufio.ErrTooLong {
+		return fmt.Errorf("hook input line exceeds %d bytes", l.maxLineLength())
+	}
+	return err
 }
 
 // ReadHookInput reads the hook context
 func ReadHookInput(input io.Reader) (*HookInfo, error) {
-	reader := bufio.NewReader(input)
+	return ReadHookInputWithLimits(input, HookInputLimits{})
+}
+
+// ReadHookInputWithLimits reads the hook context of the first ref update,
+// failing if the line is longer than allowed
+func ReadHookInputWithLimits(input io.Reader, limits HookInputLimits) (*HookInfo, error) {
+	scanner := limits.scanner(input)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, limits.scanErr(err)
+		}
+		return nil, io.EOF
+	}
 
-	line, _, err := reader.ReadLine()
-	if err != nil {
-		return nil, err
+	return parseHookLine(scanner.Text())
+}
+
+// ReadHookInputs reads the hook context of every ref updated by the push
+func ReadHookInputs(input io.Reader) ([]*HookInfo, error) {
+	return ReadHookInputsWithLimits(input, HookInputLimits{})
+}
+
+// ReadHookInputsWithLimits reads the hook context of every ref updated by the
+// push, failing if a line is too long or the push updates too many refs
+func ReadHookInputsWithLimits(input io.Reader, limits HookInputLimits) ([]*HookInfo, error) {
+	hooks := []*HookInfo{}
+	scanner := limits.scanner(input)
+
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		if len(hooks) == limits.maxRefs() {
+			return nil, fmt.Errorf("hook input exceeds %d refs", limits.maxRefs())
+		}
+
+		hook, err := parseHookLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, limits.scanErr(err)
+	}
+	if len(hooks) == 0 {
+		return nil, io.EOF
+	}
+
+	return hooks, nil
+}
+
+// ReadUpdateHookArgs reads the hook context of the update hook, which is run
+// once per ref with the ref, old and new revision as arguments, e.g. os.Args[1:]
+func ReadUpdateHookArgs(args []string) (*HookInfo, error) {
+	if len(args) != 3 || strings.Count(args[0], "/") < 2 {
+		return nil, fmt.Errorf("Invalid update hook arguments")
 	}
 
-	chunks := strings.Split(string(line), " ")
-	if len(chunks) != 3 {
+	dir, _ := os.Getwd()
+	info := newHookInfo(filepath.Base(dir), dir, args[1], args[2], args[0])
+	info.KeyID = os.Getenv(KeyIDEnv)
+	return info, nil
+}
+
+// parseHookLine parses a single "<old-rev> <new-rev> <ref>" line of hook input
+func parseHookLine(line string) (*HookInfo, error) {
+	chunks := strings.Split(line, " ")
+	if len(chunks) != 3 || strings.Count(chunks[2], "/") < 2 {
 		return nil, fmt.Errorf("Invalid hook input")
 	}
-	refchunks := strings.Split(chunks[2], "/")
 
 	dir, _ := os.Getwd()
-	info := HookInfo{
-		RepoName: filepath.Base(dir),
-		RepoPath: dir,
-		OldRev:   chunks[0],
-		NewRev:   chunks[1],
-		Ref:      chunks[2],
-		RefType:  refchunks[1],
-		RefName:  refchunks[2],
+	info := newHookInfo(filepath.Base(dir), dir, chunks[0], chunks[1], chunks[2])
+	info.KeyID = os.Getenv(KeyIDEnv)
+	return info, nil
+}
+
+// newHookInfo builds the hook context for a single ref update
+func newHookInfo(repoName, repoPath, oldRev, newRev, ref string) *HookInfo {
+	info := &HookInfo{
+		RepoName: repoName,
+		RepoPath: repoPath,
+		OldRev:   oldRev,
+		NewRev:   newRev,
+		Ref:      ref,
+	}
+
+	refchunks := strings.SplitN(ref, "/", 3)
+	if len(refchunks) == 3 {
+		info.RefType = refchunks[1]
+		info.RefName = refchunks[2]
+	}
+	if info.RepoName == "" {
+		info.RepoName = filepath.Base(repoPath)
 	}
-	info.Action = parseHookAction(info)
+	info.Action = parseHookAction(*info)
 
-	return &info, nil
+	return info
 }
 
 func parseHookAction(h HookInfo) string {
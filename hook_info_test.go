@@ -1,6 +1,7 @@
 package gitkit
 
 import (
+	"os"
 	"strings"
 	"testing"
 
@@ -19,6 +20,70 @@ func Test_ReadHookInput(t *testing.T) {
 	assert.Equal(t, "master", info.RefName)
 }
 
+func Test_ReadHookInputs(t *testing.T) {
+	input := "e285100b636ac67fa28d85685072158edaa01685 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/heads/feature/x\n" +
+		"0000000000000000000000000000000000000000 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/tags/v1.0\n"
+	hooks, err := ReadHookInputs(strings.NewReader(input))
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(hooks))
+	assert.Equal(t, "feature/x", hooks[0].RefName)
+	assert.Equal(t, BranchPushAction, hooks[0].Action)
+	assert.Equal(t, "v1.0", hooks[1].RefName)
+	assert.Equal(t, TagCreateAction, hooks[1].Action)
+
+	_, err = ReadHookInputs(strings.NewReader("foo bar\n"))
+	assert.Error(t, err)
+}
+
+func Test_ReadUpdateHookArgs(t *testing.T) {
+	info, err := ReadUpdateHookArgs([]string{"refs/heads/master", ZeroSHA, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, ZeroSHA, info.OldRev)
+	assert.Equal(t, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2", info.NewRev)
+	assert.Equal(t, "refs/heads/master", info.Ref)
+	assert.Equal(t, "master", info.RefName)
+	assert.Equal(t, BranchCreateAction, info.Action)
+
+	_, err = ReadUpdateHookArgs([]string{ZeroSHA, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"})
+	assert.Error(t, err)
+
+	_, err = ReadUpdateHookArgs([]string{"master", ZeroSHA, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"})
+	assert.Error(t, err)
+}
+
+func Test_ReadHookInput_KeyID(t *testing.T) {
+	os.Setenv(KeyIDEnv, "alice")
+	defer os.Unsetenv(KeyIDEnv)
+
+	info, err := ReadHookInput(strings.NewReader(ZeroSHA + " a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/heads/main\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", info.KeyID)
+
+	info, err = ReadUpdateHookArgs([]string{"refs/heads/main", ZeroSHA, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", info.KeyID)
+}
+
+func Test_ReadHookInputLimits(t *testing.T) {
+	line := "e285100b636ac67fa28d85685072158edaa01685 a3d33576d686e7dc1d90ec4b1a6e94e760a893b2 refs/heads/"
+
+	_, err := ReadHookInput(strings.NewReader(line + strings.Repeat("x", DefaultMaxHookLineLength) + "\n"))
+	assert.EqualError(t, err, "hook input line exceeds 4096 bytes")
+
+	limits := HookInputLimits{MaxLineLength: 100, MaxRefs: 2}
+	_, err = ReadHookInputsWithLimits(strings.NewReader(line+"main\n"+line+strings.Repeat("x", 20)+"\n"), limits)
+	assert.EqualError(t, err, "hook input line exceeds 100 bytes")
+
+	hooks, err := ReadHookInputsWithLimits(strings.NewReader(line+"a\n"+line+"b\n"), limits)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(hooks))
+
+	_, err = ReadHookInputsWithLimits(strings.NewReader(line+"a\n"+line+"b\n"+line+"c\n"), limits)
+	assert.EqualError(t, err, "hook input exceeds 2 refs")
+}
+
 func Test_HookAction(t *testing.T) {
 	examples := map[string]HookInfo{
 		"branch.create": HookInfo{
@@ -0,0 +1,322 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func (c *HookScripts) scripts() map[string]string {
+	return map[string]string{
+		"pre-receive":  c.PreReceive,
+		"update":       c.Update,
+		"post-receive": c.PostReceive,
+	}
+}
+
+// hookFile is a single file managed in the hooks directory of a repo
+type hookFile struct {
+	content []byte
+	mode    os.FileMode
+}
+
+// hasHooks returns true if any hooks are configured
+func (c *Config) hasHooks() bool {
+	return c.Hooks != nil || c.HookTemplateDir != ""
+}
+
+// hookFiles returns the managed hook files keyed by their path relative to
+// the hooks directory. Files from the template directory are overridden by
+// the configured hook scripts.
+func (c *Config) hookFiles() (map[string]hookFile, error) {
+	files := map[string]hookFile{}
+
+	if c.HookTemplateDir != "" {
+		walk := func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			info, err := os.Stat(p)
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			content, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(c.HookTemplateDir, p)
+			if err != nil {
+				return err
+			}
+
+			files[rel] = hookFile{content: content, mode: info.Mode().Perm()}
+			return nil
+		}
+
+		if err := filepath.WalkDir(c.HookTemplateDir, walk); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Hooks != nil {
+		for name, script := range c.Hooks.scripts() {
+			// Dont create hook if there's no script content
+			if script == "" {
+				continue
+			}
+			files[name] = hookFile{content: []byte(script), mode: 0755}
+		}
+	}
+
+	return files, nil
+}
+
+// setupHooksInDir configures the managed hooks in the repo base directory,
+// or points the repo to CentralHooksPath if set
+func (c *Config) setupHooksInDir(path string) error {
+	if c.CentralHooksPath != "" {
+		_, err := c.setHooksPath(path)
+		return err
+	}
+
+	files, err := c.hookFiles()
+	if err != nil {
+		return err
+	}
+	return writeHooks(filepath.Join(path, "hooks"), files)
+}
+
+// centralHooksPath returns the absolute path of CentralHooksPath, repos
+// resolve a relative core.hooksPath against their own directory
+func (c *Config) centralHooksPath() (string, error) {
+	return filepath.Abs(c.CentralHooksPath)
+}
+
+// setHooksPath sets core.hooksPath of the repo to CentralHooksPath unless
+// already set. It returns true if the repo config has been changed.
+func (c *Config) setHooksPath(path string) (bool, error) {
+	hooksPath, err := c.centralHooksPath()
+	if err != nil {
+		return false, err
+	}
+
+	configFile := filepath.Join(path, "config")
+	current, _ := exec.Command(c.GitPath, "config", "--file", configFile, "--get", "core.hooksPath").Output()
+	if strings.TrimSpace(string(current)) == hooksPath {
+		return false, nil
+	}
+
+	out, err := exec.Command(c.GitPath, "config", "--file", configFile, "core.hooksPath", hooksPath).CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("cant set core.hooksPath: %s", strings.TrimSpace(string(out)))
+	}
+	return true, nil
+}
+
+// SyncHooks rewrites the managed hooks of every repository whose hooks differ
+// from the configured scripts and template directory, regardless of AutoHooks.
+// It returns the names of the updated repositories. With CentralHooksPath the
+// shared directory is rewritten instead and the updated repositories are the
+// ones whose core.hooksPath had to be set.
+func SyncHooks(config *Config) ([]string, error) {
+	updated := []string{}
+	if !config.hasHooks() {
+		return updated, nil
+	}
+
+	files, err := config.hookFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CentralHooksPath != "" {
+		return syncCentralHooks(config, files)
+	}
+
+	store := config.repoStore()
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		hooksPath := filepath.Join(store.Path(name), "hooks")
+
+		inSync, err := hooksInSync(hooksPath, files)
+		if err != nil {
+			return updated, err
+		}
+		if inSync {
+			continue
+		}
+
+		if err := writeHooks(hooksPath, files); err != nil {
+			return updated, err
+		}
+		updated = append(updated, name)
+	}
+
+	return updated, nil
+}
+
+// syncCentralHooks rewrites CentralHooksPath if it differs from the configured
+// hooks and points all repos to it
+func syncCentralHooks(config *Config, files map[string]hookFile) ([]string, error) {
+	updated := []string{}
+
+	inSync, err := hooksInSync(config.CentralHooksPath, files)
+	if err != nil {
+		return nil, err
+	}
+	if !inSync {
+		if err := writeHooks(config.CentralHooksPath, files); err != nil {
+			return nil, err
+		}
+	}
+
+	store := config.repoStore()
+	names, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		changed, err := config.setHooksPath(store.Path(name))
+		if err != nil {
+			return updated, err
+		}
+		if changed {
+			updated = append(updated, name)
+		}
+	}
+
+	return updated, nil
+}
+
+// hooksInSync returns true if the hooks directory contains exactly the given files
+func hooksInSync(basePath string, files map[string]hookFile) (bool, error) {
+	found := 0
+	inSync := true
+
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				inSync = len(files) == 0
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(basePath, p)
+		if err != nil {
+			return err
+		}
+
+		file, ok := files[rel]
+		if !ok {
+			inSync = false
+			return fs.SkipDir
+		}
+
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm() != file.mode || !bytes.Equal(content, file.content) {
+			inSync = false
+			return fs.SkipDir
+		}
+
+		found++
+		return nil
+	}
+
+	if err := filepath.WalkDir(basePath, walk); err != nil {
+		return false, err
+	}
+
+	return inSync && found == len(files), nil
+}
+
+// writeHooks replaces the contents of the hooks directory with files. The
+// files are written to a temporary directory next to basePath, which is then
+// renamed into place, so the old hooks stay in effect until the new ones are
+// complete and are restored if the update fails.
+func writeHooks(basePath string, files map[string]hookFile) error {
+	parent := filepath.Dir(basePath)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	tmpPath, err := ioutil.TempDir(parent, "."+filepath.Base(basePath)+"-new-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpPath)
+
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return err
+	}
+
+	// Write new hook files
+	for name, file := range files {
+		fullPath := filepath.Join(tmpPath, name)
+
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(fullPath, file.content, file.mode); err != nil {
+			return err
+		}
+
+		// Preserve the exact permissions regardless of umask
+		if err := os.Chmod(fullPath, file.mode); err != nil {
+			return err
+		}
+	}
+
+	// Move the old hooks aside, they are only removed once the new ones are in place
+	oldPath := ""
+	if _, err := os.Lstat(basePath); err == nil {
+		oldPath = tmpPath + ".old"
+		if err := os.Rename(basePath, oldPath); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, basePath); err != nil {
+		if oldPath != "" {
+			os.Rename(oldPath, basePath)
+		}
+		return err
+	}
+
+	if oldPath != "" {
+		return os.RemoveAll(oldPath)
+	}
+	return nil
+}
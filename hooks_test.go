@@ -0,0 +1,152 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_setupHooksInDir(t *testing.T) {
+	templateDir := t.TempDir()
+	repoDir := t.TempDir()
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(templateDir, "lib"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(templateDir, "pre-receive"), []byte("template"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(templateDir, "post-receive"), []byte("template"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(templateDir, "lib", "common.sh"), []byte("helpers"), 0644))
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(repoDir, "hooks"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repoDir, "hooks", "update.sample"), []byte("sample"), 0755))
+
+	config := Config{
+		HookTemplateDir: templateDir,
+		Hooks:           &HookScripts{PreReceive: "script"},
+	}
+	assert.NoError(t, config.setupHooksInDir(repoDir))
+
+	examples := map[string]struct {
+		content string
+		mode    os.FileMode
+	}{
+		"pre-receive":   {"script", 0755},
+		"post-receive":  {"template", 0755},
+		"lib/common.sh": {"helpers", 0644},
+	}
+
+	for name, expected := range examples {
+		path := filepath.Join(repoDir, "hooks", name)
+
+		content, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.content, string(content))
+
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.mode, info.Mode().Perm())
+	}
+
+	_, err := os.Stat(filepath.Join(repoDir, "hooks", "update.sample"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncHooks(t *testing.T) {
+	requireGit(t)
+
+	config := &Config{
+		Dir:   t.TempDir(),
+		Hooks: &HookScripts{PreReceive: "script"},
+	}
+	store := config.repoStore()
+	assert.NoError(t, store.Create("a"))
+	assert.NoError(t, store.Create("b"))
+
+	updated, err := SyncHooks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.git", "b.git"}, updated)
+
+	updated, err = SyncHooks(config)
+	assert.NoError(t, err)
+	assert.Empty(t, updated)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(store.Path("b"), "hooks", "pre-receive"), []byte("changed"), 0755))
+	updated, err = SyncHooks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.git"}, updated)
+}
+
+func TestSyncHooks_CentralHooksPath(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	config := &Config{
+		GitPath:          "git",
+		Dir:              filepath.Join(dir, "repos"),
+		AutoHooks:        true,
+		Hooks:            &HookScripts{PreReceive: "script"},
+		CentralHooksPath: filepath.Join(dir, "hooks"),
+	}
+	store := config.repoStore()
+	assert.NoError(t, store.Create("a"))
+
+	updated, err := SyncHooks(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.git"}, updated)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "hooks", "pre-receive"))
+	assert.NoError(t, err)
+	assert.Equal(t, "script", string(content))
+
+	updated, err = SyncHooks(config)
+	assert.NoError(t, err)
+	assert.Empty(t, updated)
+
+	// New repos point to the shared directory without hooks of their own
+	assert.NoError(t, InitRepo("b", config))
+	_, err = os.Stat(filepath.Join(store.Path("b"), "hooks", "pre-receive"))
+	assert.True(t, os.IsNotExist(err))
+
+	for _, name := range []string{"a", "b"} {
+		out, err := exec.Command("git", "--git-dir", store.Path(name), "config", "core.hooksPath").Output()
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "hooks")+"\n", string(out))
+	}
+}
+
+func Test_writeHooks(t *testing.T) {
+	dir := t.TempDir()
+	hooksPath := filepath.Join(dir, "hooks")
+	assert.NoError(t, writeHooks(hooksPath, map[string]hookFile{
+		"pre-receive": {content: []byte("old"), mode: 0755},
+		"stale":       {content: []byte("stale"), mode: 0644},
+	}))
+
+	assert.NoError(t, writeHooks(hooksPath, map[string]hookFile{
+		"pre-receive": {content: []byte("new"), mode: 0755},
+	}))
+	content, err := ioutil.ReadFile(filepath.Join(hooksPath, "pre-receive"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+	_, err = os.Stat(filepath.Join(hooksPath, "stale"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Failed updates keep the previous hooks in place
+	err = writeHooks(hooksPath, map[string]hookFile{
+		"pre-receive":   {content: []byte("broken"), mode: 0755},
+		"pre-receive/x": {content: []byte("broken"), mode: 0755},
+	})
+	assert.Error(t, err)
+	content, err = ioutil.ReadFile(filepath.Join(hooksPath, "pre-receive"))
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+
+	// No temporary directories are left behind
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "hooks", entries[0].Name())
+	}
+}
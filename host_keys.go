@@ -0,0 +1,219 @@
+package gitkit
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH extension to tell clients about all host keys of the server, see
+// PROTOCOL in the OpenSSH sources. Clients with UpdateHostKeys enabled ask
+// the server to prove it owns the keys they don't know yet.
+const (
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// ErrRotationInProgress is returned by RotateHostKeys while keys are rotated
+var ErrRotationInProgress = errors.New("host key rotation already in progress")
+
+// serverConfig returns the current SSH server config
+func (s *SSH) serverConfig() *ssh.ServerConfig {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.sshconfig
+}
+
+// signers returns the current host keys
+func (s *SSH) signers() []ssh.Signer {
+	s.keysMu.RLock()
+	defer s.keysMu.RUnlock()
+	return s.hostKeys
+}
+
+// Reload reads the host keys from KeyDir or HostKeys again. New connections use the
+// reloaded keys, open connections are not affected.
+func (s *SSH) Reload() error {
+	return s.loadServerConfig()
+}
+
+// RotateHostKeys replaces the host keys in KeyDir with newly generated ones.
+// During the grace period the server keeps presenting the old keys and
+// announces the new ones to OpenSSH clients, which add them to known_hosts
+// if UpdateHostKeys is enabled. Afterwards the new keys replace the old ones
+// and are loaded with Reload. The new keys are discarded if ctx is done first.
+func (s *SSH) RotateHostKeys(ctx context.Context, grace time.Duration) error {
+	if s.config.HostKeyPassphrase != "" {
+		return fmt.Errorf("cant rotate encrypted host keys")
+	}
+	if len(s.config.HostKeys) > 0 {
+		return fmt.Errorf("cant rotate host keys that are not in KeyDir")
+	}
+	if !atomic.CompareAndSwapInt32(&s.rotating, 0, 1) {
+		return ErrRotationInProgress
+	}
+	defer atomic.StoreInt32(&s.rotating, 0)
+
+	keyTypes, err := s.config.hostKeyTypes()
+	if err != nil {
+		return err
+	}
+
+	var next []ssh.Signer
+	for _, keyType := range keyTypes {
+		path := s.config.KeyPath(keyType) + ".next"
+
+		// Keys left behind by an interrupted rotation are never used
+		if err := removeHostKey(path); err != nil {
+			return err
+		}
+		if err := hostKeyGenerators[keyType](path, s.config.KeyFormat); err != nil {
+			return err
+		}
+
+		signer, err := readHostKey(path, "")
+		if err != nil {
+			return err
+		}
+		next = append(next, signer)
+	}
+
+	s.setNextHostKeys(next)
+	defer s.setNextHostKeys(nil)
+
+	select {
+	case <-ctx.Done():
+		for _, keyType := range keyTypes {
+			if err := removeHostKey(s.config.KeyPath(keyType) + ".next"); err != nil {
+				s.logger().Errorf("ssh: cant remove host key: %v", err)
+			}
+		}
+		return ctx.Err()
+	case <-time.After(grace):
+	}
+
+	for _, keyType := range keyTypes {
+		path := s.config.KeyPath(keyType)
+		if err := os.Rename(path+".next.pub", path+".pub"); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".next", path); err != nil {
+			return err
+		}
+	}
+
+	s.logger().Infof("ssh: rotated host keys in %s", s.config.KeyDir)
+	return s.Reload()
+}
+
+func (s *SSH) setNextHostKeys(keys []ssh.Signer) {
+	s.keysMu.Lock()
+	s.nextHostKeys = keys
+	s.keysMu.Unlock()
+}
+
+// removeHostKey removes the private and public key file, if present
+func removeHostKey(path string) error {
+	for _, file := range []string{path, path + ".pub"} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// announceHostKeys sends the current and next host keys to the client while
+// keys are rotated
+func (s *SSH) announceHostKeys(conn *ssh.ServerConn) {
+	s.keysMu.RLock()
+	keys := append(append([]ssh.Signer{}, s.hostKeys...), s.nextHostKeys...)
+	rotating := len(s.nextHostKeys) > 0
+	s.keysMu.RUnlock()
+
+	if !rotating {
+		return
+	}
+
+	var payload []byte
+	for _, key := range keys {
+		payload = append(payload, ssh.Marshal(struct{ Key []byte }{key.PublicKey().Marshal()})...)
+	}
+	if _, _, err := conn.SendRequest(hostKeysRequest, false, payload); err != nil {
+		s.logger().Errorf("ssh: cant announce host keys: %v", err)
+	}
+}
+
+// handleGlobalRequests answers host key proofs and rejects other requests
+func (s *SSH) handleGlobalRequests(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != hostKeysProveRequest || !req.WantReply {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+
+		proof, err := s.proveHostKeys(conn.SessionID(), req.Payload)
+		if err != nil {
+			s.logger().Errorf("ssh: cant prove host keys to %s: %v", conn.RemoteAddr(), err)
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, proof)
+	}
+}
+
+// proveHostKeys signs the session ID with each of the requested host keys
+func (s *SSH) proveHostKeys(sessionID []byte, payload []byte) ([]byte, error) {
+	s.keysMu.RLock()
+	keys := map[string]ssh.Signer{}
+	for _, key := range append(append([]ssh.Signer{}, s.hostKeys...), s.nextHostKeys...) {
+		keys[string(key.PublicKey().Marshal())] = key
+	}
+	s.keysMu.RUnlock()
+
+	var proof []byte
+	for len(payload) > 0 {
+		var msg struct {
+			Key  []byte
+			Rest []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		payload = msg.Rest
+
+		key, ok := keys[string(msg.Key)]
+		if !ok {
+			return nil, fmt.Errorf("unknown host key requested")
+		}
+
+		data := ssh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Key       []byte
+		}{hostKeysProveRequest, sessionID, msg.Key})
+
+		sig, err := signHostKeyProof(key, data)
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, ssh.Marshal(struct{ Signature []byte }{ssh.Marshal(sig)})...)
+	}
+
+	return proof, nil
+}
+
+// signHostKeyProof signs with SHA-512 for RSA keys, which OpenSSH prefers
+func signHostKeyProof(key ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if signer, ok := key.(ssh.AlgorithmSigner); ok && key.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return signer.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2512)
+	}
+	return key.Sign(rand.Reader, data)
+}
@@ -0,0 +1,195 @@
+package gitkit
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_RotateHostKeys(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys"})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	oldKey, err := os.ReadFile(s.config.KeyPath("ed25519") + ".pub")
+	assert.NoError(t, err)
+
+	// Returns the host key presented by the server and the keys it announces
+	dial := func() (ssh.PublicKey, *ssh.Request, ssh.Conn) {
+		conn, err := net.Dial("tcp", s.Address())
+		assert.NoError(t, err)
+
+		var hostKey ssh.PublicKey
+		sConn, _, reqs, err := ssh.NewClientConn(conn, s.Address(), &ssh.ClientConfig{
+			User:              "git",
+			HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				hostKey = key
+				return nil
+			},
+		})
+		assert.NoError(t, err)
+
+		select {
+		case req := <-reqs:
+			return hostKey, req, sConn
+		case <-time.After(200 * time.Millisecond):
+			return hostKey, nil, sConn
+		}
+	}
+
+	hostKey, req, conn := dial()
+	conn.Close()
+	assert.Equal(t, string(oldKey), string(ssh.MarshalAuthorizedKey(hostKey)))
+	assert.Nil(t, req)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.RotateHostKeys(ctx, time.Minute))
+	assert.False(t, fileExists(s.config.KeyPath("ed25519")+".next"))
+
+	done := make(chan error)
+	go func() { done <- s.RotateHostKeys(context.Background(), time.Second) }()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, ErrRotationInProgress, s.RotateHostKeys(context.Background(), 0))
+
+	// The old key is still presented while the new keys are announced
+	hostKey, req, conn = dial()
+	defer conn.Close()
+	assert.Equal(t, string(oldKey), string(ssh.MarshalAuthorizedKey(hostKey)))
+	if assert.NotNil(t, req) {
+		assert.Equal(t, "hostkeys-00@openssh.com", req.Type)
+
+		var keys [][]byte
+		for payload := req.Payload; len(payload) > 0; {
+			var msg struct {
+				Key  []byte
+				Rest []byte `ssh:"rest"`
+			}
+			assert.NoError(t, ssh.Unmarshal(payload, &msg))
+			keys = append(keys, msg.Key)
+			payload = msg.Rest
+		}
+		assert.Len(t, keys, 4)
+
+		// Clients ask the server to prove it owns the new keys
+		var prove []byte
+		for _, key := range keys[2:] {
+			prove = append(prove, ssh.Marshal(struct{ Key []byte }{key})...)
+		}
+		ok, proof, err := conn.SendRequest("hostkeys-prove-00@openssh.com", true, prove)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		for _, key := range keys[2:] {
+			var msg struct {
+				Signature []byte
+				Rest      []byte `ssh:"rest"`
+			}
+			assert.NoError(t, ssh.Unmarshal(proof, &msg))
+			proof = msg.Rest
+
+			var sig ssh.Signature
+			assert.NoError(t, ssh.Unmarshal(msg.Signature, &sig))
+
+			pub, err := ssh.ParsePublicKey(key)
+			assert.NoError(t, err)
+			data := ssh.Marshal(struct {
+				Request   string
+				SessionID []byte
+				Key       []byte
+			}{"hostkeys-prove-00@openssh.com", conn.SessionID(), key})
+			assert.NoError(t, pub.Verify(data, &sig))
+		}
+
+		ok, _, err = conn.SendRequest("hostkeys-prove-00@openssh.com", true, ssh.Marshal(struct{ Key []byte }{[]byte("unknown")}))
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+
+	assert.NoError(t, <-done)
+	assert.False(t, fileExists(s.config.KeyPath("ed25519")+".next"))
+
+	newKey, err := os.ReadFile(s.config.KeyPath("ed25519") + ".pub")
+	assert.NoError(t, err)
+	assert.False(t, bytes.Equal(oldKey, newKey))
+
+	hostKey, req, conn = dial()
+	conn.Close()
+	assert.Equal(t, string(newKey), string(ssh.MarshalAuthorizedKey(hostKey)))
+	assert.Nil(t, req)
+}
+
+func TestSSH_HostKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "secret", "host_ed25519")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(keyPath), 0700))
+	assert.NoError(t, genEd25519Key(keyPath, KeyFormatOpenSSH))
+	pubKey, err := os.ReadFile(keyPath + ".pub")
+	assert.NoError(t, err)
+
+	assert.EqualError(t, NewSSH(Config{Dir: dir + "/repos"}).Listen("127.0.0.1:0"), "key directory or host keys are not provided")
+
+	s := NewSSH(Config{Dir: dir + "/repos", HostKeys: []string{keyPath}})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	var hostKey ssh.PublicKey
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User: "git",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+	conn.Close()
+
+	assert.Equal(t, string(pubKey), string(ssh.MarshalAuthorizedKey(hostKey)))
+	assert.Len(t, s.signers(), 1)
+	assert.EqualError(t, s.RotateHostKeys(context.Background(), time.Second), "cant rotate host keys that are not in KeyDir")
+}
+
+func TestSSH_SSHConfig(t *testing.T) {
+	dir := t.TempDir()
+	assert.EqualError(t, NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", HostKeyTypes: []string{"dsa"}}).Listen("127.0.0.1:0"), `unsupported host key type "dsa"`)
+
+	s := NewSSH(Config{
+		Dir:          dir + "/repos",
+		KeyDir:       dir + "/keys",
+		HostKeyTypes: []string{"ed25519"},
+		SSHConfig: func(config *ssh.ServerConfig) {
+			config.Ciphers = []string{"chacha20-poly1305@openssh.com"}
+			config.MACs = []string{"hmac-sha2-256"}
+		},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	assert.False(t, fileExists(s.config.KeyPath("rsa")))
+
+	dial := func(config ssh.ClientConfig) error {
+		config.User = "git"
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		conn, err := ssh.Dial("tcp", s.Address(), &config)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, dial(ssh.ClientConfig{}))
+	assert.Error(t, dial(ssh.ClientConfig{Config: ssh.Config{Ciphers: []string{"aes128-ctr"}}}))
+	assert.Error(t, dial(ssh.ClientConfig{HostKeyAlgorithms: []string{ssh.KeyAlgoRSA}}))
+}
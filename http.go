@@ -4,10 +4,11 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
-	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 )
@@ -20,15 +21,27 @@ type service struct {
 }
 
 type Server struct {
-	config   Config
-	services []service
-	AuthFunc func(Credential, *Request) (bool, error)
+	config          Config
+	services        []service
+	AuthFunc        func(Credential, *Request) (bool, error)
+	PostReceiveFunc func(*Push) error
+
+	// Verifies a bearer token and returns the identity of its owner, an
+	// empty identity rejects the request. Tokens are rejected if not set.
+	TokenAuthFunc func(token string, req *Request) (string, error)
+
+	// Decides if an authenticated client may access a repo, like over SSH.
+	// It is called with the username of credentials accepted by AuthFunc or
+	// the identity returned by TokenAuthFunc, and the repo name without .git
+	// suffix.
+	Authorize func(string, string) (bool, error)
 }
 
 type Request struct {
 	*http.Request
 	RepoName string
 	RepoPath string
+	Identity string // Verified identity of the client, empty if Auth is disabled
 }
 
 func New(cfg Config) *Server {
@@ -55,11 +68,18 @@ func (s *Server) findService(req *http.Request) (*service, string) {
 			return &svc, path
 		}
 	}
+
+	if s.config.DumbHTTP && req.Method == "GET" {
+		if path, file, ok := findDumbFile(req.URL.Path); ok {
+			return &service{"GET", "/" + file, s.getDumbFile, file}, path
+		}
+	}
+
 	return nil, ""
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	logInfo("request", r.Method+" "+r.Host+r.URL.String())
+	s.config.logInfo("request: %s", s.config.redact(r.Method+" "+r.Host+r.URL.String()))
 
 	// Find the git subservice to handle the request
 	svc, repoUrlPath := s.findService(r)
@@ -71,20 +91,33 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Determine namespace and repo name from request path
 	repoNamespace, repoName := getNamespaceAndRepo(repoUrlPath)
 	if repoName == "" {
-		logError("auth", fmt.Errorf("no repo name provided"))
+		s.logError("auth", fmt.Errorf("no repo name provided"))
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	name, err := NormalizeRepoName(path.Join(repoNamespace, repoName))
+	if err != nil {
+		s.logError("auth", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := s.config.checkRepoPath(name); err != nil {
+		s.logError("auth", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	req := &Request{
 		Request:  r,
-		RepoName: path.Join(repoNamespace, repoName),
-		RepoPath: path.Join(s.config.Dir, repoNamespace, repoName),
+		RepoName: name,
+		RepoPath: s.config.repoStore().Path(name),
 	}
 
 	if s.config.Auth {
-		if s.AuthFunc == nil {
-			logError("auth", fmt.Errorf("no auth backend provided"))
+		if s.AuthFunc == nil && s.TokenAuthFunc == nil {
+			s.logError("auth", fmt.Errorf("no auth backend provided"))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
@@ -98,32 +131,35 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		cred, err := getCredential(r)
 		if err != nil {
-			logError("auth", err)
+			s.logError("auth", err)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		allow, err := s.AuthFunc(cred, req)
+		identity, allow, err := s.authenticate(cred, req)
 		if !allow || err != nil {
 			if err != nil {
-				logError("auth", err)
+				s.logError("auth", err)
 			}
 
-			logError("auth", fmt.Errorf("rejected user %s", cred.Username))
+			s.logError("auth", fmt.Errorf("rejected user %s", cred.Username))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		req.Identity = identity
 	}
 
-	if !RepoExists(req.RepoPath) && s.config.AutoCreate == true {
-		err := InitRepo(req.RepoName, &s.config)
+	// Repos are only created by pushes, clones of mistyped names should fail
+	isPush := svc.rpc == "git-receive-pack" || (svc.rpc == "" && r.URL.Query().Get("service") == "git-receive-pack")
+	if isPush && !repoDirExists(req.RepoPath) && s.config.autoCreate(req.RepoName) {
+		_, err := ensureRepo(req.RepoName, &s.config, InitOptions{KeyID: req.Identity, Remote: r.RemoteAddr, Source: "http"})
 		if err != nil {
-			logError("repo-init", err)
+			s.logError("repo-init", err)
 		}
 	}
 
-	if !RepoExists(req.RepoPath) {
-		logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
+	if !repoDirExists(req.RepoPath) {
+		s.logError("repo-init", fmt.Errorf("%s does not exist", req.RepoPath))
 		http.NotFound(w, r)
 		return
 	}
@@ -131,18 +167,68 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	svc.handler(svc.rpc, w, req)
 }
 
+// authenticate verifies the credential and returns the identity of the
+// client, whose repo access is checked with Authorize. Basic credentials are
+// verified by AuthFunc and bearer tokens by TokenAuthFunc, credentials
+// without a check are rejected.
+func (s *Server) authenticate(cred Credential, req *Request) (string, bool, error) {
+	var identity string
+	if cred.Token != "" {
+		if s.TokenAuthFunc == nil {
+			return "", false, nil
+		}
+		id, err := s.TokenAuthFunc(cred.Token, req)
+		if id == "" || err != nil {
+			return "", false, err
+		}
+		identity = id
+	} else {
+		if s.AuthFunc == nil {
+			return "", false, nil
+		}
+		allow, err := s.AuthFunc(cred, req)
+		if !allow || err != nil {
+			return "", allow, err
+		}
+		identity = cred.Username
+	}
+
+	if s.Authorize != nil {
+		allow, err := s.Authorize(identity, strings.TrimSuffix(req.RepoName, ".git"))
+		return identity, allow, err
+	}
+	return identity, true, nil
+}
+
 func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 	context := "get-info-refs"
 	rpc := r.URL.Query().Get("service")
 
+	if rpc == "" && s.config.DumbHTTP {
+		s.getDumbFile("info/refs", w, r)
+		return
+	}
+
 	if !(rpc == "git-upload-pack" || rpc == "git-receive-pack") {
 		http.Error(w, "Not Found", 404)
 		return
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", "--advertise-refs", r.RepoPath)
+	if rpc == "git-upload-pack" {
+		if _, ok := s.checkUploadPolicy(context, w, r); !ok {
+			return
+		}
+	}
+
+	args, err := s.config.rpcArgs(rpc, r, "--stateless-rpc", "--advertise-refs")
+	if err != nil {
+		s.fail500(w, context, err)
+		return
+	}
+
+	cmd, pipe := gitCommand(s.config.commandEnv(), s.config.GitPath, args...)
 	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
 	defer cleanUpProcessGroup(cmd)
@@ -152,22 +238,22 @@ func (s *Server) getInfoRefs(_ string, w http.ResponseWriter, r *Request) {
 	w.WriteHeader(200)
 
 	if err := packLine(w, fmt.Sprintf("# service=%s\n", rpc)); err != nil {
-		logError(context, err)
+		s.logError(context, err)
 		return
 	}
 
 	if err := packFlush(w); err != nil {
-		logError(context, err)
+		s.logError(context, err)
 		return
 	}
 
-	if _, err := io.Copy(w, pipe); err != nil {
-		logError(context, err)
+	if _, err := copyBuffer(w, pipe, s.config.CopyBufferSize); err != nil {
+		s.logError(context, err)
 		return
 	}
 
 	if err := cmd.Wait(); err != nil {
-		logError(context, err)
+		s.logError(context, err)
 		return
 	}
 }
@@ -180,52 +266,208 @@ func (s *Server) postRPC(rpc string, w http.ResponseWriter, r *Request) {
 		var err error
 		body, err = gzip.NewReader(r.Body)
 		if err != nil {
-			fail500(w, context, err)
+			s.fail500(w, context, err)
+			return
+		}
+	}
+
+	var commands *pushCommands
+	if (s.PostReceiveFunc != nil || s.config.RefLogFunc != nil) && rpc == "git-receive-pack" {
+		commands = &pushCommands{}
+	}
+
+	// Inspects the request before it is passed to git
+	var check func(*clientRequest) error
+	var rejectPrefix string
+	var rejectStatus int
+
+	switch {
+	case rpc == "git-receive-pack" && s.config.MaxRefsPerPush > 0:
+		check = s.config.checkRefUpdates
+		rejectPrefix = "Push rejected: "
+		rejectStatus = http.StatusRequestEntityTooLarge
+	case rpc == "git-upload-pack":
+		policy, ok := s.checkUploadPolicy(context, w, r)
+		if !ok {
 			return
 		}
+		if policy.checksRequest() {
+			check = policy.checkRequest
+			rejectPrefix = "Fetch rejected: "
+			rejectStatus = http.StatusForbidden
+		}
+	}
+
+	var inspection *packInspection
+	if rpc == "git-receive-pack" {
+		inspection = s.config.packInspection(r.RepoName)
+	}
+
+	args, err := s.config.rpcArgs(rpc, r, "--stateless-rpc")
+	if err != nil {
+		s.fail500(w, context, err)
+		return
 	}
 
-	cmd, pipe := gitCommand(s.config.GitPath, subCommand(rpc), "--stateless-rpc", r.RepoPath)
+	// Hooks of pushes identify the pusher like over SSH
+	cmd, pipe := gitCommand(append(s.config.commandEnv(), KeyIDEnv+"="+r.Identity), s.config.GitPath, args...)
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
 	defer stdin.Close()
 
 	if err := cmd.Start(); err != nil {
-		fail500(w, context, err)
+		s.fail500(w, context, err)
 		return
 	}
 	defer cleanUpProcessGroup(cmd)
 
-	if _, err := io.Copy(stdin, body); err != nil {
-		fail500(w, context, err)
+	if check != nil || inspection != nil || commands != nil {
+		var rejected error
+		maxRefs := 0
+		if rpc == "git-receive-pack" {
+			maxRefs = s.config.MaxRefsPerPush
+		}
+		err := copyClientInput(stdin, body, s.config.CopyBufferSize, maxRefs, func(req *clientRequest) error {
+			commands.record(req)
+			if check != nil {
+				rejected = check(req)
+			}
+			return rejected
+		}, inspection.wrapper())
+		if rejected != nil {
+			s.logError(context, rejected)
+			http.Error(w, rejectPrefix+rejected.Error(), rejectStatus)
+			return
+		}
+		// Git is terminated before it unpacks the rest of the pack
+		if rejected := inspection.err(); rejected != nil {
+			s.logError(context, rejected)
+			http.Error(w, "Push rejected: "+rejected.Error(), http.StatusForbidden)
+			return
+		}
+		if err == errSectionTooLarge {
+			s.logError(context, err)
+			http.Error(w, "Request rejected: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.fail500(w, context, err)
+			return
+		}
+	} else if _, err := copyBuffer(stdin, body, s.config.CopyBufferSize); err != nil {
+		s.fail500(w, context, err)
 		return
 	}
 
+	// Git may wait for the end of the request, e.g. upload-pack after the
+	// shallow section of a fetch with --depth
+	stdin.Close()
+
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-result", rpc))
 	w.Header().Add("Cache-Control", "no-cache")
 	w.WriteHeader(200)
 
-	if _, err := io.Copy(newWriteFlusher(w), pipe); err != nil {
-		logError(context, err)
+	if _, err := copyBuffer(newWriteFlusher(w), pipe, s.config.CopyBufferSize); err != nil {
+		s.logError(context, err)
 		return
 	}
 	if err := cmd.Wait(); err != nil {
-		logError(context, err)
+		s.logError(context, err)
 		return
 	}
+
+	if commands != nil {
+		s.postReceive(r, commands)
+	}
+}
+
+// checkUploadPolicy returns the upload policy of the repo, or responds with
+// an error and returns false if the fetch is denied
+func (s *Server) checkUploadPolicy(context string, w http.ResponseWriter, r *Request) (UploadPolicy, bool) {
+	policy, err := s.config.uploadPolicy(r.RepoName, remoteAddr(r.Request))
+	if err != nil {
+		s.fail500(w, context, err)
+		return policy, false
+	}
+	if policy.Deny {
+		s.logError(context, fmt.Errorf("upload policy denies fetch of %s", r.RepoName))
+		http.Error(w, policy.denyMessage(), http.StatusForbidden)
+		return policy, false
+	}
+	return policy, true
+}
+
+// remoteAddr returns the client address of an HTTP request
+func remoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{IP: net.ParseIP(r.RemoteAddr)}
+	}
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: portNum}
+}
+
+// postReceive logs the refs changed by a push and runs the post-receive callback
+func (s *Server) postReceive(r *Request, commands *pushCommands) {
+	context := "post-receive"
+
+	after, err := readRefs(s.config.GitPath, r.RepoPath)
+	if err != nil {
+		s.logError(context, err)
+		return
+	}
+
+	refs := commands.refs(r.RepoName, r.RepoPath, after)
+	if len(refs) == 0 {
+		return
+	}
+
+	for _, ref := range refs {
+		ref.KeyID = r.Identity
+	}
+	push := &Push{KeyID: r.Identity, RepoName: r.RepoName, RepoPath: r.RepoPath, Refs: refs, Progress: func(string) {}}
+	s.config.logRefs(push)
+	if s.PostReceiveFunc == nil {
+		return
+	}
+	err = callHandler(s.config.logger(), context, s.config.PostReceiveTimeout, func() error { return s.PostReceiveFunc(push) })
+	if err != nil {
+		s.logError(context, err)
+	}
+}
+
+// rpcArgs returns the git arguments of an RPC, restricted to the pinned ref for upload-pack
+func (c *Config) rpcArgs(rpc string, r *Request, flags ...string) ([]string, error) {
+	pinned := ""
+	if rpc == "git-upload-pack" {
+		var err error
+		if pinned, err = c.pinnedRef(r.RepoName); err != nil {
+			return nil, err
+		}
+	}
+	return c.commandArgs(subCommand(rpc), r.RepoPath, pinned, flags...), nil
+}
+
+func (s *Server) fail500(w http.ResponseWriter, context string, err error) {
+	http.Error(w, "Internal server error", 500)
+	s.logError(context, err)
+}
+
+func (s *Server) logError(context string, err error) {
+	s.config.logger().Errorf("%s: %v", context, err)
 }
 
 func (s *Server) Setup() error {
 	return s.config.Setup()
 }
 
-func gitCommand(name string, args ...string) (*exec.Cmd, io.Reader) {
+func gitCommand(env []string, name string, args ...string) (*exec.Cmd, io.Reader) {
 	cmd := exec.Command(name, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	cmd.Env = os.Environ()
+	cmd.Env = env
 
 	r, _ := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
@@ -0,0 +1,116 @@
+package gitkit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// HTTP serves repositories over the smart HTTP protocol with its own
+// listener, mirroring SSH. Use Server directly to mount the handler into an
+// existing http.Server.
+type HTTP struct {
+	*Server
+
+	mu       sync.Mutex
+	listener net.Listener
+	server   *http.Server
+}
+
+func NewHTTP(config Config) *HTTP {
+	return &HTTP{Server: New(config)}
+}
+
+func (h *HTTP) Listen(bind string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.listener != nil {
+		return ErrAlreadyStarted
+	}
+
+	if err := h.Setup(); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	h.listener = listener
+	h.server = &http.Server{Handler: h.Server}
+
+	if h.config.OnReady != nil {
+		h.config.OnReady(listener.Addr().String())
+	}
+	return nil
+}
+
+// Serve handles requests until Stop is called, it then returns
+// http.ErrServerClosed.
+func (h *HTTP) Serve() error {
+	h.mu.Lock()
+	listener, server := h.listener, h.server
+	h.mu.Unlock()
+
+	if listener == nil {
+		return ErrNoListener
+	}
+	return server.Serve(listener)
+}
+
+func (h *HTTP) ListenAndServe(bind string) error {
+	if err := h.Listen(bind); err != nil {
+		return err
+	}
+	return h.Serve()
+}
+
+// Stop closes the listener and all connections if the server has been
+// started, otherwise it is a no-op.
+func (h *HTTP) Stop() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.listener == nil {
+		return nil
+	}
+	listener, server := h.listener, h.server
+	h.listener = nil
+	h.server = nil
+
+	err := server.Close()
+	// The listener is not tracked by the server before Serve
+	listener.Close()
+	return err
+}
+
+// Shutdown stops accepting requests and waits for running ones to finish,
+// see http.Server.Shutdown. It is a no-op if the server has not been started.
+func (h *HTTP) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	if h.listener == nil {
+		h.mu.Unlock()
+		return nil
+	}
+	listener, server := h.listener, h.server
+	h.listener = nil
+	h.server = nil
+	h.mu.Unlock()
+
+	err := server.Shutdown(ctx)
+	listener.Close()
+	return err
+}
+
+// Address returns the network address of the listener, see SSH.Address
+func (h *HTTP) Address() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.listener != nil {
+		return h.listener.Addr().String()
+	}
+	return ""
+}
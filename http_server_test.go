@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP_ListenAndServe(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewHTTP(Config{Dir: dir + "/repos", AutoCreate: true, Auth: true})
+	s.TokenAuthFunc = func(token string, req *Request) (string, error) {
+		if token == "s3cret" {
+			return "ci", nil
+		}
+		return "", nil
+	}
+	s.Authorize = func(id string, repo string) (bool, error) {
+		return id == "ci" && repo == "app", nil
+	}
+	pushes := make(chan *Push, 1)
+	s.PostReceiveFunc = func(push *Push) error {
+		pushes <- push
+		return nil
+	}
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.Equal(t, ErrAlreadyStarted, s.Listen("127.0.0.1:0"))
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+
+	git := func(token string, args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "http.extraHeader=Authorization: Bearer " + token}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "-q", work).Run())
+	_, err := git("s3cret", "-C", work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	url := "http://" + s.Address() + "/app.git"
+	out, err := git("s3cret", "-C", work, "push", "-q", url, "HEAD:refs/heads/master")
+	assert.NoError(t, err, out)
+
+	// Pushes are attributed to the identity of the token, not the token
+	push := <-pushes
+	assert.Equal(t, "ci", push.KeyID)
+	assert.Equal(t, "ci", push.Refs[0].KeyID)
+
+	out, err = git("s3cret", "clone", "-q", url, filepath.Join(dir, "clone"))
+	assert.NoError(t, err, out)
+	assert.FileExists(t, filepath.Join(dir, "clone", ".git", "refs", "heads", "master"))
+
+	_, err = git("wrong", "clone", "-q", url, filepath.Join(dir, "denied"))
+	assert.Error(t, err)
+
+	// Basic credentials need an AuthFunc
+	res, err := http.Get("http://user:pass@" + s.Address() + "/app.git/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	assert.NoError(t, s.Stop())
+	assert.Equal(t, http.ErrServerClosed, <-served)
+	assert.Equal(t, "", s.Address())
+	assert.NoError(t, s.Stop())
+
+	// Shutdown stops the server once the served requests are done
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go func() { served <- s.Serve() }()
+	res, err = http.Get("http://" + s.Address() + "/app.git/info/refs?service=git-upload-pack")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.NoError(t, s.Shutdown(context.Background()))
+	assert.Equal(t, http.ErrServerClosed, <-served)
+	assert.Equal(t, "", s.Address())
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
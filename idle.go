@@ -0,0 +1,54 @@
+package gitkit
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleConn closes connections without traffic for the timeout. Once started
+// after the handshake, every read and write extends the deadline.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	active  int32
+	onIdle  func() // Called once the connection timed out
+	once    sync.Once
+}
+
+func (c *idleConn) start() {
+	atomic.StoreInt32(&c.active, 1)
+	c.extend()
+}
+
+func (c *idleConn) extend() {
+	if atomic.LoadInt32(&c.active) == 1 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.extend()
+	n, err := c.Conn.Read(p)
+	c.check(err)
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.extend()
+	n, err := c.Conn.Write(p)
+	c.check(err)
+	return n, err
+}
+
+func (c *idleConn) check(err error) {
+	if isTimeout(err) && atomic.LoadInt32(&c.active) == 1 && c.onIdle != nil {
+		c.once.Do(c.onIdle)
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,81 @@
+package gitkit
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultClientAliveCountMax is used if Config.ClientAliveCountMax is not set.
+const DefaultClientAliveCountMax = 3
+
+// Global request sent as SSH keepalive, clients reply with a failure to
+// requests they do not know, which is enough to tell they are alive
+const keepAliveRequest = "keepalive@openssh.com"
+
+// setKeepAlive enables TCP keepalive with the period on TCP connections
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || period <= 0 {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
+
+// sendKeepAlives sends a keepalive request every interval until the
+// connection is closed. The connection is closed once countMax requests in a
+// row are unanswered.
+func sendKeepAlives(conn ssh.Conn, interval time.Duration, countMax int, onTimeout func()) {
+	closed := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-closed:
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					_, _, err := conn.SendRequest(keepAliveRequest, true, nil)
+					replies <- err
+				}()
+				continue
+			}
+
+			if missed++; missed >= countMax {
+				onTimeout()
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// clientAliveCountMax returns ClientAliveCountMax or DefaultClientAliveCountMax if not set
+func (c *Config) clientAliveCountMax() int {
+	if c.ClientAliveCountMax <= 0 {
+		return DefaultClientAliveCountMax
+	}
+	return c.ClientAliveCountMax
+}
@@ -0,0 +1,94 @@
+package gitkit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_setKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, setKeepAlive(conn, time.Minute))
+
+	// Other connections are left alone
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	assert.NoError(t, setKeepAlive(server, time.Minute))
+}
+
+func TestSSH_ClientAlive(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", KeepAlivePeriod: time.Minute, ClientAliveInterval: 50 * time.Millisecond, ClientAliveCountMax: 2})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	dial := func(reply bool) (ssh.Conn, <-chan int) {
+		conn, err := net.Dial("tcp", s.Address())
+		assert.NoError(t, err)
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, s.Address(), &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		assert.NoError(t, err)
+		go func() {
+			for ch := range chans {
+				ch.Reject(ssh.Prohibited, "")
+			}
+		}()
+
+		received := make(chan int, 100)
+		go func() {
+			count := 0
+			for req := range reqs {
+				if req.Type != keepAliveRequest {
+					req.Reply(false, nil)
+					continue
+				}
+				count++
+				received <- count
+				if reply {
+					req.Reply(false, nil)
+				}
+			}
+			close(received)
+		}()
+		return sshConn, received
+	}
+
+	// Clients answering keepalives stay connected
+	conn, received := dial(true)
+	defer conn.Close()
+	for i := 1; i <= 4; i++ {
+		select {
+		case count := <-received:
+			assert.Equal(t, i, count)
+		case <-time.After(time.Second):
+			t.Fatal("no keepalive received")
+		}
+	}
+
+	// Clients that do not answer are disconnected
+	silent, _ := dial(false)
+	defer silent.Close()
+	closed := make(chan struct{})
+	go func() {
+		silent.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyFormat is the encoding of generated host private keys
+type KeyFormat string
+
+const (
+	KeyFormatPKCS8   KeyFormat = "pkcs8"   // PKCS#8 PEM, the default
+	KeyFormatOpenSSH KeyFormat = "openssh" // OpenSSH native format as written by ssh-keygen
+)
+
+// marshalPrivateKey encodes the private key as a PEM block in the given format
+func marshalPrivateKey(privateKey interface{}, format KeyFormat) (*pem.Block, error) {
+	switch format {
+	case "", KeyFormatPKCS8:
+		bytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: bytes}, nil
+	case KeyFormatOpenSSH:
+		bytes, err := marshalOpenSSHPrivateKey(privateKey)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: bytes}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key format: %q", format)
+}
+
+// marshalOpenSSHPrivateKey encodes an unencrypted key in the openssh-key-v1
+// format described in PROTOCOL.key of OpenSSH
+func marshalOpenSSHPrivateKey(privateKey interface{}) ([]byte, error) {
+	var (
+		publicKey ssh.PublicKey
+		keyFields []byte
+		err       error
+	)
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		if publicKey, err = ssh.NewPublicKey(&key.PublicKey); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		keyFields = ssh.Marshal(struct {
+			N    *big.Int
+			E    *big.Int
+			D    *big.Int
+			Iqmp *big.Int
+			P    *big.Int
+			Q    *big.Int
+		}{key.N, big.NewInt(int64(key.E)), key.D, key.Precomputed.Qinv, key.Primes[0], key.Primes[1]})
+	case ed25519.PrivateKey:
+		if publicKey, err = ssh.NewPublicKey(key.Public()); err != nil {
+			return nil, err
+		}
+		keyFields = ssh.Marshal(struct {
+			Pub  []byte
+			Priv []byte
+		}{[]byte(key.Public().(ed25519.PublicKey)), []byte(key)})
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", privateKey)
+	}
+
+	// Matching check ints are used to verify decryption
+	check := make([]byte, 4)
+	if _, err := rand.Read(check); err != nil {
+		return nil, err
+	}
+	checkInt := binary.BigEndian.Uint32(check)
+
+	private := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+	}{checkInt, checkInt, publicKey.Type()})
+	private = append(private, keyFields...)
+	private = append(private, ssh.Marshal(struct{ Comment string }{""})...)
+
+	// Pad to the cipher block size of 8 with 1, 2, 3...
+	for i := 1; len(private)%8 != 0; i++ {
+		private = append(private, byte(i))
+	}
+
+	key := ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, publicKey.Marshal(), private})
+
+	return append([]byte("openssh-key-v1\x00"), key...), nil
+}
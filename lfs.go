@@ -0,0 +1,72 @@
+package gitkit
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Command Git LFS clients run over SSH to get credentials for the LFS API,
+// e.g. git-lfs-authenticate 'repo.git' upload. Older clients do not quote the repo.
+var lfsCommandRegex = regexp.MustCompile(`^(?:/\S*/)?git-lfs-authenticate ('[^']*'|[^'\s]+) (upload|download)$`)
+
+// parseLFSCommand returns the git command whose access rules apply to the
+// LFS operation and the operation, upload or download
+func parseLFSCommand(cmd string) (*GitCommand, string, bool) {
+	matches := lfsCommandRegex.FindStringSubmatch(cmd)
+	if matches == nil {
+		return nil, "", false
+	}
+
+	repo, err := NormalizeRepoName(strings.Trim(matches[1], "'"))
+	if err != nil {
+		return nil, "", false
+	}
+
+	gitcmd := &GitCommand{Command: "git-upload-pack", Repo: repo, Original: cmd}
+	if matches[2] == "upload" {
+		gitcmd.Command = "git-receive-pack"
+	}
+	return gitcmd, matches[2], true
+}
+
+// handleLFSAuthenticate writes the response of LFSAuthenticateFunc to keys
+// that may fetch from the repo, or push to it for uploads
+func (s *SSH) handleLFSAuthenticate(conn *ssh.ServerConn, keyID string, ch ssh.Channel, req *ssh.Request, gitcmd *GitCommand, operation string) {
+	req.Reply(true, nil)
+
+	if err := s.authorize(conn.Permissions, keyID, gitcmd); err != nil {
+		s.logger().Infof("ssh: key with ID '%s' denied LFS %s on repo '%s': %v", keyID, operation, gitcmd.Repo, err)
+		ch.Stderr().Write([]byte("Access denied.\r\n"))
+		sendExitStatus(ch, 1)
+		return
+	}
+
+	// Uploads are pushes and get the same checks as receive-pack
+	if gitcmd.IsReceivePack() {
+		if !s.secondFactorPassed(conn.Permissions) {
+			s.logger().Infof("ssh: key with ID '%s' requested LFS upload to repo '%s' without second factor", keyID, gitcmd.Repo)
+			ch.Stderr().Write([]byte(secondFactorMessage))
+			sendExitStatus(ch, 1)
+			return
+		}
+		if !s.pushes.allow(keyID, lockoutKey(conn.RemoteAddr())) {
+			s.logger().Infof("ssh: key with ID '%s' reached the push rate limit on repo '%s'", keyID, gitcmd.Repo)
+			ch.Stderr().Write([]byte("Too many pushes, please try again later.\r\n"))
+			sendExitStatus(ch, 1)
+			return
+		}
+	}
+
+	response, err := s.LFSAuthenticateFunc(keyID, strings.TrimSuffix(gitcmd.Repo, ".git"), operation)
+	if err != nil {
+		s.logger().Errorf("ssh: LFS authentication failed for repo '%s': %v", gitcmd.Repo, err)
+		ch.Stderr().Write([]byte("LFS authentication failed.\r\n"))
+		sendExitStatus(ch, 1)
+		return
+	}
+
+	ch.Write([]byte(response))
+	sendExitStatus(ch, 0)
+}
@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_parseLFSCommand(t *testing.T) {
+	examples := []struct {
+		cmd       string
+		command   string
+		repo      string
+		operation string
+	}{
+		{"git-lfs-authenticate 'app.git' upload", "git-receive-pack", "app.git", "upload"},
+		{"git-lfs-authenticate 'org/app' download", "git-upload-pack", "org/app.git", "download"},
+		{"git-lfs-authenticate app download", "git-upload-pack", "app.git", "download"},
+		{"/usr/bin/git-lfs-authenticate '/app.git' upload", "git-receive-pack", "app.git", "upload"},
+		{"git-lfs-authenticate '../app.git' download", "git-upload-pack", "app.git", "download"},
+	}
+
+	for _, example := range examples {
+		gitcmd, operation, ok := parseLFSCommand(example.cmd)
+		if assert.True(t, ok, example.cmd) {
+			assert.Equal(t, example.command, gitcmd.Command)
+			assert.Equal(t, example.repo, gitcmd.Repo)
+			assert.Equal(t, example.operation, operation)
+		}
+	}
+
+	for _, cmd := range []string{
+		"git-lfs-authenticate 'app.git'",
+		"git-lfs-authenticate 'app.git' delete",
+		"git-lfs-authenticate '-app.git' download",
+		"git-upload-pack 'app.git'",
+	} {
+		_, _, ok := parseLFSCommand(cmd)
+		assert.False(t, ok, cmd)
+	}
+}
+
+func TestSSH_LFSAuthenticate(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true, ReceiveRateLimit: ReceiveRateLimit{PerKey: 1}})
+	s.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "deploy"}, nil
+	}
+	s.Authorize = func(keyID string, repo string) (bool, error) {
+		return repo != "private", nil
+	}
+	s.LFSAuthenticateFunc = func(keyID, repo, operation string) (string, error) {
+		if repo == "broken" {
+			return "", errors.New("no token")
+		}
+		return fmt.Sprintf(`{"href":"https://lfs.example.com/%s","header":{"Authorization":"%s %s"}}`, repo, keyID, operation), nil
+	}
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	out, err := session.Output("git-lfs-authenticate 'org/app.git' upload")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"href":"https://lfs.example.com/org/app","header":{"Authorization":"deploy upload"}}`, string(out))
+
+	// Uploads count against the push rate limit, downloads do not
+	for command, message := range map[string]string{
+		"git-lfs-authenticate 'private.git' download": "Access denied.\r\n",
+		"git-lfs-authenticate 'broken.git' download":  "LFS authentication failed.\r\n",
+		"git-lfs-authenticate 'org/app.git' upload":   "Too many pushes, please try again later.\r\n",
+	} {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+		stderr, err := session.StderrPipe()
+		assert.NoError(t, err)
+		err = session.Run(command)
+		if assert.IsType(t, &ssh.ExitError{}, err, command) {
+			assert.Equal(t, 1, err.(*ssh.ExitError).ExitStatus())
+		}
+		out, _ := ioutil.ReadAll(stderr)
+		assert.Equal(t, message, string(out))
+	}
+
+	session, err = conn.NewSession()
+	assert.NoError(t, err)
+	_, err = session.Output("git-lfs-authenticate 'org/app.git' download")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,70 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultSocketMode is used if Config.SocketMode is not set.
+const DefaultSocketMode os.FileMode = 0660
+
+// unixBindPrefix marks binds of Unix domain sockets, e.g. unix:///run/gitkit.sock
+const unixBindPrefix = "unix://"
+
+// listen returns a TCP listener for the bind, or a listener on a Unix domain
+// socket with the given mode for binds like unix:///run/gitkit.sock
+func listen(bind string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(bind, unixBindPrefix) {
+		return net.Listen("tcp", bind)
+	}
+
+	path := strings.TrimPrefix(bind, unixBindPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("socket path is not provided")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file left behind by a server that did
+// not shut down cleanly. Sockets still in use and other files are kept.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("cant listen on %s: file exists and is not a socket", path)
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("cant listen on %s: socket is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// socketMode returns SocketMode or DefaultSocketMode if not set
+func (c *Config) socketMode() os.FileMode {
+	if c.SocketMode == 0 {
+		return DefaultSocketMode
+	}
+	return c.SocketMode
+}
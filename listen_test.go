@@ -0,0 +1,88 @@
+package gitkit
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_ListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "gitkit.sock")
+
+	// Socket of a server that did not shut down cleanly
+	stale, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+		"info": func(keyID string, args []string, ch io.ReadWriter) (int, error) {
+			fmt.Fprint(ch, "ok")
+			return 0, nil
+		},
+	}})
+	assert.NoError(t, s.Listen("unix://"+socket))
+	go s.Serve()
+	defer s.Stop()
+
+	assert.Equal(t, socket, s.Address())
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultSocketMode, info.Mode().Perm())
+	assert.NoError(t, s.HealthCheck(time.Second))
+
+	conn, err := ssh.Dial("unix", socket, &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	out, err := session.Output("info")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(out))
+
+	// Sockets in use are not replaced
+	_, err = listen("unix://"+socket, DefaultSocketMode)
+	assert.EqualError(t, err, "cant listen on "+socket+": socket is in use")
+
+	assert.NoError(t, s.Stop())
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_listen(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	_, err := listen("unix://"+file, DefaultSocketMode)
+	assert.EqualError(t, err, "cant listen on "+file+": file exists and is not a socket")
+
+	_, err = listen("unix://", DefaultSocketMode)
+	assert.Error(t, err)
+
+	socket := filepath.Join(dir, "gitkit.sock")
+	listener, err := listen("unix://"+socket, 0600)
+	assert.NoError(t, err)
+	defer listener.Close()
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	listener, err = listen("127.0.0.1:0", DefaultSocketMode)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", listener.Addr().Network())
+	listener.Close()
+}
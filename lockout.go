@@ -0,0 +1,109 @@
+package gitkit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthFailureLockout temporarily rejects clients after repeated failed
+// authentication attempts. Every rejected key counts as a failure, so the
+// threshold should allow for clients offering several keys.
+type AuthFailureLockout struct {
+	Threshold int           // Failures within Window that trigger a lockout, zero disables the lockout
+	Window    time.Duration // Period in which failures are counted
+	Duration  time.Duration // How long clients are locked out
+}
+
+// lockoutEntry tracks the failures of a single client
+type lockoutEntry struct {
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+// authLockout keeps failure counts keyed by client IP
+type authLockout struct {
+	config AuthFailureLockout
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+func newAuthLockout(config AuthFailureLockout) *authLockout {
+	return &authLockout{config: config, now: time.Now, entries: map[string]*lockoutEntry{}}
+}
+
+// lockoutKey returns the client IP of the address
+func lockoutKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// locked returns true if the client is currently locked out
+func (l *authLockout) locked(key string) bool {
+	if l == nil || l.config.Threshold <= 0 {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	return ok && l.now().Before(entry.lockedUntil)
+}
+
+// fail records a failed attempt and locks the client out once the threshold is reached
+func (l *authLockout) fail(key string) {
+	if l == nil || l.config.Threshold <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &lockoutEntry{}
+		l.entries[key] = entry
+	}
+
+	entry.failures = append(recentFailures(entry.failures, now.Add(-l.config.Window)), now)
+	if len(entry.failures) >= l.config.Threshold {
+		entry.lockedUntil = now.Add(l.config.Duration)
+		entry.failures = nil
+	}
+}
+
+// sweep removes expired entries, at most once per window
+func (l *authLockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.config.Window {
+		return
+	}
+	l.lastSweep = now
+
+	since := now.Add(-l.config.Window)
+	for key, entry := range l.entries {
+		entry.failures = recentFailures(entry.failures, since)
+		if len(entry.failures) == 0 && !now.Before(entry.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// recentFailures drops failures before since
+func recentFailures(failures []time.Time, since time.Time) []time.Time {
+	for i, t := range failures {
+		if t.After(since) {
+			return failures[i:]
+		}
+	}
+	return nil
+}
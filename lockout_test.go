@@ -0,0 +1,45 @@
+package gitkit
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_authLockout(t *testing.T) {
+	now := time.Now()
+	l := newAuthLockout(AuthFailureLockout{Threshold: 3, Window: time.Minute, Duration: 10 * time.Minute})
+	l.now = func() time.Time { return now }
+
+	l.fail("10.0.0.1")
+	l.fail("10.0.0.1")
+	assert.False(t, l.locked("10.0.0.1"))
+
+	// Failures outside the window do not count
+	now = now.Add(2 * time.Minute)
+	l.fail("10.0.0.1")
+	l.fail("10.0.0.1")
+	assert.False(t, l.locked("10.0.0.1"))
+
+	l.fail("10.0.0.1")
+	assert.True(t, l.locked("10.0.0.1"))
+	assert.False(t, l.locked("10.0.0.2"))
+
+	now = now.Add(11 * time.Minute)
+	assert.False(t, l.locked("10.0.0.1"))
+
+	// Expired entries are removed
+	l.fail("10.0.0.2")
+	assert.Len(t, l.entries, 1)
+
+	var disabled *authLockout
+	disabled.fail("10.0.0.1")
+	assert.False(t, disabled.locked("10.0.0.1"))
+}
+
+func Test_lockoutKey(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", lockoutKey(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}))
+	assert.Equal(t, "::1", lockoutKey(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 2222}))
+}
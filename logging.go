@@ -0,0 +1,76 @@
+package gitkit
+
+import "log"
+
+// LogLevel controls which lines are logged
+type LogLevel int
+
+const (
+	LogLevelInfo  LogLevel = iota // Log every connection and request, the default
+	LogLevelError                 // Only log failures
+)
+
+// Logger receives the log lines of the servers, e.g. to forward them to a
+// structured logger. Per-request lines are logged with Infof unless LogLevel
+// suppresses them.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger writes all lines to the standard logger
+type stdLogger struct{}
+
+func (stdLogger) Debugf(format string, args ...interface{}) { log.Printf(format, args...) }
+func (stdLogger) Infof(format string, args ...interface{})  { log.Printf(format, args...) }
+func (stdLogger) Errorf(format string, args ...interface{}) { log.Printf(format, args...) }
+
+// logger returns Logger or the standard logger if it is not set
+func (c *Config) logger() Logger {
+	if c.Logger == nil {
+		return stdLogger{}
+	}
+	return c.Logger
+}
+
+// logger returns Receiver.Logger or the standard logger if it is not set
+func (r *Receiver) logger() Logger {
+	if r.Logger == nil {
+		return stdLogger{}
+	}
+	return r.Logger
+}
+
+// logger returns SSH.Logger and falls back to Config.Logger
+func (s *SSH) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return s.config.logger()
+}
+
+// redact applies RedactLog to a logged command, env or payload string
+func (c *Config) redact(s string) string {
+	if c.RedactLog == nil {
+		return s
+	}
+	return c.RedactLog(s)
+}
+
+// logInfo logs a per-request line unless LogLevel suppresses it
+func (c *Config) logInfo(format string, args ...interface{}) {
+	if c.LogLevel > LogLevelInfo {
+		return
+	}
+	c.logger().Infof(format, args...)
+}
+
+// logInfo logs a per-request line of the SSH server unless LogLevel
+// suppresses it
+func (s *SSH) logInfo(format string, args ...interface{}) {
+	if s.config.LogLevel > LogLevelInfo {
+		return
+	}
+	s.logger().Infof(format, args...)
+}
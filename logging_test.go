@@ -0,0 +1,107 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConfig_redact(t *testing.T) {
+	assert.Equal(t, "git-upload-pack 'repo.git'", (&Config{}).redact("git-upload-pack 'repo.git'"))
+
+	c := &Config{RedactLog: func(s string) string {
+		return strings.Replace(s, "secret", "***", -1)
+	}}
+	assert.Equal(t, "token=***", c.redact("token=secret"))
+}
+
+func TestConfig_logInfo(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	(&Config{}).logInfo("ssh: connection from %s", "127.0.0.1")
+	assert.Contains(t, buf.String(), "ssh: connection from 127.0.0.1")
+
+	buf.Reset()
+	(&Config{LogLevel: LogLevelError}).logInfo("ssh: connection from %s", "127.0.0.1")
+	assert.Equal(t, "", buf.String())
+}
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) record(level string, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", format, args...)
+}
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record("error", format, args...)
+}
+
+func (l *recordingLogger) recorded() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestConfig_Logger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	logger := &recordingLogger{}
+	(&Config{Logger: logger}).logInfo("ssh: connection from %s", "127.0.0.1")
+	assert.Equal(t, []string{"info ssh: connection from 127.0.0.1"}, logger.recorded())
+	assert.Equal(t, "", buf.String())
+
+	// SSH.Logger takes precedence
+	override := &recordingLogger{}
+	s := NewSSH(Config{Logger: logger, LogLevel: LogLevelError})
+	s.Logger = override
+	s.logInfo("ssh: connection from %s", "127.0.0.1")
+	s.logger().Errorf("ssh: command failed: %v", "exit status 1")
+	assert.Equal(t, []string{"error ssh: command failed: exit status 1"}, override.recorded())
+	assert.Len(t, logger.recorded(), 1)
+}
+
+func TestSSH_Logger(t *testing.T) {
+	dir := t.TempDir()
+	logger := &recordingLogger{}
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Logger: logger})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	session.Run("git-upload-pack 'missing.git'")
+
+	lines := logger.recorded()
+	assert.Contains(t, lines, "info ssh: incoming exec request: git-upload-pack 'missing.git'")
+	assert.Contains(t, lines, "info ssh: repo 'missing.git' does not exist")
+}
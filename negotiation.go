@@ -0,0 +1,236 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxSectionSize bounds a single section of a client request, which is held in
+// memory until it has been inspected
+const maxSectionSize = 16 << 20
+
+// errSectionTooLarge is returned for request sections above maxSectionSize
+var errSectionTooLarge = errors.New("request section is too large")
+
+// clientRequest holds the leading pkt-line sections a client sends to
+// upload-pack or receive-pack before any pack data is transferred.
+type clientRequest struct {
+	Command string   // Protocol v2 command, empty for v0/v1
+	Lines   []string // Payloads of all inspected pkt-lines
+	Caps    []string // Capabilities and arguments requested by the client
+
+	maxRefUpdates int  // Stop reading once more ref updates were sent, zero means unlimited
+	refCount      int  // Ref update commands read so far
+	truncated     bool // Reading stopped at maxRefUpdates, before the end of the section
+}
+
+// readPktLine reads a single pkt-line and returns its 4 byte header and payload.
+// Flush and delimiter packets have no payload.
+func readPktLine(r *bufio.Reader) (string, []byte, error) {
+	header := make([]byte, 4)
+	if n, err := io.ReadFull(r, header); err != nil {
+		return string(header[:n]), nil, err
+	}
+
+	size, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return string(header), nil, fmt.Errorf("invalid pkt-line length: %q", header)
+	}
+
+	if size < 4 {
+		return string(header), nil, nil
+	}
+
+	payload := make([]byte, size-4)
+	n, err := io.ReadFull(r, payload)
+	if err != nil {
+		return string(header), payload[:n], err
+	}
+
+	return string(header), payload, nil
+}
+
+// readSection reads pkt-lines up to and including the next flush packet,
+// appending the raw bytes to buf and the parsed lines to req. It returns true
+// if the section is the one that starts the actual transfer.
+func (req *clientRequest) readSection(r *bufio.Reader, buf *bytes.Buffer) (bool, error) {
+	command := ""
+
+	for {
+		header, payload, err := readPktLine(r)
+		buf.WriteString(header)
+		buf.Write(payload)
+		if err != nil {
+			return false, err
+		}
+		if buf.Len() > maxSectionSize {
+			return false, errSectionTooLarge
+		}
+
+		if header == "0000" {
+			break
+		}
+		if payload == nil {
+			continue
+		}
+
+		line := strings.TrimSuffix(string(payload), "\n")
+		req.Lines = append(req.Lines, line)
+
+		// Pushes of too many refs are rejected without reading all commands
+		if _, ok := parseRefUpdate(line); ok {
+			req.refCount++
+			if req.maxRefUpdates > 0 && req.refCount > req.maxRefUpdates {
+				req.truncated = true
+				return true, nil
+			}
+		}
+
+		if strings.HasPrefix(line, "command=") {
+			command = strings.TrimPrefix(line, "command=")
+			req.Command = command
+			continue
+		}
+		req.Caps = append(req.Caps, parseCapabilities(line)...)
+	}
+
+	// Protocol v2 clients list refs before fetching
+	return command == "" || command == "fetch", nil
+}
+
+// parseCapabilities extracts the capabilities from a single request line
+func parseCapabilities(line string) []string {
+	// First receive-pack command: <old> <new> <ref>\0<caps>
+	if i := strings.IndexByte(line, 0); i >= 0 {
+		return strings.Fields(line[i+1:])
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "want":
+		// First upload-pack want: want <oid> <caps>
+		if len(fields) > 2 {
+			return fields[2:]
+		}
+		return nil
+	case "have", "want-ref", "shallow":
+		return nil
+	}
+
+	// Remaining receive-pack commands: <old> <new> <ref>
+	if len(fields) == 3 && isObjectName(fields[0]) && isObjectName(fields[1]) {
+		return nil
+	}
+
+	return []string{line}
+}
+
+// refUpdates returns the number of ref update commands sent to receive-pack
+func (req *clientRequest) refUpdates() int {
+	return req.refCount
+}
+
+// updates returns the ref update commands sent to receive-pack
+func (req *clientRequest) updates() []refUpdate {
+	updates := []refUpdate{}
+	for _, line := range req.Lines {
+		if update, ok := parseRefUpdate(line); ok {
+			updates = append(updates, update)
+		}
+	}
+	return updates
+}
+
+// parseRefUpdate parses a receive-pack command: <old> <new> <ref>[\0<caps>]
+func parseRefUpdate(line string) (refUpdate, bool) {
+	if i := strings.IndexByte(line, 0); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 3 && isObjectName(fields[0]) && isObjectName(fields[1]) {
+		return refUpdate{OldRev: fields[0], NewRev: fields[1], Ref: fields[2]}, true
+	}
+	return refUpdate{}, false
+}
+
+func isObjectName(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// copyClientInput forwards the client stream to git. The leading request
+// sections are parsed and passed to inspect before they are forwarded, so
+// inspect may abort the session by returning an error. Once more than
+// maxRefUpdates ref updates were read, inspect is called right away and the
+// rest of the commands is never read. The rest of the stream, e.g. the pack of
+// a push, is passed through wrap if set and copied with a buffer of bufSize
+// bytes.
+func copyClientInput(dst io.Writer, src io.Reader, bufSize int, maxRefUpdates int, inspect func(*clientRequest) error, wrap func(*clientRequest, io.Reader) (io.Reader, error)) error {
+	reader := bufio.NewReader(src)
+	req := &clientRequest{maxRefUpdates: maxRefUpdates}
+
+	for {
+		buf := &bytes.Buffer{}
+		done, err := req.readSection(reader, buf)
+		if err == errSectionTooLarge {
+			return err
+		}
+		if err != nil {
+			// Let git deal with streams we do not understand
+			if _, werr := dst.Write(buf.Bytes()); werr != nil {
+				return werr
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			break
+		}
+
+		if done {
+			if err := inspect(req); err != nil {
+				return err
+			}
+			if req.truncated {
+				return fmt.Errorf("push updates more than %d refs", maxRefUpdates)
+			}
+		}
+
+		if _, err := dst.Write(buf.Bytes()); err != nil {
+			return err
+		}
+
+		if done {
+			break
+		}
+	}
+
+	var rest io.Reader = reader
+	if wrap != nil {
+		var err error
+		if rest, err = wrap(req, reader); err != nil {
+			return err
+		}
+		if closer, ok := rest.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+
+	_, err := copyBuffer(dst, rest, bufSize)
+	return err
+}
@@ -0,0 +1,143 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pktStream(lines ...string) string {
+	buf := &bytes.Buffer{}
+	for _, line := range lines {
+		if line == "0000" || line == "0001" {
+			buf.WriteString(line)
+			continue
+		}
+		packLine(buf, line)
+	}
+	return buf.String()
+}
+
+func Test_copyClientInput(t *testing.T) {
+	oid := "e285100b636ac67fa28d85685072158edaa01685"
+
+	examples := []struct {
+		input   string
+		command string
+		caps    []string
+	}{
+		{
+			input: pktStream("want "+oid+" thin-pack ofs-delta agent=git/2.39\n", "want "+oid+"\n", "shallow "+oid+"\n", "deepen 1\n", "0000") + "0009done\n",
+			caps:  []string{"thin-pack", "ofs-delta", "agent=git/2.39", "deepen 1"},
+		},
+		{
+			input: pktStream(ZeroSHA+" "+oid+" refs/heads/main\x00report-status side-band-64k\n", ZeroSHA+" "+oid+" refs/heads/dev\n", "0000") + "PACK...",
+			caps:  []string{"report-status", "side-band-64k"},
+		},
+		{
+			input:   pktStream("command=ls-refs\n", "agent=git/2.39\n", "0001", "peel\n", "0000", "command=fetch\n", "0001", "thin-pack\n", "want "+oid+"\n", "filter blob:none\n", "done\n", "0000"),
+			command: "fetch",
+			caps:    []string{"agent=git/2.39", "peel", "thin-pack", "filter blob:none", "done"},
+		},
+		{
+			input: "0000",
+		},
+	}
+
+	for _, example := range examples {
+		var req *clientRequest
+		out := &bytes.Buffer{}
+
+		err := copyClientInput(out, bytes.NewBufferString(example.input), 0, 0, func(r *clientRequest) error {
+			req = r
+			return nil
+		}, nil)
+
+		assert.NoError(t, err)
+		assert.Equal(t, example.input, out.String())
+		assert.NotNil(t, req)
+		assert.Equal(t, example.command, req.Command)
+		assert.Equal(t, example.caps, req.Caps)
+	}
+}
+
+func Test_copyClientInputAbort(t *testing.T) {
+	input := pktStream("want e285100b636ac67fa28d85685072158edaa01685 thin-pack\n", "0000")
+	out := &bytes.Buffer{}
+
+	err := copyClientInput(out, bytes.NewBufferString(input), 0, 0, func(r *clientRequest) error {
+		return fmt.Errorf("denied")
+	}, nil)
+
+	assert.EqualError(t, err, "denied")
+	assert.Equal(t, 0, out.Len())
+}
+
+func Test_copyClientInputInvalid(t *testing.T) {
+	input := "zzzz some garbage"
+	out := &bytes.Buffer{}
+
+	err := copyClientInput(out, bytes.NewBufferString(input), 0, 0, func(r *clientRequest) error {
+		t.Error("inspect should not be called")
+		return nil
+	}, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, input, out.String())
+}
+
+func TestConfig_checkRefUpdates(t *testing.T) {
+	oid := "e285100b636ac67fa28d85685072158edaa01685"
+	input := pktStream(ZeroSHA+" "+oid+" refs/heads/main\x00report-status\n", ZeroSHA+" "+oid+" refs/heads/dev\n", oid+" "+ZeroSHA+" refs/tags/v1\n", "0000") + "PACK..."
+
+	var req *clientRequest
+	err := copyClientInput(&bytes.Buffer{}, bytes.NewBufferString(input), 0, 0, func(r *clientRequest) error {
+		req = r
+		return nil
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, req.refUpdates())
+
+	assert.NoError(t, (&Config{}).checkRefUpdates(req))
+	assert.NoError(t, (&Config{MaxRefsPerPush: 3}).checkRefUpdates(req))
+	assert.EqualError(t, (&Config{MaxRefsPerPush: 2}).checkRefUpdates(req), "push updates more than 2 refs")
+}
+
+func Test_copyClientInputMaxRefUpdates(t *testing.T) {
+	oid := "e285100b636ac67fa28d85685072158edaa01685"
+	lines := []string{ZeroSHA + " " + oid + " refs/heads/main\x00report-status\n"}
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf("%s %s refs/heads/b%d\n", ZeroSHA, oid, i))
+	}
+	input := pktStream(lines...) + "invalid"
+
+	// The limit is checked before the end of the section is read
+	var req *clientRequest
+	out := &bytes.Buffer{}
+	err := copyClientInput(out, bytes.NewBufferString(input), 0, 2, func(r *clientRequest) error {
+		req = r
+		return (&Config{MaxRefsPerPush: 2}).checkRefUpdates(r)
+	}, nil)
+	assert.EqualError(t, err, "push updates more than 2 refs")
+	assert.Equal(t, 3, req.refUpdates())
+	assert.Equal(t, 0, out.Len())
+}
+
+func Test_copyClientInputSectionSize(t *testing.T) {
+	line := "have " + strings.Repeat("a", 40) + "\n"
+	lines := make([]string, maxSectionSize/len(line)+1)
+	for i := range lines {
+		lines[i] = line
+	}
+
+	out := &bytes.Buffer{}
+	err := copyClientInput(out, bytes.NewBufferString(pktStream(lines...)), 0, 0, func(r *clientRequest) error {
+		t.Error("inspect should not be called")
+		return nil
+	}, nil)
+	assert.Equal(t, errSectionTooLarge, err)
+	assert.Equal(t, 0, out.Len())
+}
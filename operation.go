@@ -0,0 +1,39 @@
+package gitkit
+
+import "time"
+
+// Outcomes of git commands run over SSH, see Operation
+const (
+	OutcomeSuccess          = "success"           // The command exited with status 0
+	OutcomeAuthDenied       = "auth-denied"       // The key was not allowed to run the command
+	OutcomeRejected         = "rejected"          // The command was refused, e.g. a missing repo, a session limit or a rejected pack
+	OutcomeGitError         = "git-error"         // Git could not be run or exited with an error
+	OutcomeTimeout          = "timeout"           // Git was killed after UploadPackTimeout or ReceivePackTimeout
+	OutcomeClientDisconnect = "client-disconnect" // The client went away before the exit status was sent
+)
+
+// Operation describes a finished git command of an SSH session
+type Operation struct {
+	Repo     string
+	Verb     string // upload-pack, upload-archive or receive-pack
+	KeyID    string
+	Outcome  string        // One of the Outcome* constants
+	Start    time.Time     // Time the command was parsed
+	Duration time.Duration // Time until the exit status was sent or the session was closed
+}
+
+// operationDone passes a finished command to the OnOperation callback
+func (c *Config) operationDone(gitcmd *GitCommand, keyID string, start time.Time, outcome string) {
+	if c.OnOperation == nil {
+		return
+	}
+
+	c.OnOperation(Operation{
+		Repo:     gitcmd.Repo,
+		Verb:     gitcmd.Verb(),
+		KeyID:    keyID,
+		Outcome:  outcome,
+		Start:    start,
+		Duration: time.Since(start),
+	})
+}
@@ -0,0 +1,111 @@
+package gitkit
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// packInspection runs the pack of a push through Config.PackInspector and the
+// thin pack check and records whether the pack has been rejected
+type packInspection struct {
+	repo          string
+	inspector     func(repo string, pack io.Reader) (io.Reader, error)
+	checkThin     bool
+	allowThinPack bool
+	onThinPack    func(repo string)
+
+	mu       sync.Mutex
+	rejected error
+}
+
+// packInspection returns nil unless pushes to the repo are inspected
+func (c *Config) packInspection(repo string) *packInspection {
+	allowThin := c.allowThinPack()
+	if c.PackInspector == nil && allowThin && c.OnThinPack == nil {
+		return nil
+	}
+	return &packInspection{
+		repo:          strings.TrimSuffix(repo, ".git"),
+		inspector:     c.PackInspector,
+		checkThin:     !allowThin || c.OnThinPack != nil,
+		allowThinPack: allowThin,
+		onThinPack:    c.OnThinPack,
+	}
+}
+
+// wrapper returns the function passed to copyClientInput, nil if there is
+// no inspection
+func (p *packInspection) wrapper() func(*clientRequest, io.Reader) (io.Reader, error) {
+	if p == nil {
+		return nil
+	}
+	return p.wrap
+}
+
+// wrap returns the reader passed to git instead of the pack stream
+func (p *packInspection) wrap(req *clientRequest, pack io.Reader) (io.Reader, error) {
+	if p.inspector != nil {
+		inspected, err := p.inspector(p.repo, pack)
+		if err != nil {
+			p.reject(err)
+			return nil, err
+		}
+		pack = inspected
+	}
+	if p.checkThin {
+		pack = newThinPackReader(pack, objectHash(req), p.thinPack)
+	}
+	return &inspectedReader{reader: pack, inspection: p}, nil
+}
+
+// thinPack reports a thin pack and returns the rejection if thin packs are not allowed
+func (p *packInspection) thinPack() error {
+	if p.onThinPack != nil {
+		p.onThinPack(p.repo)
+	}
+	if !p.allowThinPack {
+		return ErrThinPack
+	}
+	return nil
+}
+
+func (p *packInspection) reject(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rejected == nil {
+		p.rejected = err
+	}
+}
+
+// err returns the reason the pack has been rejected, nil if it has not
+func (p *packInspection) err() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rejected
+}
+
+// inspectedReader treats read errors of the inspector as a rejection
+type inspectedReader struct {
+	reader     io.Reader
+	inspection *packInspection
+}
+
+func (r *inspectedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.inspection.reject(err)
+	}
+	return n, err
+}
+
+// Close releases the thin pack check once the stream is done
+func (r *inspectedReader) Close() error {
+	if thin, ok := r.reader.(*thinPackReader); ok {
+		return thin.Close()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_copyClientInputPack(t *testing.T) {
+	oid := "e285100b636ac67fa28d85685072158edaa01685"
+	commands := pktStream(ZeroSHA+" "+oid+" refs/heads/main\x00report-status\n", "0000")
+
+	var pack []byte
+	out := &bytes.Buffer{}
+	err := copyClientInput(out, bytes.NewBufferString(commands+"PACK..."), 0, 0, func(r *clientRequest) error {
+		return nil
+	}, func(req *clientRequest, r io.Reader) (io.Reader, error) {
+		var err error
+		pack, err = ioutil.ReadAll(r)
+		return bytes.NewBufferString("PACK!!!"), err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "PACK...", string(pack))
+	assert.Equal(t, commands+"PACK!!!", out.String())
+
+	// Errors of the inspector are recorded as a rejection
+	inspection := (&Config{PackInspector: func(repo string, pack io.Reader) (io.Reader, error) {
+		assert.Equal(t, "app", repo)
+		return io.MultiReader(pack, &failingReader{fmt.Errorf("pack too large")}), nil
+	}}).packInspection("app.git")
+
+	out.Reset()
+	err = copyClientInput(out, bytes.NewBufferString(commands+"PACK..."), 0, 0, func(r *clientRequest) error {
+		return nil
+	}, inspection.wrapper())
+	assert.EqualError(t, err, "pack too large")
+	assert.EqualError(t, inspection.err(), "pack too large")
+	assert.Equal(t, commands+"PACK...", out.String())
+
+	assert.Nil(t, (&Config{}).packInspection("app.git"))
+	assert.Nil(t, (&Config{}).packInspection("app.git").wrapper())
+	assert.NoError(t, (&Config{}).packInspection("app.git").err())
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestSSH_PackInspector(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	dir := t.TempDir()
+	inspected := &bytes.Buffer{}
+	reject := true
+	s := NewSSH(Config{
+		Dir:    dir + "/repos",
+		KeyDir: dir + "/keys",
+		PackInspector: func(repo string, pack io.Reader) (io.Reader, error) {
+			assert.Equal(t, "app", repo)
+			inspected.Reset()
+			if reject {
+				return io.MultiReader(io.LimitReader(pack, 4), &failingReader{fmt.Errorf("pack contains secrets")}), nil
+			}
+			return io.TeeReader(pack, inspected), nil
+		},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "-q", work).Run())
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	_, err := git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	out, err := git("push", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Push rejected: pack contains secrets.")
+
+	repoPath := filepath.Join(dir, "repos", "app.git")
+	refs, err := readRefs("git", repoPath)
+	assert.NoError(t, err)
+	assert.Empty(t, refs)
+	quarantines, _ := filepath.Glob(filepath.Join(repoPath, "objects", "tmp_objdir-incoming-*"))
+	assert.Empty(t, quarantines)
+
+	reject = false
+	out, err = git("push", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.NoError(t, err, out)
+	assert.True(t, strings.HasPrefix(inspected.String(), "PACK"))
+
+	refs, err = readRefs("git", repoPath)
+	assert.NoError(t, err)
+	assert.Contains(t, refs, "refs/heads/main")
+}
@@ -0,0 +1,142 @@
+package gitkit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const backendDialTimeout = 10 * time.Second
+
+// proxyCommand runs the git command on a backend server and relays the session.
+// The server authenticates to the backend with BackendClientKey and passes on
+// the protocol version requested by the client. It returns false if the
+// backend could not be used, in which case the request has not been replied
+// to and may still be served locally.
+func (s *SSH) proxyCommand(backend string, gitcmd *GitCommand, env map[string]string, ch ssh.Channel, req *ssh.Request, limiter *rateLimiter) (bool, error) {
+	if s.config.BackendHostKeyCallback == nil {
+		return false, fmt.Errorf("backend host key callback is not provided")
+	}
+	if s.config.BackendClientKey == nil {
+		return false, fmt.Errorf("backend client key is not provided")
+	}
+
+	user := s.config.GitUser
+	if user == "" {
+		user = "git"
+	}
+
+	client, err := ssh.Dial("tcp", backend, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.config.BackendClientKey)},
+		HostKeyCallback: s.config.BackendHostKeyCallback,
+		Timeout:         backendDialTimeout,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	// Backends that do not accept the variable serve protocol v0
+	if protocol := gitProtocol(env, ""); protocol != "" {
+		session.Setenv(GitProtocolEnv, protocol)
+	}
+
+	input, err := session.StdinPipe()
+	if err != nil {
+		return false, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return false, err
+	}
+
+	if err := session.Start(fmt.Sprintf("git-%s '%s'", gitcmd.Verb(), gitcmd.Repo)); err != nil {
+		return false, err
+	}
+	req.Reply(true, nil)
+
+	done := s.stats.commandStarted(gitcmd.Repo, gitcmd.Verb())
+	defer done()
+
+	// The backend connection is closed once the timeout is reached or the
+	// connection is closed at the end of a shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout := s.config.commandTimeout(gitcmd.Verb()); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	closing := s.conns.closing()
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() != context.DeadlineExceeded {
+				return
+			}
+		case <-closing:
+		}
+		client.Close()
+	}()
+
+	go func() {
+		defer input.Close()
+
+		clientInput := limiter.reader(ch)
+		if s.config.OnNegotiation == nil {
+			copyBuffer(input, clientInput, s.config.CopyBufferSize)
+			return
+		}
+
+		err := copyClientInput(input, clientInput, s.config.CopyBufferSize, 0, func(r *clientRequest) error {
+			s.config.OnNegotiation(gitcmd.Repo, r.Caps)
+			return nil
+		}, nil)
+		if err == errSectionTooLarge {
+			ch.Stderr().Write([]byte("Request rejected: " + err.Error() + ".\r\n"))
+		}
+		if err != nil {
+			s.logger().Errorf("ssh: cant forward client input to %s: %v", backend, err)
+		}
+	}()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		copyBuffer(ch.Stderr(), stderr, s.config.CopyBufferSize)
+	}()
+	_, outErr := copyBuffer(limiter.writer(ch), stdout, s.config.CopyBufferSize)
+	if outErr != nil {
+		// The backend stops once the client is gone
+		client.Close()
+	}
+	<-stderrDone
+
+	status := uint32(0)
+	err = session.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+		status = 1
+	} else if exitErr, ok := err.(*ssh.ExitError); ok {
+		status = uint32(exitErr.ExitStatus())
+		err = nil
+	} else if err != nil {
+		status = 1
+	}
+
+	sendExitStatus(ch, status)
+
+	return true, err
+}
@@ -0,0 +1,165 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is used to read PROXY headers if
+// Config.HandshakeTimeout is not set.
+const DefaultProxyHeaderTimeout = 10 * time.Second
+
+// Signature of PROXY protocol v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Max length of a PROXY protocol v1 header including CRLF
+const proxyV1MaxLength = 107
+
+var errNoProxyHeader = errors.New("connection does not start with a PROXY header")
+
+// proxyConn is a connection accepted from a load balancer, reporting the
+// client address of its PROXY header as remote address
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxyV2LocalHeader returns a v2 header for connections of the server
+// itself, e.g. by HealthCheck
+func proxyV2LocalHeader() []byte {
+	return append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header the connection
+// must start with. Headers without a client address, e.g. health checks of
+// the balancer, keep the address of the balancer.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	prefix, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		remote, err = readProxyV2(reader)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		remote, err = readProxyV1(reader)
+	default:
+		return nil, errNoProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// readProxyV1 parses headers like PROXY TCP4 <src> <dst> <sport> <dport>\r\n
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY header exceeds %d bytes", proxyV1MaxLength)
+		}
+		c, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address in PROXY header: %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in PROXY header: %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses binary headers, only the source address of TCP over
+// IPv4 and IPv6 is used
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("invalid PROXY header version: %d", versionCommand>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL, connections of the balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("invalid PROXY header command: %d", versionCommand&0x0f)
+	}
+
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("PROXY header too short for IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("PROXY header too short for IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+// proxyHeaderTimeout returns the max duration to read PROXY headers
+func (c *Config) proxyHeaderTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return c.HandshakeTimeout
+	}
+	return DefaultProxyHeaderTimeout
+}
@@ -0,0 +1,119 @@
+package gitkit
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// proxyV2Header returns a v2 PROXY header for a TCP connection
+func proxyV2Header(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	family, srcIP, dstIP := byte(0x21), src.IP.To16(), dst.IP.To16()
+	if src.IP.To4() != nil {
+		family, srcIP, dstIP = 0x11, src.IP.To4(), dst.IP.To4()
+	}
+
+	payload := append(append([]byte{}, srcIP...), dstIP...)
+	payload = append(payload, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(payload[len(payload)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(payload[len(payload)-2:], uint16(dst.Port))
+
+	header := append(append([]byte{}, proxyV2Signature...), 0x21, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	balancer := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	examples := []struct {
+		header string
+		remote string
+		err    string
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234 22\r\n", "203.0.113.7:51234", ""},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 51234 22\r\n", "[2001:db8::7]:51234", ""},
+		{"PROXY UNKNOWN\r\n", balancer.String(), ""},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, dst)), "203.0.113.7:51234", ""},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 22})), "[2001:db8::7]:51234", ""},
+		{string(proxyV2LocalHeader()), balancer.String(), ""},
+		{"SSH-2.0-OpenSSH_8.9\r\n", "", "connection does not start with a PROXY header"},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n", "", `invalid PROXY header: "PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n"`},
+		{"PROXY TCP4 2001:db8::7 10.0.0.1 51234 22\r\n", "", `invalid source address in PROXY header: "2001:db8::7"`},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", "PROXY header exceeds 107 bytes"},
+	}
+
+	for _, ex := range examples {
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(ex.header + "SSH-2.0-Go\r\n"))
+			client.Close()
+		}()
+
+		conn, err := readProxyHeader(&addrConn{Conn: server, addr: balancer}, time.Second)
+		if ex.err != "" {
+			assert.EqualError(t, err, ex.err)
+			server.Close()
+			continue
+		}
+		if assert.NoError(t, err, ex.header) {
+			assert.Equal(t, ex.remote, conn.RemoteAddr().String())
+
+			// Data after the header is passed on
+			rest, _ := ioutil.ReadAll(conn)
+			assert.Equal(t, "SSH-2.0-Go\r\n", string(rest))
+		}
+		server.Close()
+	}
+}
+
+func TestSSH_ProxyProtocol(t *testing.T) {
+	dir := t.TempDir()
+	logger := &recordingLogger{}
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", ProxyProtocol: true})
+	s.Logger = logger
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	config := &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	conn, err := net.Dial("tcp", s.Address())
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 51234 22\r\n"))
+	assert.NoError(t, err)
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, s.Address(), config)
+	assert.NoError(t, err)
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	// The connection is logged once the server side of the handshake is done
+	logged := func() bool {
+		for _, line := range logger.recorded() {
+			if line == "info ssh: connection from 203.0.113.7:51234 (SSH-2.0-Go)" {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 100 && !logged(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, logged(), logger.recorded())
+
+	// Connections without a header are rejected
+	_, err = ssh.Dial("tcp", s.Address(), config)
+	assert.Error(t, err)
+
+	assert.NoError(t, s.HealthCheck(time.Second))
+}
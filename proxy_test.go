@@ -0,0 +1,123 @@
+package gitkit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_UploadPackBackend(t *testing.T) {
+	requireGit(t)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	clientKey, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	// The backend only accepts the client key of the front server
+	dir := t.TempDir()
+	backend := NewSSH(Config{Dir: dir + "/backend/repos", KeyDir: dir + "/backend/keys", Auth: true})
+	backend.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+		assert.Equal(t, authorizedKeyString(clientKey.PublicKey()), content)
+		return &PublicKey{Id: "front"}, nil
+	}
+	assert.NoError(t, InitRepo("app", backend.config))
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", backend.config.repoStore().Path("app.git"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:refs/heads/main"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+	assert.NoError(t, backend.Listen("127.0.0.1:0"))
+	go backend.Serve()
+	defer backend.Stop()
+
+	var mu sync.Mutex
+	var negotiated []string
+	front := NewSSH(Config{
+		Dir:               dir + "/front/repos",
+		KeyDir:            dir + "/front/keys",
+		UploadPackTimeout: time.Second,
+		UploadPackBackend: func(repo string, remote net.Addr) (string, error) {
+			assert.Equal(t, "app", repo)
+			return backend.Address(), nil
+		},
+		BackendHostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BackendClientKey:       clientKey,
+		OnNegotiation: func(repo string, caps []string) {
+			mu.Lock()
+			defer mu.Unlock()
+			negotiated = append(negotiated, repo)
+		},
+	})
+	assert.NoError(t, front.Listen("127.0.0.1:0"))
+	go front.Serve()
+	defer front.Stop()
+
+	conn, err := ssh.Dial("tcp", front.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// The protocol version is passed on, and idle sessions time out while
+	// they are counted in the stats
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Setenv(GitProtocolEnv, "version=2"))
+	stdin, err := session.StdinPipe()
+	assert.NoError(t, err)
+	defer stdin.Close()
+	stdout, err := session.StdoutPipe()
+	assert.NoError(t, err)
+	assert.NoError(t, session.Start("git-upload-pack 'app.git'"))
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "000eversion 2\n", line)
+	assert.Equal(t, int64(1), front.Stats().Operations["upload-pack"])
+
+	start := time.Now()
+	go io.Copy(io.Discard, stdout)
+	err = session.Wait()
+	if assert.IsType(t, &ssh.ExitError{}, err) {
+		assert.Equal(t, 1, err.(*ssh.ExitError).ExitStatus())
+	}
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+	for i := 0; i < 50 && front.Stats().Operations["upload-pack"] != 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, int64(0), front.Stats().Operations["upload-pack"])
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	_, port, _ := net.SplitHostPort(front.Address())
+	cmd := exec.Command("git", "clone", "-q", "ssh://git@127.0.0.1/app.git", filepath.Join(dir, "clone"))
+	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	assert.FileExists(t, filepath.Join(dir, "clone", ".git", "refs", "heads", "main"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, strings.Join(negotiated, ","), "app.git")
+}
@@ -0,0 +1,111 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DefaultPublishTopic is used if Receiver.PublishTopic is not set
+const DefaultPublishTopic = "gitkit.push"
+
+// Max number of commits listed per ref in push events
+const maxEventCommits = 100
+
+// Publisher sends events to a message broker, e.g. NATS or Kafka
+type Publisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+}
+
+// PushEvent is published as JSON after a push has been handled
+type PushEvent struct {
+	Repo string     `json:"repo"`
+	Refs []RefEvent `json:"refs"`
+}
+
+// RefEvent describes a single ref update of a push
+type RefEvent struct {
+	Ref     string        `json:"ref"`
+	Action  string        `json:"action"`
+	OldRev  string        `json:"old_rev"`
+	NewRev  string        `json:"new_rev"`
+	Commits []CommitEvent `json:"commits"`
+}
+
+// CommitEvent describes a pushed commit
+type CommitEvent struct {
+	ID          string `json:"id"`
+	AuthorName  string `json:"author_name"`
+	AuthorEmail string `json:"author_email"`
+	Message     string `json:"message"`
+}
+
+// publish sends the push event of the hooks if a publisher is configured
+func (r *Receiver) publish(hooks []*HookInfo) error {
+	if r.Publisher == nil || len(hooks) == 0 {
+		return nil
+	}
+
+	event := PushEvent{Repo: hooks[0].RepoName, Refs: []RefEvent{}}
+	for _, hook := range hooks {
+		commits, err := readCommits(hook)
+		if err != nil {
+			return err
+		}
+
+		event.Refs = append(event.Refs, RefEvent{
+			Ref:     hook.Ref,
+			Action:  hook.Action,
+			OldRev:  hook.OldRev,
+			NewRev:  hook.NewRev,
+			Commits: commits,
+		})
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	topic := r.PublishTopic
+	if topic == "" {
+		topic = DefaultPublishTopic
+	}
+
+	if err := r.Publisher.Publish(context.Background(), topic, payload); err != nil {
+		return fmt.Errorf("cant publish push event: %v", err)
+	}
+	return nil
+}
+
+// readCommits lists the commits added to the ref, newest first
+func readCommits(hook *HookInfo) ([]CommitEvent, error) {
+	commits := []CommitEvent{}
+	if hook.NewRev == ZeroSHA {
+		return commits, nil
+	}
+
+	revs := hook.NewRev
+	if hook.OldRev != ZeroSHA {
+		revs = hook.OldRev + ".." + hook.NewRev
+	}
+
+	cmd := exec.Command("git", "log", "-z", fmt.Sprintf("--max-count=%d", maxEventCommits), "--format=%H%x1f%an%x1f%ae%x1f%s", revs)
+	cmd.Dir = hook.RepoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cant read commits: %v", err)
+	}
+
+	for _, entry := range strings.Split(string(out), "\x00") {
+		fields := strings.Split(entry, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		commits = append(commits, CommitEvent{ID: fields[0], AuthorName: fields[1], AuthorEmail: fields[2], Message: fields[3]})
+	}
+
+	return commits, nil
+}
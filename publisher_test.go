@@ -0,0 +1,71 @@
+package gitkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPublisher struct {
+	topic   string
+	payload []byte
+	err     error
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, payload []byte) error {
+	p.topic = topic
+	p.payload = payload
+	return p.err
+}
+
+func TestReceiver_publish(t *testing.T) {
+	requireGit(t)
+
+	repoDir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "first")
+	first := git("rev-parse", "HEAD")
+	git("commit", "-q", "--allow-empty", "-m", "second")
+	second := git("rev-parse", "HEAD")
+
+	publisher := &testPublisher{}
+	r := Receiver{TmpDir: t.TempDir(), Publisher: publisher}
+
+	hooks := []*HookInfo{
+		newHookInfo("app.git", repoDir, first, second, "refs/heads/main"),
+		newHookInfo("app.git", repoDir, first, ZeroSHA, "refs/heads/old"),
+	}
+	assert.NoError(t, r.HandleHooks(hooks))
+	assert.Equal(t, DefaultPublishTopic, publisher.topic)
+
+	event := PushEvent{}
+	assert.NoError(t, json.Unmarshal(publisher.payload, &event))
+	assert.Equal(t, "app.git", event.Repo)
+	assert.Equal(t, 2, len(event.Refs))
+	assert.Equal(t, []CommitEvent{{ID: second, AuthorName: "Test", AuthorEmail: "test@example.com", Message: "second"}}, event.Refs[0].Commits)
+	assert.Equal(t, BranchDeleteAction, event.Refs[1].Action)
+	assert.Empty(t, event.Refs[1].Commits)
+
+	// Failed handlers are not published
+	publisher.payload = nil
+	r.BatchHandlerFunc = func([]*HookInfo, string) error { return errors.New("rejected") }
+	assert.EqualError(t, r.HandleHooks(hooks), "rejected")
+	assert.Nil(t, publisher.payload)
+
+	r.BatchHandlerFunc = nil
+	publisher.err = errors.New("broker down")
+	assert.EqualError(t, r.HandleHooks(hooks), "cant publish push event: broker down")
+}
@@ -0,0 +1,115 @@
+package gitkit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Push holds the ref updates applied by a single receive-pack session
+type Push struct {
+	KeyID    string      // SSH key ID or verified HTTP identity of the pusher
+	RepoName string      // Repository name relative to the repos directory
+	RepoPath string      // Full path to the repository
+	Refs     []*HookInfo // Updated refs
+
+	// Shows a message in the pusher's terminal, prefixed with "remote:".
+	// Messages are only delivered over SSH and dropped for HTTP pushes.
+	Progress func(string)
+}
+
+// progressFunc returns a func writing messages to w the way git prints
+// messages of the remote side
+func progressFunc(w io.Writer) func(string) {
+	return func(message string) {
+		for _, line := range strings.Split(strings.TrimRight(message, "\n"), "\n") {
+			fmt.Fprintf(w, "remote: %s\n", line)
+		}
+	}
+}
+
+// logRefs passes the updated refs of the push to RefLogFunc
+func (c *Config) logRefs(push *Push) {
+	if c.RefLogFunc == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, ref := range push.Refs {
+		c.RefLogFunc(push.RepoName, ref.Ref, ref.OldRev, ref.NewRev, push.KeyID, now)
+	}
+}
+
+// readRefs returns all refs of the repository mapped to their object names
+func readRefs(gitPath string, repoPath string) (map[string]string, error) {
+	cmd := exec.Command(gitPath, "for-each-ref", "--format=%(objectname) %(refname)")
+	cmd.Dir = repoPath
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		chunks := strings.SplitN(scanner.Text(), " ", 2)
+		if len(chunks) != 2 {
+			continue
+		}
+		refs[chunks[1]] = chunks[0]
+	}
+
+	return refs, scanner.Err()
+}
+
+// refUpdate is a ref update command sent to receive-pack
+type refUpdate struct {
+	OldRev string
+	NewRev string
+	Ref    string
+}
+
+// pushCommands records the ref updates a client sends to receive-pack, so
+// pushes are attributed only the refs they updated themselves
+type pushCommands struct {
+	mu      sync.Mutex
+	updates []refUpdate
+}
+
+// record keeps the ref update commands of the request
+func (p *pushCommands) record(req *clientRequest) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates = req.updates()
+}
+
+// refs builds hook infos for the recorded commands whose refs point to the
+// new revision after the push. Commands rejected by git, or refs updated by
+// a concurrent push since, are left out.
+func (p *pushCommands) refs(repoName string, repoPath string, after map[string]string) []*HookInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hooks := []*HookInfo{}
+	for _, update := range p.updates {
+		current, ok := after[update.Ref]
+		if !ok {
+			current = ZeroSHA
+		}
+		if current != update.NewRev {
+			continue
+		}
+		hooks = append(hooks, newHookInfo(repoName, repoPath, update.OldRev, update.NewRev, update.Ref))
+	}
+	return hooks
+}
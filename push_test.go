@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pushCommands(t *testing.T) {
+	oid1 := "e285100b636ac67fa28d85685072158edaa01685"
+	oid2 := "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2"
+
+	req := &clientRequest{Lines: []string{
+		oid1 + " " + oid2 + " refs/heads/main\x00report-status",
+		ZeroSHA + " " + oid2 + " refs/heads/feature/x",
+		oid1 + " " + ZeroSHA + " refs/heads/old",
+		ZeroSHA + " " + oid1 + " refs/heads/rejected",
+		oid2 + " " + oid1 + " refs/heads/stable",
+	}}
+	commands := &pushCommands{}
+	commands.record(req)
+
+	// refs/heads/stable was updated by a concurrent push in the meantime,
+	// refs/heads/other by another push entirely
+	after := map[string]string{
+		"refs/heads/main":      oid2,
+		"refs/heads/feature/x": oid2,
+		"refs/heads/stable":    oid2,
+		"refs/heads/other":     oid1,
+	}
+
+	hooks := commands.refs("repo.git", "/repos/repo.git", after)
+	assert.Equal(t, 3, len(hooks))
+
+	assert.Equal(t, "refs/heads/main", hooks[0].Ref)
+	assert.Equal(t, BranchPushAction, hooks[0].Action)
+	assert.Equal(t, oid1, hooks[0].OldRev)
+
+	assert.Equal(t, "refs/heads/feature/x", hooks[1].Ref)
+	assert.Equal(t, "feature/x", hooks[1].RefName)
+	assert.Equal(t, BranchCreateAction, hooks[1].Action)
+	assert.Equal(t, ZeroSHA, hooks[1].OldRev)
+
+	assert.Equal(t, "refs/heads/old", hooks[2].Ref)
+	assert.Equal(t, BranchDeleteAction, hooks[2].Action)
+	assert.Equal(t, ZeroSHA, hooks[2].NewRev)
+	assert.Equal(t, "repo.git", hooks[2].RepoName)
+
+	// Recording is a no-op without commands to record
+	var none *pushCommands
+	none.record(req)
+}
+
+func Test_progressFunc(t *testing.T) {
+	buf := &bytes.Buffer{}
+	progress := progressFunc(buf)
+
+	progress("Deploying...")
+	progress("step 1\nstep 2\n")
+	assert.Equal(t, "remote: Deploying...\nremote: step 1\nremote: step 2\n", buf.String())
+}
+
+func TestConfig_logRefs(t *testing.T) {
+	refs := []*HookInfo{
+		newHookInfo("repo.git", "/repos/repo.git", ZeroSHA, "a3d33576d686e7dc1d90ec4b1a6e94e760a893b2", "refs/heads/main"),
+		newHookInfo("repo.git", "/repos/repo.git", "e285100b636ac67fa28d85685072158edaa01685", ZeroSHA, "refs/heads/old"),
+	}
+	push := &Push{KeyID: "alice", RepoName: "repo.git", Refs: refs}
+
+	// No-op without a func
+	(&Config{}).logRefs(push)
+
+	logged := []string{}
+	var times []time.Time
+	c := &Config{RefLogFunc: func(repo, ref, oldRev, newRev, keyID string, at time.Time) {
+		logged = append(logged, fmt.Sprintf("%s %s %s..%s %s", repo, ref, oldRev[:7], newRev[:7], keyID))
+		times = append(times, at)
+	}}
+	c.logRefs(push)
+
+	assert.Equal(t, []string{
+		"repo.git refs/heads/main 0000000..a3d3357 alice",
+		"repo.git refs/heads/old e285100..0000000 alice",
+	}, logged)
+	assert.Equal(t, times[0], times[1])
+}
@@ -0,0 +1,89 @@
+package gitkit
+
+import (
+	"sync"
+	"time"
+)
+
+// ReceiveRateLimit limits how often pushes are accepted over SSH. Fetches do
+// not count against the limits.
+type ReceiveRateLimit struct {
+	PerKey int           // Pushes per key within Window, zero means unlimited
+	PerIP  int           // Pushes per client IP within Window, zero means unlimited
+	Window time.Duration // Period in which pushes are counted, defaults to a minute
+}
+
+func (l ReceiveRateLimit) enabled() bool {
+	return l.PerKey > 0 || l.PerIP > 0
+}
+
+func (l ReceiveRateLimit) window() time.Duration {
+	if l.Window <= 0 {
+		return time.Minute
+	}
+	return l.Window
+}
+
+// receiveLimiter keeps the recent pushes keyed by key ID and client IP
+type receiveLimiter struct {
+	config ReceiveRateLimit
+	now    func() time.Time
+
+	mu        sync.Mutex
+	pushes    map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newReceiveLimiter(config ReceiveRateLimit) *receiveLimiter {
+	return &receiveLimiter{config: config, now: time.Now, pushes: map[string][]time.Time{}}
+}
+
+// allow records a push of the key from the client IP, or returns false
+// without recording it if either limit is reached
+func (l *receiveLimiter) allow(keyID string, ip string) bool {
+	if l == nil || !l.config.enabled() {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	since := now.Add(-l.config.window())
+	l.sweep(now, since)
+
+	var counters []string
+	if l.config.PerKey > 0 && keyID != "" {
+		counter := "key:" + keyID
+		if len(recentFailures(l.pushes[counter], since)) >= l.config.PerKey {
+			return false
+		}
+		counters = append(counters, counter)
+	}
+	if l.config.PerIP > 0 && ip != "" {
+		counter := "ip:" + ip
+		if len(recentFailures(l.pushes[counter], since)) >= l.config.PerIP {
+			return false
+		}
+		counters = append(counters, counter)
+	}
+
+	for _, counter := range counters {
+		l.pushes[counter] = append(recentFailures(l.pushes[counter], since), now)
+	}
+	return true
+}
+
+// sweep removes counters without recent pushes, at most once per window
+func (l *receiveLimiter) sweep(now time.Time, since time.Time) {
+	if now.Sub(l.lastSweep) < l.config.window() {
+		return
+	}
+	l.lastSweep = now
+
+	for counter, pushes := range l.pushes {
+		if len(recentFailures(pushes, since)) == 0 {
+			delete(l.pushes, counter)
+		}
+	}
+}
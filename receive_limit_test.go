@@ -0,0 +1,35 @@
+package gitkit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_receiveLimiter(t *testing.T) {
+	now := time.Now()
+	l := newReceiveLimiter(ReceiveRateLimit{PerKey: 2, PerIP: 3, Window: time.Minute})
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.allow("alice", "10.0.0.1"))
+	assert.True(t, l.allow("alice", "10.0.0.1"))
+	assert.False(t, l.allow("alice", "10.0.0.2"))
+
+	// Rejected pushes are not counted against the IP
+	assert.True(t, l.allow("bob", "10.0.0.1"))
+	assert.False(t, l.allow("carol", "10.0.0.1"))
+	assert.True(t, l.allow("carol", "10.0.0.2"))
+
+	now = now.Add(2 * time.Minute)
+	assert.True(t, l.allow("alice", "10.0.0.1"))
+	assert.Len(t, l.pushes, 2)
+
+	// Pushes without a key are not limited per key
+	l = newReceiveLimiter(ReceiveRateLimit{PerKey: 1})
+	assert.True(t, l.allow("", "10.0.0.1"))
+	assert.True(t, l.allow("", "10.0.0.1"))
+
+	var disabled *receiveLimiter
+	assert.True(t, disabled.allow("alice", "10.0.0.1"))
+}
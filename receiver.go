@@ -1,23 +1,55 @@
 package gitkit
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
 )
 
 const ZeroSHA = "0000000000000000000000000000000000000000"
 
+// ErrKeepTmpDir can be returned by handlers to keep the extracted tree. The
+// handler is then responsible for removing the directory.
+var ErrKeepTmpDir = errors.New("keep temp directory")
+
 type Receiver struct {
-	Debug       bool
-	MainOnly    bool
-	TmpDir      string
-	HandlerFunc func(*HookInfo, string) error
+	Debug         bool
+	MainOnly      bool
+	DetectChanges bool // Populate HookInfo.ChangedFiles before calling the handler
+	Submodules    bool // Check out submodules allowed by SubmoduleAllowed into the extracted tree, which git archive leaves empty
+	TmpDir        string
+	TmpDirName    func(*HookInfo) string // Name of the temp directory for a push, defaults to a random UUID
+	HandlerFunc   func(*HookInfo, string) error
+	OnDelete      func(*HookInfo) error // Called instead of HandlerFunc for deleted refs
+	ForceOwner    *Owner                // Owner of extracted files, defaults to the current user
+	Publisher     Publisher             // Receives an event for every handled push
+	PublishTopic  string                // Topic of push events, defaults to gitkit.push
+	InputLimits   HookInputLimits       // Bounds of the hook input, see HookInputLimits for defaults
+	Timeout       time.Duration         // Max duration of a handler call, zero means no timeout
+	Logger        Logger                // Receives log lines instead of the standard logger
+
+	// Decides if the submodule url may be fetched, e.g. if the pusher can read
+	// it. Relative urls are passed as the repo name they resolve to next to
+	// the pushed repo, e.g. org/lib.git, for SSH.CheckAccess(hook.KeyID, url,
+	// AccessRead). Only https and ssh urls are fetched otherwise. Nil refuses
+	// all submodules.
+	SubmoduleAllowed func(hook *HookInfo, url string) (bool, error)
+
+	// Called once per push with all updated refs and the tree of the primary
+	// ref, including deleted refs. Takes precedence over HandlerFunc when set.
+	BatchHandlerFunc func([]*HookInfo, string) error
 }
 
 func ReadCommitMessage(sha string) (string, error) {
@@ -28,6 +60,55 @@ func ReadCommitMessage(sha string) (string, error) {
 	return strings.TrimSpace(string(buff)), nil
 }
 
+// ChangedFiles returns the paths changed between two revisions. For new refs
+// the changes of the new revision itself are returned.
+func ChangedFiles(oldRev, newRev string) ([]string, error) {
+	return changedFiles("", oldRev, newRev)
+}
+
+func changedFiles(repoPath string, oldRev, newRev string) ([]string, error) {
+	if newRev == ZeroSHA {
+		return []string{}, nil
+	}
+
+	args := []string{"diff", "--name-status", "--no-renames", "-z", oldRev, newRev}
+	if oldRev == ZeroSHA {
+		args = []string{"diff-tree", "--root", "-r", "--no-commit-id", "--name-status", "--no-renames", "-z", newRev}
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff failed: %v", err)
+	}
+
+	// Output is a list of NUL separated status and path pairs
+	files := []string{}
+	fields := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+	for i := 1; i < len(fields); i += 2 {
+		files = append(files, fields[i])
+	}
+
+	return files, nil
+}
+
+// detectChanges sets the changed files of the hooks if enabled
+func (r *Receiver) detectChanges(hooks ...*HookInfo) error {
+	if !r.DetectChanges {
+		return nil
+	}
+
+	for _, hook := range hooks {
+		files, err := changedFiles(hook.RepoPath, hook.OldRev, hook.NewRev)
+		if err != nil {
+			return err
+		}
+		hook.ChangedFiles = files
+	}
+	return nil
+}
+
 func IsForcePush(hook *HookInfo) (bool, error) {
 	// New branch or tag OR deleted branch or tag
 	if hook.OldRev == ZeroSHA || hook.NewRev == ZeroSHA {
@@ -45,43 +126,351 @@ func IsForcePush(hook *HookInfo) (bool, error) {
 	return base != hook.OldRev, nil
 }
 
+func (r *Receiver) tmpDirName(hook *HookInfo) (string, error) {
+	if r.TmpDirName != nil {
+		name := r.TmpDirName(hook)
+		// Names must not leave TmpDir or point at TmpDir itself
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid temp directory name: %q", name)
+		}
+		return name, nil
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", fmt.Errorf("error generating new uuid: %v", err)
+	}
+	return id.String(), nil
+}
+
+// CleanupStaleTmp removes temp directories of the receiver older than the
+// given age, e.g. left behind by crashed hooks or in debug mode. Only
+// directories named with a UUID, the receiver's default naming scheme, are
+// removed.
+func CleanupStaleTmp(tmpDir string, olderThan time.Duration) (int, error) {
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-olderThan)
+	var firstErr error
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !entry.ModTime().Before(cutoff) || !isUUID(entry.Name()) {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(tmpDir, entry.Name())); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		removed++
+	}
+
+	return removed, firstErr
+}
+
+// isUUID returns true for UUIDs in their canonical form
+func isUUID(name string) bool {
+	id, err := uuid.FromString(name)
+	return err == nil && id.String() == strings.ToLower(name)
+}
+
 func (r *Receiver) Handle(reader io.Reader) error {
-	hook, err := ReadHookInput(reader)
+	return r.handle(reader, "")
+}
+
+// HandleConn handles hook input sent over a connection, e.g. a unix socket,
+// by a hook that can not pipe its stdin to the receiver. The first line must
+// be the path of the hook's repository, followed by the hook input:
+//
+//	{ pwd; cat; } | socat - UNIX-CONNECT:/run/gitkit.sock
+//
+// The handler error is written back before the connection is closed, so an
+// empty response means the push has been accepted.
+func (r *Receiver) HandleConn(conn net.Conn) error {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	repoPath, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("cant read repository path: %v", err)
+	}
+
+	repoPath = strings.TrimSpace(repoPath)
+	if !filepath.IsAbs(repoPath) {
+		return fmt.Errorf("invalid repository path: %q", repoPath)
+	}
+
+	err = r.handle(reader, repoPath)
+	if err != nil {
+		fmt.Fprintln(conn, err)
+	}
+	return err
+}
+
+// Replay runs a past ref update of the repository at repoPath through the
+// receiver as if it had just been pushed, e.g. to redeploy after fixing a
+// handler. Revisions are resolved in the repository and must exist, ZeroSHA
+// replays a created or deleted ref.
+func (r *Receiver) Replay(repoPath, oldRev, newRev, ref string) error {
+	if strings.Count(ref, "/") < 2 {
+		return fmt.Errorf("invalid ref: %q", ref)
+	}
+
+	oldRev, err := resolveRev(repoPath, oldRev)
 	if err != nil {
 		return err
 	}
+	newRev, err = resolveRev(repoPath, newRev)
+	if err != nil {
+		return err
+	}
+
+	hook := newHookInfo("", repoPath, oldRev, newRev, ref)
+	if r.BatchHandlerFunc != nil {
+		return r.HandleHooks([]*HookInfo{hook})
+	}
+	return r.HandleHook(hook)
+}
+
+// resolveRev returns the object id of a revision in the repository
+func resolveRev(repoPath, rev string) (string, error) {
+	if rev == ZeroSHA {
+		return rev, nil
+	}
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision: %q", rev)
+	}
+
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+"^{object}")
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("revision %s does not exist in %s", rev, repoPath)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// handle reads the hook input, repoPath overrides the working directory as
+// the hook's repository if set
+func (r *Receiver) handle(reader io.Reader, repoPath string) error {
+	hooks := []*HookInfo{}
+
+	if r.BatchHandlerFunc != nil {
+		var err error
+		if hooks, err = ReadHookInputsWithLimits(reader, r.InputLimits); err != nil {
+			return err
+		}
+	} else {
+		hook, err := ReadHookInputWithLimits(reader, r.InputLimits)
+		if err != nil {
+			return err
+		}
+		hooks = append(hooks, hook)
+	}
 
+	if repoPath != "" {
+		for _, hook := range hooks {
+			hook.RepoPath = repoPath
+			hook.RepoName = filepath.Base(repoPath)
+		}
+	}
+
+	if r.BatchHandlerFunc != nil {
+		return r.HandleHooks(hooks)
+	}
+	return r.HandleHook(hooks[0])
+}
+
+// HandleHook extracts the pushed tree of a single ref and runs the handler on it.
+// Git commands are executed in the hook's repository path.
+func (r *Receiver) HandleHook(hook *HookInfo) error {
 	if r.MainOnly && hook.Ref != "refs/heads/main" {
 		return fmt.Errorf("cant push to non-main branch")
 	}
 
-	id, err := uuid.NewV4()
+	// Deleted refs have no tree to extract
+	if hook.NewRev == ZeroSHA {
+		if r.OnDelete != nil {
+			err := callHandler(r.logger(), "on-delete", r.Timeout, func() error { return r.OnDelete(hook) })
+			if err != nil {
+				return err
+			}
+		}
+		return r.publish([]*HookInfo{hook})
+	}
+
+	if err := r.detectChanges(hook); err != nil {
+		return err
+	}
+
+	tmpDir, err := r.extract(hook)
 	if err != nil {
-		return fmt.Errorf("error generating new uuid: %v", err)
+		return err
 	}
 
-	tmpDir := path.Join(r.TmpDir, id.String())
-	if err := os.MkdirAll(tmpDir, 0774); err != nil {
+	if r.HandlerFunc != nil {
+		err = callHandler(r.logger(), "handler", r.Timeout, func() error { return r.HandlerFunc(hook, tmpDir) })
+	}
+
+	return r.cleanup(tmpDir, r.publishHandled([]*HookInfo{hook}, err))
+}
+
+// HandleHooks extracts the tree of the primary ref once and runs the batch
+// handler with all refs of the push. The temp directory is empty if the push
+// only deletes refs.
+func (r *Receiver) HandleHooks(hooks []*HookInfo) error {
+	if r.MainOnly {
+		for _, hook := range hooks {
+			if hook.Ref != "refs/heads/main" {
+				return fmt.Errorf("cant push to non-main branch")
+			}
+		}
+	}
+
+	if err := r.detectChanges(hooks...); err != nil {
 		return err
 	}
 
-	// Cleanup temp directory unless we're in debug mode
-	if !r.Debug {
-		defer os.RemoveAll(tmpDir)
+	tmpDir := ""
+	if primary := primaryHook(hooks); primary != nil {
+		dir, err := r.extract(primary)
+		if err != nil {
+			return err
+		}
+		tmpDir = dir
+	}
+
+	var err error
+	if r.BatchHandlerFunc != nil {
+		err = callHandler(r.logger(), "batch-handler", r.Timeout, func() error { return r.BatchHandlerFunc(hooks, tmpDir) })
+	}
+
+	return r.cleanup(tmpDir, r.publishHandled(hooks, err))
+}
+
+// publishHandled publishes the push if the handler succeeded and returns
+// the handler error, or the publish error wrapped in keepTmpDirError if the
+// handler asked to keep the temp directory
+func (r *Receiver) publishHandled(hooks []*HookInfo, err error) error {
+	if err != nil && !errors.Is(err, ErrKeepTmpDir) {
+		return err
+	}
+
+	if perr := r.publish(hooks); perr != nil {
+		if err != nil {
+			return &keepTmpDirError{perr}
+		}
+		return perr
+	}
+	return err
+}
+
+// keepTmpDirError keeps the temp directory but still fails the push
+type keepTmpDirError struct {
+	err error
+}
+
+func (e *keepTmpDirError) Error() string { return e.err.Error() }
+
+// cleanup removes the temp directory unless we're in debug mode or the
+// handler asked to keep it
+func (r *Receiver) cleanup(tmpDir string, err error) error {
+	if kerr, ok := err.(*keepTmpDirError); ok {
+		return kerr.err
+	}
+	if errors.Is(err, ErrKeepTmpDir) {
+		return nil
+	}
+
+	if !r.Debug && tmpDir != "" {
+		os.RemoveAll(tmpDir)
 	}
+	return err
+}
 
-	archiveCmd := fmt.Sprintf("git archive '%s' | tar -x -C '%s'", hook.NewRev, tmpDir)
-	buff, err := exec.Command("bash", "-c", archiveCmd).CombinedOutput()
+// extract checks out the tree of the hook's new revision into a temp directory
+func (r *Receiver) extract(hook *HookInfo) (string, error) {
+	name, err := r.tmpDirName(hook)
 	if err != nil {
-		if len(buff) > 0 && strings.Contains(string(buff), "Damaged tar archive") {
-			return fmt.Errorf("Error: repository might be empty!")
+		return "", err
+	}
+
+	tmpDir := path.Join(r.TmpDir, name)
+	if err := os.MkdirAll(tmpDir, 0774); err != nil {
+		return "", err
+	}
+
+	err = r.archive(hook, tmpDir)
+	if err == nil && r.Submodules {
+		err = checkoutSubmodules(hook, tmpDir, r.SubmoduleAllowed)
+	}
+	if err != nil {
+		if !r.Debug {
+			os.RemoveAll(tmpDir)
 		}
-		return fmt.Errorf("cant archive repo: %s", buff)
+		return "", err
 	}
 
-	if r.HandlerFunc != nil {
-		return r.HandlerFunc(hook, tmpDir)
+	return tmpDir, nil
+}
+
+// archive extracts the tree of the new revision with git archive
+func (r *Receiver) archive(hook *HookInfo, tmpDir string) error {
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.Command("git", "archive", "--format=tar", hook.NewRev)
+	cmd.Dir = hook.RepoPath
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	extractErr := extractArchive(stdout, tmpDir, r.ForceOwner)
+	if extractErr != nil {
+		// Unblock git if extraction stopped early
+		io.Copy(ioutil.Discard, stdout)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("cant archive repo: %s", strings.TrimSpace(stderr.String()))
+	}
+	if extractErr != nil {
+		return fmt.Errorf("cant extract archive: %v", extractErr)
 	}
 
 	return nil
 }
+
+// primaryHook picks the ref whose tree is extracted for a batch: the main
+// branch if pushed, otherwise the first updated branch or any other ref.
+func primaryHook(hooks []*HookInfo) *HookInfo {
+	var primary *HookInfo
+
+	for _, hook := range hooks {
+		if hook.NewRev == ZeroSHA {
+			continue
+		}
+		if hook.Ref == "refs/heads/main" {
+			return hook
+		}
+		if primary == nil || (primary.RefType != "heads" && hook.RefType == "heads") {
+			primary = hook
+		}
+	}
+
+	return primary
+}
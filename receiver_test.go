@@ -0,0 +1,429 @@
+package gitkit
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_primaryHook(t *testing.T) {
+	rev := "e285100b636ac67fa28d85685072158edaa01685"
+
+	tag := newHookInfo("repo", "", ZeroSHA, rev, "refs/tags/v1.0")
+	feature := newHookInfo("repo", "", ZeroSHA, rev, "refs/heads/feature")
+	main := newHookInfo("repo", "", rev, rev, "refs/heads/main")
+	deleted := newHookInfo("repo", "", rev, ZeroSHA, "refs/heads/old")
+
+	assert.Equal(t, main, primaryHook([]*HookInfo{tag, feature, main}))
+	assert.Equal(t, feature, primaryHook([]*HookInfo{deleted, tag, feature}))
+	assert.Equal(t, tag, primaryHook([]*HookInfo{deleted, tag}))
+	assert.Nil(t, primaryHook([]*HookInfo{deleted}))
+}
+
+func TestReceiver_tmpDirName(t *testing.T) {
+	hook := &HookInfo{RepoName: "repo", NewRev: "e285100b636ac67fa28d85685072158edaa01685"}
+
+	r := Receiver{}
+	name, err := r.tmpDirName(hook)
+	assert.NoError(t, err)
+	assert.Equal(t, 36, len(name))
+
+	r.TmpDirName = func(h *HookInfo) string { return h.RepoName + "-" + h.NewRev[:7] }
+	name, err = r.tmpDirName(hook)
+	assert.NoError(t, err)
+	assert.Equal(t, "repo-e285100", name)
+
+	for _, invalid := range []string{"", ".", "..", "/", "../foo", "foo/..", "./foo", "foo/bar", "/foo"} {
+		r.TmpDirName = func(*HookInfo) string { return invalid }
+		_, err = r.tmpDirName(hook)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestReceiver_HandleHookTmpDirName(t *testing.T) {
+	requireGit(t)
+
+	repoDir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoDir
+		assert.NoError(t, cmd.Run())
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = repoDir
+	rev, err := cmd.Output()
+	assert.NoError(t, err)
+	hook := newHookInfo("repo", repoDir, ZeroSHA, strings.TrimSpace(string(rev)), "refs/heads/main")
+
+	parent := t.TempDir()
+	used := ""
+	r := Receiver{
+		TmpDir:     filepath.Join(parent, "tmp"),
+		TmpDirName: func(h *HookInfo) string { return h.RefName + "-" + h.NewRev[:7] },
+		HandlerFunc: func(hook *HookInfo, tmpDir string) error {
+			used = tmpDir
+			return nil
+		},
+	}
+	assert.NoError(t, r.HandleHook(hook))
+	assert.Equal(t, filepath.Join(parent, "tmp", "main-"+hook.NewRev[:7]), used)
+
+	// Names escaping TmpDir are rejected before anything is extracted
+	used = ""
+	r.TmpDirName = func(*HookInfo) string { return "../escape" }
+	assert.EqualError(t, r.HandleHook(hook), `invalid temp directory name: "../escape"`)
+	assert.Equal(t, "", used)
+	_, err = os.Stat(filepath.Join(parent, "escape"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReceiver_HandleHookKeepTmpDir(t *testing.T) {
+	requireGit(t)
+
+	repoDir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "main"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoDir
+		assert.NoError(t, cmd.Run())
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = repoDir
+	rev, err := cmd.Output()
+	assert.NoError(t, err)
+
+	hook := newHookInfo("repo", repoDir, ZeroSHA, strings.TrimSpace(string(rev)), "refs/heads/main")
+
+	kept := ""
+	r := Receiver{
+		TmpDir: t.TempDir(),
+		HandlerFunc: func(hook *HookInfo, tmpDir string) error {
+			kept = tmpDir
+			return ErrKeepTmpDir
+		},
+	}
+	assert.NoError(t, r.HandleHook(hook))
+	_, err = os.Stat(kept)
+	assert.NoError(t, err)
+
+	removed := ""
+	r.HandlerFunc = func(hook *HookInfo, tmpDir string) error {
+		removed = tmpDir
+		return nil
+	}
+	assert.NoError(t, r.HandleHook(hook))
+	_, err = os.Stat(removed)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_changedFiles(t *testing.T) {
+	requireGit(t)
+
+	repoDir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q", "-b", "main")
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "a"), []byte("a"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "b"), []byte("b"), 0644))
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	first := git("rev-parse", "HEAD")
+
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "a"), []byte("changed"), 0644))
+	assert.NoError(t, os.Remove(filepath.Join(repoDir, "b")))
+	assert.NoError(t, os.MkdirAll(filepath.Join(repoDir, "dir"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "dir", "c d"), []byte("c"), 0644))
+	git("add", "-A")
+	git("commit", "-q", "-m", "second")
+	second := git("rev-parse", "HEAD")
+
+	files, err := changedFiles(repoDir, first, second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "dir/c d"}, files)
+
+	files, err = changedFiles(repoDir, ZeroSHA, first)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, files)
+
+	files, err = changedFiles(repoDir, second, ZeroSHA)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestReceiver_HandleHookDelete(t *testing.T) {
+	hook := newHookInfo("repo", t.TempDir(), "e285100b636ac67fa28d85685072158edaa01685", ZeroSHA, "refs/heads/old")
+
+	r := Receiver{
+		TmpDir: t.TempDir(),
+		HandlerFunc: func(*HookInfo, string) error {
+			t.Error("handler called for deleted ref")
+			return nil
+		},
+	}
+	assert.NoError(t, r.HandleHook(hook))
+
+	var deleted *HookInfo
+	r.OnDelete = func(hook *HookInfo) error {
+		deleted = hook
+		return nil
+	}
+	assert.NoError(t, r.HandleHook(hook))
+	assert.Equal(t, hook, deleted)
+}
+
+func TestReceiver_HandleConn(t *testing.T) {
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "receiver.sock"))
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	var deleted *HookInfo
+	r := Receiver{
+		MainOnly: true,
+		OnDelete: func(hook *HookInfo) error {
+			deleted = hook
+			return nil
+		},
+	}
+
+	send := func(payload string) string {
+		conn, err := net.Dial("unix", listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			server, err := listener.Accept()
+			if assert.NoError(t, err) {
+				r.HandleConn(server)
+			}
+		}()
+
+		conn.Write([]byte(payload))
+		conn.(*net.UnixConn).CloseWrite()
+		response, _ := ioutil.ReadAll(conn)
+		<-handled
+		return string(response)
+	}
+
+	rev := "e285100b636ac67fa28d85685072158edaa01685"
+	assert.Equal(t, "", send("/repos/app.git\n"+rev+" "+ZeroSHA+" refs/heads/main\n"))
+	assert.Equal(t, "/repos/app.git", deleted.RepoPath)
+	assert.Equal(t, "app.git", deleted.RepoName)
+
+	assert.Equal(t, "cant push to non-main branch\n", send("/repos/app.git\n"+rev+" "+ZeroSHA+" refs/heads/old\n"))
+}
+
+func TestCleanupStaleTmp(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * time.Hour)
+
+	for _, name := range []string{"3f1b7c52-8a1e-4b5e-9a43-7d6e0f1c2b3a", "deploy-cache", "0c9a5e3d-2b7f-4c1d-8e6a-5f4b3a2c1d0e"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, name, "src"), 0755))
+		assert.NoError(t, os.Chtimes(filepath.Join(dir, name), old, old))
+	}
+	fresh := "9d8c7b6a-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, fresh), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d"), []byte("file"), 0644))
+
+	removed, err := CleanupStaleTmp(dir, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"1a2b3c4d-5e6f-4a7b-8c9d-0e1f2a3b4c5d", fresh, "deploy-cache"}, names)
+
+	removed, err = CleanupStaleTmp(filepath.Join(dir, "missing"), time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestReceiver_HandleHookSubmodules(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "protocol.file.allow=always"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	// lib.git is referenced by app.git with a relative url
+	git(dir, "init", "-q", "--bare", "-b", "main", "lib.git")
+	git(dir, "init", "-q", "--bare", "-b", "main", "app.git")
+	git(dir, "clone", "-q", "lib.git", "lib")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "lib", "lib.txt"), []byte("lib"), 0644))
+	git(filepath.Join(dir, "lib"), "add", ".")
+	git(filepath.Join(dir, "lib"), "commit", "-q", "-m", "lib")
+	git(filepath.Join(dir, "lib"), "push", "-q", "origin", "HEAD:main")
+
+	git(dir, "clone", "-q", "app.git", "app")
+	work := filepath.Join(dir, "app")
+	git(work, "submodule", "add", "-q", "../lib.git", "vendor/lib")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "app.txt"), []byte("app"), 0644))
+	git(work, "add", ".")
+	git(work, "commit", "-q", "-m", "app")
+	git(work, "push", "-q", "origin", "HEAD:main")
+	rev := git(work, "rev-parse", "HEAD")
+
+	hook := newHookInfo("app.git", filepath.Join(dir, "app.git"), ZeroSHA, rev, "refs/heads/main")
+
+	var files []string
+	r := Receiver{
+		TmpDir: t.TempDir(),
+		HandlerFunc: func(hook *HookInfo, tmpDir string) error {
+			files = nil
+			return filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(tmpDir, path)
+					files = append(files, rel)
+				}
+				return err
+			})
+		},
+	}
+
+	assert.NoError(t, r.HandleHook(hook))
+	assert.Equal(t, []string{".gitmodules", "app.txt"}, files)
+
+	// Submodules are only fetched if allowed
+	r.Submodules = true
+	files = nil
+	assert.EqualError(t, r.HandleHook(hook), "submodule vendor/lib from lib.git is not allowed")
+	assert.Nil(t, files)
+
+	var urls []string
+	r.SubmoduleAllowed = func(hook *HookInfo, url string) (bool, error) {
+		urls = append(urls, url)
+		return true, nil
+	}
+	assert.NoError(t, r.HandleHook(hook))
+	assert.Equal(t, []string{".gitmodules", "app.txt", "vendor/lib/lib.txt"}, files)
+	assert.Equal(t, []string{"lib.git"}, urls)
+
+	// Submodules are not checked out through symlinks in the extracted tree
+	tmpDir, outside := t.TempDir(), t.TempDir()
+	assert.NoError(t, os.Symlink(outside, filepath.Join(tmpDir, "vendor")))
+	assert.EqualError(t, checkoutSubmodules(hook, tmpDir, r.SubmoduleAllowed), "invalid submodule path: vendor/lib")
+	entries, err := ioutil.ReadDir(outside)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Absolute urls can't reach local repos, even if allowed
+	git(work, "config", "-f", ".gitmodules", "submodule.vendor/lib.url", filepath.Join(dir, "lib.git"))
+	git(work, "commit", "-q", "-am", "absolute")
+	git(work, "push", "-q", "origin", "HEAD:main")
+	hook = newHookInfo("app.git", filepath.Join(dir, "app.git"), rev, git(work, "rev-parse", "HEAD"), "refs/heads/main")
+	err = r.HandleHook(hook)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "transport 'file' not allowed")
+	}
+}
+
+func Test_readSubmodules(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "lib")
+	lib := git("rev-parse", "HEAD")
+	git("update-index", "--add", "--cacheinfo", "160000,"+lib+",lib")
+	git("config", "-f", ".gitmodules", "submodule.lib.path", "lib")
+
+	for url, expected := range map[string]submodule{
+		"../lib.git":                {Path: "lib", SHA: lib, Repo: "org/lib.git", URL: filepath.Join(dir, "..", "lib.git")},
+		"./lib.git":                 {Path: "lib", SHA: lib, Repo: "org/app.git/lib.git", URL: filepath.Join(dir, "lib.git")},
+		"https://example.com/lib":   {Path: "lib", SHA: lib, URL: "https://example.com/lib"},
+		"git@example.com:org/lib":   {Path: "lib", SHA: lib, URL: "git@example.com:org/lib"},
+		"../../../other/secret.git": {},
+	} {
+		git("config", "-f", ".gitmodules", "submodule.lib.url", url)
+		git("add", ".gitmodules")
+		git("commit", "-q", "-m", url)
+
+		submodules, err := readSubmodules(dir, "org/app.git", "HEAD")
+		if expected.Path == "" {
+			assert.EqualError(t, err, "submodule lib is outside of the repo directory", url)
+			continue
+		}
+		assert.NoError(t, err, url)
+		assert.Equal(t, []submodule{expected}, submodules, url)
+	}
+}
+
+func TestReceiver_Replay(t *testing.T) {
+	requireGit(t)
+
+	repoDir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return strings.TrimSpace(string(out))
+	}
+
+	git("init", "-q", "-b", "main")
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "a"), []byte("a"), 0644))
+	git("add", ".")
+	git("commit", "-q", "-m", "first")
+	first := git("rev-parse", "HEAD")
+
+	var handled *HookInfo
+	var content []byte
+	r := Receiver{
+		TmpDir: t.TempDir(),
+		HandlerFunc: func(hook *HookInfo, tmpDir string) error {
+			handled = hook
+			content, _ = os.ReadFile(filepath.Join(tmpDir, "a"))
+			return nil
+		},
+	}
+
+	assert.NoError(t, r.Replay(repoDir, ZeroSHA, "main", "refs/heads/main"))
+	if assert.NotNil(t, handled) {
+		assert.Equal(t, first, handled.NewRev)
+		assert.Equal(t, BranchCreateAction, handled.Action)
+		assert.Equal(t, repoDir, handled.RepoPath)
+		assert.Equal(t, "a", string(content))
+	}
+
+	missing := "e285100b636ac67fa28d85685072158edaa01685"
+	assert.EqualError(t, r.Replay(repoDir, missing, first, "refs/heads/main"), "revision "+missing+" does not exist in "+repoDir)
+	assert.EqualError(t, r.Replay(repoDir, ZeroSHA, first, "main"), `invalid ref: "main"`)
+}
@@ -0,0 +1,105 @@
+package gitkit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Ref is a named reference of a repository
+type Ref struct {
+	Name string // Full ref name, e.g. refs/heads/main
+	SHA  string // Object the ref points to
+}
+
+// ListRefs returns all refs of the repository sorted by name. Empty
+// repositories have no refs.
+func ListRefs(name string, config *Config) ([]Ref, error) {
+	repoPath, err := existingRepoPath(name, config)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runGit(config.GitPath, repoPath, "for-each-ref", "--format=%(objectname) %(refname)")
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []Ref{}
+	for _, line := range strings.Split(string(out), "\n") {
+		chunks := strings.SplitN(line, " ", 2)
+		if len(chunks) != 2 {
+			continue
+		}
+		refs = append(refs, Ref{Name: chunks[1], SHA: chunks[0]})
+	}
+
+	return refs, nil
+}
+
+// GetDefaultBranch returns the branch HEAD points to, i.e. the branch
+// checked out by fresh clones
+func GetDefaultBranch(name string, config *Config) (string, error) {
+	repoPath, err := existingRepoPath(name, config)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := runGit(config.GitPath, repoPath, "symbolic-ref", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(strings.TrimSpace(out), "refs/heads/"), nil
+}
+
+// SetDefaultBranch points HEAD of the repository to an existing branch
+func SetDefaultBranch(name string, branch string, config *Config) error {
+	repoPath, err := existingRepoPath(name, config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := runGit(config.GitPath, repoPath, "check-ref-format", "--branch", branch); err != nil || strings.HasPrefix(branch, "-") {
+		return fmt.Errorf("invalid branch name %q", branch)
+	}
+
+	ref := "refs/heads/" + branch
+	if _, err := runGit(config.GitPath, repoPath, "show-ref", "--verify", "--quiet", ref); err != nil {
+		return fmt.Errorf("branch %q does not exist", branch)
+	}
+
+	_, err = runGit(config.GitPath, repoPath, "symbolic-ref", "HEAD", ref)
+	return err
+}
+
+// existingRepoPath returns the path of the named repository or
+// os.ErrNotExist if it does not exist
+func existingRepoPath(name string, config *Config) (string, error) {
+	name, err := NormalizeRepoName(name)
+	if err != nil {
+		return "", err
+	}
+	if err := config.checkRepoPath(name); err != nil {
+		return "", err
+	}
+
+	store := config.repoStore()
+	if !store.Exists(name) {
+		return "", os.ErrNotExist
+	}
+	return store.Path(name), nil
+}
+
+// runGit runs a git command in the repository and returns its output
+func runGit(gitPath string, repoPath string, args ...string) (string, error) {
+	cmd := exec.Command(gitPath, args...)
+	cmd.Dir = repoPath
+	cmd.Env = withoutRepoEnv(os.Environ())
+
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("git %s failed: %s", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return string(out), err
+}
@@ -0,0 +1,88 @@
+package gitkit
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListRefs(t *testing.T) {
+	requireGit(t)
+
+	config := &Config{Dir: t.TempDir(), GitPath: "git"}
+	assert.NoError(t, InitRepo("app", config))
+
+	refs, err := ListRefs("app", config)
+	assert.NoError(t, err)
+	assert.Equal(t, []Ref{}, refs)
+
+	work := filepath.Join(t.TempDir(), "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", config.repoStore().Path("app.git"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:refs/heads/main", "HEAD:refs/tags/v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = work
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	sha := strings.TrimSpace(string(out))
+
+	refs, err = ListRefs("/../app.git", config)
+	assert.NoError(t, err)
+	assert.Equal(t, []Ref{
+		{Name: "refs/heads/main", SHA: sha},
+		{Name: "refs/tags/v1", SHA: sha},
+	}, refs)
+
+	_, err = ListRefs("missing", config)
+	assert.Equal(t, os.ErrNotExist, err)
+
+	_, err = ListRefs("-app", config)
+	assert.Error(t, err)
+}
+
+func TestDefaultBranch(t *testing.T) {
+	requireGit(t)
+
+	config := &Config{Dir: t.TempDir(), GitPath: "git"}
+	assert.NoError(t, InitRepo("app", config))
+
+	work := filepath.Join(t.TempDir(), "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", config.repoStore().Path("app.git"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:refs/heads/master", "HEAD:refs/heads/develop"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+
+	assert.NoError(t, SetDefaultBranch("app", "master", config))
+	branch, err := GetDefaultBranch("app", config)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", branch)
+
+	assert.NoError(t, SetDefaultBranch("app", "develop", config))
+	branch, err = GetDefaultBranch("app.git", config)
+	assert.NoError(t, err)
+	assert.Equal(t, "develop", branch)
+
+	assert.EqualError(t, SetDefaultBranch("app", "missing", config), `branch "missing" does not exist`)
+	assert.EqualError(t, SetDefaultBranch("app", "bad..name", config), `invalid branch name "bad..name"`)
+	assert.Equal(t, os.ErrNotExist, SetDefaultBranch("missing", "main", config))
+
+	branch, err = GetDefaultBranch("app", config)
+	assert.NoError(t, err)
+	assert.Equal(t, "develop", branch)
+}
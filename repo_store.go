@@ -0,0 +1,233 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathEscape is returned for repositories whose path resolves outside of
+// the repository root, e.g. through a symlink in Config.Dir
+var ErrPathEscape = errors.New("repository path escapes the repository root")
+
+// RepoStore locates and manages repositories. Names are relative to the store
+// and may omit the .git suffix.
+type RepoStore interface {
+	Exists(name string) bool  // Returns true if the repository exists
+	Path(name string) string  // Returns the local path git is run against
+	Create(name string) error // Creates an empty bare repository
+	Delete(name string) error // Removes the repository
+	List() ([]string, error)  // Returns the names of all repositories
+}
+
+// FSRepoStore keeps bare repositories in a local directory
+type FSRepoStore struct {
+	Dir         string // Directory that contains repositories
+	GitPath     string // Path to git binary
+	TemplateDir string // Template directory of new repositories, see git init --template
+}
+
+// NewFSRepoStore returns a store for repositories in dir
+func NewFSRepoStore(dir string, gitPath string) *FSRepoStore {
+	if gitPath == "" {
+		gitPath = "git"
+	}
+	return &FSRepoStore{Dir: dir, GitPath: gitPath}
+}
+
+func (s *FSRepoStore) Exists(name string) bool {
+	return repoDirExists(s.Path(name))
+}
+
+func (s *FSRepoStore) Path(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(cleanRepoName(name)))
+}
+
+func (s *FSRepoStore) Create(name string) error {
+	return s.init(s.Path(name))
+}
+
+// init creates an empty bare repository at path
+func (s *FSRepoStore) init(path string) error {
+	args := []string{"init", "--bare", "--initial-branch=main"}
+	// A HEAD in the template takes precedence over the initial branch
+	if s.TemplateDir != "" {
+		args = append(args, "--template="+s.TemplateDir)
+	}
+	return exec.Command(s.GitPath, append(args, path)...).Run()
+}
+
+func (s *FSRepoStore) Delete(name string) error {
+	return os.RemoveAll(s.Path(name))
+}
+
+func (s *FSRepoStore) List() ([]string, error) {
+	names := []string{}
+
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && strings.HasSuffix(d.Name(), ".git") {
+			if repoDirExists(p) {
+				name, err := filepath.Rel(s.Dir, p)
+				if err != nil {
+					return err
+				}
+				names = append(names, filepath.ToSlash(name))
+			}
+			return fs.SkipDir
+		}
+		return nil
+	}
+
+	if err := filepath.WalkDir(s.Dir, walk); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// repoStore returns the configured store or the filesystem store for Dir
+func (c *Config) repoStore() RepoStore {
+	if c.Store != nil {
+		return c.Store
+	}
+	store := NewFSRepoStore(c.Dir, c.GitPath)
+	store.TemplateDir = c.TemplateDir
+	return store
+}
+
+// checkTemplateDir returns an error if TemplateDir is set but not a directory,
+// git init silently ignores missing templates
+func (c *Config) checkTemplateDir() error {
+	if c.TemplateDir == "" {
+		return nil
+	}
+
+	info, err := os.Stat(c.TemplateDir)
+	if err != nil {
+		return fmt.Errorf("invalid template dir: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid template dir: %s is not a directory", c.TemplateDir)
+	}
+	return nil
+}
+
+// checkRepoPath returns ErrPathEscape if the path of the named repository
+// resolves outside of the real path of Dir. Custom stores are not checked.
+func (c *Config) checkRepoPath(name string) error {
+	if c.Store != nil {
+		return nil
+	}
+
+	root, err := realPath(c.Dir)
+	if err != nil {
+		return err
+	}
+	repoPath, err := realPath(c.repoStore().Path(name))
+	if err == ErrPathEscape {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, repoPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s: %w", name, ErrPathEscape)
+	}
+	return nil
+}
+
+// realPath returns the absolute path with all symlinks resolved. Missing
+// trailing components, e.g. of a repo yet to be created, are kept as is.
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// Symlinks pointing nowhere are followed when the repo is created
+		if _, err := os.Lstat(path); err == nil {
+			return "", ErrPathEscape
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, missing), nil
+		}
+		missing = filepath.Join(filepath.Base(path), missing)
+		path = parent
+	}
+}
+
+// resolvedRepoStore keeps a single repository at a path chosen by
+// SSH.RepoResolverFunc and passes all other names to the configured store
+type resolvedRepoStore struct {
+	RepoStore
+	name string
+	path string
+	fs   *FSRepoStore
+}
+
+func (s *resolvedRepoStore) resolves(name string) bool {
+	return cleanRepoName(name) == s.name
+}
+
+func (s *resolvedRepoStore) Exists(name string) bool {
+	if s.resolves(name) {
+		return repoDirExists(s.path)
+	}
+	return s.RepoStore.Exists(name)
+}
+
+func (s *resolvedRepoStore) Path(name string) string {
+	if s.resolves(name) {
+		return s.path
+	}
+	return s.RepoStore.Path(name)
+}
+
+func (s *resolvedRepoStore) Create(name string) error {
+	if s.resolves(name) {
+		return s.fs.init(s.path)
+	}
+	return s.RepoStore.Create(name)
+}
+
+func (s *resolvedRepoStore) Delete(name string) error {
+	if s.resolves(name) {
+		return os.RemoveAll(s.path)
+	}
+	return s.RepoStore.Delete(name)
+}
+
+// withRepoPath returns a copy of the config whose store keeps the named
+// repository at path
+func (c *Config) withRepoPath(name string, path string) (*Config, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("path %q of repo %s is not absolute", path, name)
+	}
+
+	fs := NewFSRepoStore(filepath.Dir(path), c.GitPath)
+	fs.TemplateDir = c.TemplateDir
+
+	resolved := *c
+	resolved.Store = &resolvedRepoStore{RepoStore: c.repoStore(), name: cleanRepoName(name), path: filepath.Clean(path), fs: fs}
+	return &resolved, nil
+}
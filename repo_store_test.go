@@ -0,0 +1,119 @@
+package gitkit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSRepoStore(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	store := NewFSRepoStore(dir, "")
+
+	assert.Equal(t, filepath.Join(dir, "foo.git"), store.Path("foo"))
+	assert.Equal(t, filepath.Join(dir, "org", "foo.git"), store.Path("org/foo.git"))
+	assert.Equal(t, filepath.Join(dir, "foo.git"), store.Path("../foo"))
+
+	assert.False(t, store.Exists("foo"))
+	assert.NoError(t, store.Create("foo"))
+	assert.NoError(t, store.Create("org/bar.git"))
+	assert.True(t, store.Exists("foo.git"))
+
+	names, err := store.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo.git", "org/bar.git"}, names)
+
+	assert.NoError(t, store.Delete("foo"))
+	assert.False(t, store.Exists("foo"))
+}
+
+func TestConfig_checkRepoPath(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "repos")
+	outside := filepath.Join(dir, "outside")
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "org"), 0755))
+	assert.NoError(t, os.MkdirAll(outside, 0755))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "evil")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "linked.git")))
+	assert.NoError(t, os.Symlink(filepath.Join(outside, "missing.git"), filepath.Join(root, "dangling.git")))
+	assert.NoError(t, os.Symlink(filepath.Join(root, "org"), filepath.Join(root, "alias")))
+	assert.NoError(t, os.Symlink(root, filepath.Join(dir, "root-link")))
+
+	config := &Config{Dir: root}
+	for name, escapes := range map[string]bool{
+		"app.git":          false,
+		"org/app.git":      false,
+		"new/nested.git":   false,
+		"alias/app.git":    false,
+		"evil/app.git":     true,
+		"linked.git":       true,
+		"dangling.git":     true,
+		"evil/new/app.git": true,
+	} {
+		err := config.checkRepoPath(name)
+		assert.Equal(t, escapes, errors.Is(err, ErrPathEscape), name)
+		if !escapes {
+			assert.NoError(t, err, name)
+		}
+	}
+
+	// The root itself may be a symlink
+	config = &Config{Dir: filepath.Join(dir, "root-link")}
+	assert.NoError(t, config.checkRepoPath("app.git"))
+	assert.True(t, errors.Is(config.checkRepoPath("evil/app.git"), ErrPathEscape))
+}
+
+func TestInitRepo_TemplateDir(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	templateDir := filepath.Join(dir, "template")
+	assert.NoError(t, os.MkdirAll(filepath.Join(templateDir, "info"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(templateDir, "HEAD"), []byte("ref: refs/heads/trunk\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(templateDir, "info", "exclude"), []byte("*.log\n"), 0644))
+
+	config := &Config{Dir: filepath.Join(dir, "repos"), GitPath: "git", TemplateDir: templateDir}
+	assert.NoError(t, InitRepo("app", config))
+
+	head, err := os.ReadFile(filepath.Join(config.repoStore().Path("app"), "HEAD"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ref: refs/heads/trunk\n", string(head))
+
+	exclude, err := os.ReadFile(filepath.Join(config.repoStore().Path("app"), "info", "exclude"))
+	assert.NoError(t, err)
+	assert.Equal(t, "*.log\n", string(exclude))
+
+	config.TemplateDir = filepath.Join(dir, "missing")
+	assert.Error(t, InitRepo("other", config))
+	assert.Error(t, config.Setup())
+	assert.False(t, config.repoStore().Exists("other"))
+}
+
+func TestConfig_withRepoPath(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	config := &Config{Dir: filepath.Join(dir, "repos"), GitPath: "git"}
+
+	_, err := config.withRepoPath("app.git", "disk1/app.git")
+	assert.EqualError(t, err, `path "disk1/app.git" of repo app.git is not absolute`)
+
+	resolved, err := config.withRepoPath("app", filepath.Join(dir, "disk1", "alice", "app"))
+	assert.NoError(t, err)
+	assert.NoError(t, InitRepo("app.git", resolved))
+	assert.NoError(t, InitRepo("other", resolved))
+
+	assert.True(t, RepoExists(filepath.Join(dir, "disk1", "alice", "app")))
+	assert.Equal(t, filepath.Join(dir, "disk1", "alice", "app"), resolved.repoStore().Path("app"))
+	assert.True(t, resolved.repoStore().Exists("app"))
+	assert.False(t, config.repoStore().Exists("app"))
+
+	// Other repos stay in Dir
+	assert.True(t, config.repoStore().Exists("other"))
+	assert.Nil(t, config.Store)
+}
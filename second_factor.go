@@ -0,0 +1,86 @@
+package gitkit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Asked for with keyboard-interactive before the key is accepted
+const secondFactorPrompt = "One-time code: "
+
+// Sent to clients pushing without a valid code
+const secondFactorMessage = "Second factor required. Push with GIT_SSH_COMMAND=\"ssh -o PreferredAuthentications=keyboard-interactive,publickey\" and enter a valid one-time code.\r\n"
+
+var (
+	errNoSecondFactor = errors.New("no one-time code")
+	errSecondFactor   = errors.New("invalid one-time code")
+)
+
+// secondFactor asks for the one-time code with keyboard-interactive auth and
+// then requires the key, whose permissions are marked as verified if
+// SecondFactor accepts the code for it. Clients that authenticate with the
+// key alone are never asked, their pushes are refused in handleExec.
+func (s *SSH) secondFactor(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge, publicKey func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error)) (*ssh.Permissions, error) {
+	client := lockoutKey(conn.RemoteAddr())
+	if s.lockout.locked(client) {
+		return nil, fmt.Errorf("too many failed attempts from %s", client)
+	}
+
+	answers, err := challenge("", "", []string{secondFactorPrompt}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 || strings.TrimSpace(answers[0]) == "" {
+		return nil, errNoSecondFactor
+	}
+	code := strings.TrimSpace(answers[0])
+
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				perms, err := publicKey(conn, key)
+				if err != nil {
+					return nil, err
+				}
+				return s.checkSecondFactor(conn, perms, code)
+			},
+		},
+	}
+}
+
+// checkSecondFactor returns the permissions marked as verified if
+// SecondFactor accepts the code for the key
+func (s *SSH) checkSecondFactor(conn ssh.ConnMetadata, perms *ssh.Permissions, code string) (*ssh.Permissions, error) {
+	keyID := perms.Extensions["key-id"]
+	ok, err := s.config.SecondFactor(keyID, code)
+	if err != nil {
+		s.logger().Errorf("ssh: second factor check failed: %v", err)
+		return nil, err
+	}
+	if !ok {
+		s.logger().Infof("ssh: key with ID '%s' failed the second factor", keyID)
+		s.lockout.fail(lockoutKey(conn.RemoteAddr()))
+		return nil, errSecondFactor
+	}
+
+	verified := &ssh.Permissions{
+		CriticalOptions: perms.CriticalOptions,
+		Extensions:      map[string]string{"second-factor": "verified"},
+	}
+	for name, value := range perms.Extensions {
+		verified.Extensions[name] = value
+	}
+	return verified, nil
+}
+
+// secondFactorPassed reports if pushes of the connection are allowed by the
+// second factor, or SecondFactor is not set
+func (s *SSH) secondFactorPassed(perms *ssh.Permissions) bool {
+	if s.config.SecondFactor == nil {
+		return true
+	}
+	return perms != nil && perms.Extensions["second-factor"] == "verified"
+}
@@ -0,0 +1,120 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_SecondFactor(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	assert.NoError(t, err)
+
+	var codes []string
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true})
+	s.config.SecondFactor = func(keyID string, code string) (bool, error) {
+		codes = append(codes, code)
+		return keyID == "alice" && code == "123456", nil
+	}
+	s.PublicKeyLookupFunc = func(content string) (*PublicKey, error) {
+		return &PublicKey{Id: "alice"}, nil
+	}
+	s.LFSAuthenticateFunc = func(keyID, repo, operation string) (string, error) {
+		return "{}", nil
+	}
+	assert.NoError(t, InitRepo("app", s.config))
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	prompts := 0
+	dial := func(auth ...ssh.AuthMethod) (*ssh.Client, error) {
+		return ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            auth,
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	}
+	code := func(code string) ssh.AuthMethod {
+		return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			prompts++
+			assert.Equal(t, []string{secondFactorPrompt}, questions)
+			return []string{code}, nil
+		})
+	}
+	run := func(conn *ssh.Client, command string) (string, string) {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+		defer session.Close()
+
+		stderr, err := session.StderrPipe()
+		assert.NoError(t, err)
+		session.Stdin = strings.NewReader("0000")
+		out, _ := session.Output(command)
+		errOut, _ := ioutil.ReadAll(stderr)
+		return string(out), string(errOut)
+	}
+
+	// The key alone allows fetches without a prompt, pushes are refused
+	conn, err := dial(ssh.PublicKeys(signer))
+	assert.NoError(t, err)
+	out, _ := run(conn, "git-upload-pack 'app.git'")
+	assert.NotEmpty(t, out)
+	out, errOut := run(conn, "git-receive-pack 'app.git'")
+	assert.Empty(t, out)
+	assert.Equal(t, secondFactorMessage, errOut)
+	out, errOut = run(conn, "git-lfs-authenticate 'app.git' upload")
+	assert.Empty(t, out)
+	assert.Equal(t, secondFactorMessage, errOut)
+	conn.Close()
+	assert.Equal(t, 0, prompts)
+
+	// A wrong code fails authentication
+	_, err = dial(code("000000"), ssh.PublicKeys(signer))
+	assert.Error(t, err)
+
+	// Skipping the code falls back to the key alone
+	conn, err = dial(code(""), ssh.PublicKeys(signer))
+	assert.NoError(t, err)
+	_, errOut = run(conn, "git-receive-pack 'app.git'")
+	assert.Equal(t, secondFactorMessage, errOut)
+	conn.Close()
+
+	conn, err = dial(code("123456"), ssh.PublicKeys(signer))
+	assert.NoError(t, err)
+	out, _ = run(conn, "git-receive-pack 'app.git'")
+	assert.Contains(t, out, "report-status")
+	out, _ = run(conn, "git-lfs-authenticate 'app.git' upload")
+	assert.Equal(t, "{}", out)
+	conn.Close()
+	assert.Equal(t, 3, prompts)
+	assert.Equal(t, []string{"000000", "123456"}, codes)
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	// Non-interactive clones are never asked for the code
+	identity := filepath.Join(dir, "id_ed25519")
+	assert.NoError(t, storeKey(identity, priv, pub, KeyFormatOpenSSH))
+	_, port, _ := net.SplitHostPort(s.Address())
+	cmd := exec.Command("git", "clone", "-q", "ssh://git@127.0.0.1/app.git", filepath.Join(dir, "clone"))
+	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -o IdentitiesOnly=yes -i "+identity+" -p "+port)
+	output, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(output))
+	assert.Equal(t, []string{"000000", "123456"}, codes)
+}
@@ -1,26 +1,49 @@
 package gitkit
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// KeyIDEnv is the environment variable git and its hooks get the ID of the
+// authenticated key in, or the username of HTTP pushes
+const KeyIDEnv = "GITKIT_KEY"
+
+// OriginalCommandEnv is the environment variable SSH gateways pass the
+// client's command in, see Config.AcceptOriginalCommand
+const OriginalCommandEnv = "SSH_ORIGINAL_COMMAND"
+
+// GitProtocolEnv is the environment variable clients request a protocol
+// version in, e.g. version=2
+const GitProtocolEnv = "GIT_PROTOCOL"
+
+// Values of GIT_PROTOCOL passed on to git, colon separated keys and values
+var reGitProtocol = regexp.MustCompile(`^[a-zA-Z0-9.=:-]+$`)
+
 var (
 	ErrAlreadyStarted = errors.New("server has already been started")
 	ErrNoListener     = errors.New("cannot call Serve() before Listen()")
@@ -31,15 +54,201 @@ type PublicKey struct {
 	Name        string
 	Fingerprint string
 	Content     string
+	Tenant      string // Customer the key belongs to, sessions share the quota in Config.TenantLimits
+
+	// Optional restrictions of the key, checked in addition to Authorize.
+	// Repos are matched with path.Match and the .git suffix may be left out,
+	// ops are git commands, e.g. upload-pack or receive-pack.
+	AllowedRepos []string
+	AllowedOps   []string
+
+	// Runs this command instead of the one sent by the client, locking deploy
+	// keys to a single repo and operation, e.g. {Command: "git-upload-pack", Repo: "app"}
+	ForcedCommand *GitCommand
+
+	// IPs or CIDRs the key may connect from, e.g. 10.0.0.0/8, enforced like
+	// the source-address option of certificates
+	AllowedSources []string
+}
+
+// permissions returns the SSH permissions carrying the key's ID and restrictions
+func (k *PublicKey) permissions() *ssh.Permissions {
+	ext := map[string]string{"key-id": k.Id}
+	if k.Tenant != "" {
+		ext["tenant"] = k.Tenant
+	}
+	if k.AllowedRepos != nil {
+		ext["allowed-repos"] = strings.Join(k.AllowedRepos, "\n")
+	}
+	if k.AllowedOps != nil {
+		ext["allowed-ops"] = strings.Join(k.AllowedOps, "\n")
+	}
+	if k.ForcedCommand != nil {
+		ext["forced-command"] = k.ForcedCommand.String()
+	}
+	perms := &ssh.Permissions{Extensions: ext}
+	if k.AllowedSources != nil {
+		perms.CriticalOptions = map[string]string{"source-address": strings.Join(k.AllowedSources, ",")}
+	}
+	return perms
+}
+
+// NormalizeAuthorizedKey converts a public key in authorized_keys format, with
+// optional options and comment, to the "<type> <base64>" form passed to
+// PublicKeyLookupFunc, e.g. "ssh-ed25519 AAAAC3Nza...". Use it on stored keys
+// so that they match regardless of comments.
+func NormalizeAuthorizedKey(content string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(content))
+	if err != nil {
+		return "", err
+	}
+	return authorizedKeyString(key), nil
+}
+
+// ParsePublicKey parses a line of an authorized_keys file into a PublicKey
+// with the normalized Content matched against by PublicKeyLookupFunc, the
+// SHA256 Fingerprint and the comment as Name. Id is left for the caller to set.
+// The command="..." option becomes ForcedCommand and must be a git command,
+// from="..." becomes AllowedSources and may only list IPs and CIDRs. Lines
+// with other options, e.g. restrict or environment, are refused as gitkit
+// can not enforce them.
+func ParsePublicKey(line string) (*PublicKey, error) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
+
+	pkey := &PublicKey{
+		Name:        comment,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Content:     authorizedKeyString(key),
+	}
+	for _, option := range options {
+		if err := pkey.applyOption(option); err != nil {
+			return nil, err
+		}
+	}
+	return pkey, nil
+}
+
+// applyOption sets the restriction of an authorized_keys option on the key
+func (k *PublicKey) applyOption(option string) error {
+	name, value := option, ""
+	if i := strings.IndexByte(option, '='); i >= 0 {
+		name, value = option[:i], option[i+1:]
+		if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+			return fmt.Errorf("invalid key option %q", option)
+		}
+		value = strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+	}
+
+	switch strings.ToLower(name) {
+	case "command":
+		if k.ForcedCommand != nil {
+			return fmt.Errorf("duplicate key option %q", name)
+		}
+		cmd, err := ParseGitCommand(value)
+		if err != nil {
+			return fmt.Errorf("cant use key command %q: %v", value, err)
+		}
+		k.ForcedCommand = cmd
+	case "from":
+		if k.AllowedSources != nil {
+			return fmt.Errorf("duplicate key option %q", name)
+		}
+		for _, source := range strings.Split(value, ",") {
+			if net.ParseIP(source) == nil {
+				if _, _, err := net.ParseCIDR(source); err != nil {
+					return fmt.Errorf("cant use key source %q, only IPs and CIDRs are supported", source)
+				}
+			}
+			k.AllowedSources = append(k.AllowedSources, source)
+		}
+	default:
+		return fmt.Errorf("unsupported key option %q", name)
+	}
+	return nil
+}
+
+func authorizedKeyString(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// keyAllows checks the command against the key restrictions of the connection
+func keyAllows(perms *ssh.Permissions, gitcmd *GitCommand) bool {
+	if perms == nil {
+		return true
+	}
+
+	if ops, ok := perms.Extensions["allowed-ops"]; ok {
+		if !matchAny(strings.Split(ops, "\n"), gitcmd.Verb(), gitcmd.Command) {
+			return false
+		}
+	}
+
+	if repos, ok := perms.Extensions["allowed-repos"]; ok {
+		repo := strings.TrimSuffix(gitcmd.Repo, ".git")
+		allowed := false
+		for _, pattern := range strings.Split(repos, "\n") {
+			if matched, _ := path.Match(strings.TrimSuffix(pattern, ".git"), repo); matched {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAny(list []string, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type SSH struct {
 	listener net.Listener
 
-	sshconfig           *ssh.ServerConfig
 	config              *Config
-	PublicKeyLookupFunc func(string) (*PublicKey, error)
+	PublicKeyLookupFunc func(string) (*PublicKey, error) // Called with the key in NormalizeAuthorizedKey format
 	Authorize           func(string, string) (bool, error)
+	PostReceiveFunc     func(*Push) error
+	Logger              Logger // Overrides Config.Logger
+
+	// Repo access check that is passed the operation, e.g. to grant read-only
+	// access with AccessRead. Called instead of Authorize if set.
+	AuthorizeAccess func(keyID, repo string, op AccessType) (bool, error)
+
+	// Returns the JSON response to git-lfs-authenticate with the href and
+	// header of the LFS API, e.g. {"href": "...", "header": {...}, "expires_at": "..."}.
+	// Called for keys allowed to fetch from the repo, or to push for uploads.
+	LFSAuthenticateFunc func(keyID, repo, operation string) (string, error)
+
+	// Returns the absolute path of the repo, e.g. to shard repos across disks.
+	// Repos are kept in Config.Dir or Config.Store if not set.
+	RepoResolverFunc func(keyID, repo string) (string, error)
+
+	// Server config and host keys, replaced by Reload
+	keysMu       sync.RWMutex
+	sshconfig    *ssh.ServerConfig
+	hostKeys     []ssh.Signer
+	nextHostKeys []ssh.Signer // Announced to clients while keys are rotated
+	rotating     int32
+
+	stats    stats
+	lockout  *authLockout
+	pushes   *receiveLimiter
+	tenants  tenants
+	conns    connTracker
+	draining int32
 }
 
 func NewSSH(config Config) *SSH {
@@ -82,157 +291,632 @@ func execCommand(cmdname string, args ...string) (string, string, error) {
 	return string(bufOut), string(bufErr), err
 }
 
-func (s *SSH) handleConnection(keyID string, chans <-chan ssh.NewChannel) {
+func (s *SSH) handleConnection(conn *ssh.ServerConn, chans <-chan ssh.NewChannel) {
+	keyID := ""
+	if conn.Permissions != nil {
+		keyID = conn.Permissions.Extensions["key-id"]
+	}
+
+	maxChannels := s.config.maxChannelsPerConnection()
+	openChannels := int32(0)
+
 	for newChan := range chans {
 		if newChan.ChannelType() != "session" {
 			newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
 
+		if maxChannels > 0 && atomic.LoadInt32(&openChannels) >= int32(maxChannels) {
+			s.logger().Infof("ssh: too many channels from %s", conn.RemoteAddr())
+			newChan.Reject(ssh.ResourceShortage, "too many open sessions")
+			continue
+		}
+
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
-			log.Printf("error accepting channel: %v", err)
+			s.logger().Errorf("error accepting channel: %v", err)
 			continue
 		}
+		atomic.AddInt32(&openChannels, 1)
+		s.conns.wg.Add(1)
 
 		go func(in <-chan *ssh.Request) {
+			defer s.conns.wg.Done()
+			defer atomic.AddInt32(&openChannels, -1)
 			defer ch.Close()
 
-			for req := range in {
-				payload := cleanCommand(string(req.Payload))
+			// Variables sent by the client, e.g. with ssh -o SetEnv=NAME=value
+			env := map[string]string{}
 
+			for req := range in {
 				switch req.Type {
 				case "env":
-					log.Printf("ssh: incoming env request: %s\n", payload)
-
-					args := strings.Split(strings.Replace(payload, "\x00", "", -1), "\v")
-					if len(args) != 2 {
-						log.Printf("env: invalid env arguments: '%#v'", args)
-						continue
+					var msg struct {
+						Name  string
+						Value string
 					}
-
-					args[0] = strings.TrimLeft(args[0], "\x04")
-					if len(args[0]) == 0 {
-						log.Printf("env: invalid key from payload: %s", payload)
+					if err := ssh.Unmarshal(req.Payload, &msg); err != nil || msg.Name == "" {
+						s.logger().Infof("env: invalid env request: %q", s.config.redact(string(req.Payload)))
+						req.Reply(false, nil)
 						continue
 					}
 
-					_, _, err := execCommandBytes("env", args[0]+"="+args[1])
-					if err != nil {
-						log.Printf("env: %v", err)
+					s.logInfo("ssh: incoming env request: %s", s.config.redact(msg.Name))
+					env[msg.Name] = msg.Value
+					req.Reply(true, nil)
+				case "exec":
+					command := cleanCommand(string(req.Payload))
+					if s.config.AcceptOriginalCommand && strings.Trim(string(req.Payload), "\x00") == "" {
+						command = env[OriginalCommandEnv]
+					}
+					s.runSession(conn, keyID, env, ch, req, command)
+					return
+				case "shell":
+					if s.config.AcceptOriginalCommand && env[OriginalCommandEnv] != "" {
+						s.runSession(conn, keyID, env, ch, req, env[OriginalCommandEnv])
 						return
 					}
-				case "exec":
-					log.Printf("ssh: incoming exec request: %s\n", payload)
+					ch.Write([]byte("Unsupported request type.\r\n"))
+					s.logger().Debugf("ssh: unsupported req type: %s", req.Type)
+					return
+				default:
+					ch.Write([]byte("Unsupported request type.\r\n"))
+					s.logger().Debugf("ssh: unsupported req type: %s", req.Type)
+					return
+				}
+			}
+		}(reqs)
+	}
+}
 
-					cmdName := strings.TrimLeft(payload, "'()")
-					log.Printf("ssh: payload '%v'", cmdName)
+// gitProtocol returns the GIT_PROTOCOL value sent by the client for git. Pinned
+// repos are served with protocol v0, which only allows wants of advertised refs.
+func gitProtocol(env map[string]string, pinned string) string {
+	protocol := env[GitProtocolEnv]
+	if pinned != "" || !reGitProtocol.MatchString(protocol) {
+		return ""
+	}
+	return protocol
+}
 
-					if strings.HasPrefix(cmdName, "\x00") {
-						cmdName = strings.Replace(cmdName, "\x00", "", -1)[1:]
-					}
+// runSession runs the command of a session unless the server is shutting down or busy
+func (s *SSH) runSession(conn *ssh.ServerConn, keyID string, env map[string]string, ch ssh.Channel, req *ssh.Request, payload string) {
+	done, err := s.startSession()
+	switch err {
+	case errShuttingDown:
+		ch.Stderr().Write([]byte("Server is shutting down, please try again later.\r\n"))
+		return
+	case errServerBusy:
+		s.logger().Infof("ssh: rejecting session of %s, %d sessions are open", conn.RemoteAddr(), s.config.MaxOpenSessions)
+		ch.Stderr().Write([]byte("Server is busy, please try again later.\r\n"))
+		return
+	}
+	defer done()
 
-					gitcmd, err := ParseGitCommand(cmdName)
-					if err != nil {
-						log.Println("ssh: error parsing command:", err)
-						ch.Write([]byte("Invalid command.\r\n"))
-						return
-					}
+	s.handleExec(conn, keyID, env, ch, req, payload)
+}
 
-					if s.Authorize != nil {
-						authorized, err := s.Authorize(keyID, strings.TrimSuffix(gitcmd.Repo, ".git"))
-						if err != nil {
-							log.Printf("ssh: Authorization failed: %s", err)
-							return
-						}
-						if !authorized {
-							log.Printf("ssh: key with ID '%s' not authorized for repo '%s'", keyID, gitcmd.Repo)
-							return
-						}
-					}
+func (s *SSH) handleExec(conn *ssh.ServerConn, keyID string, env map[string]string, ch ssh.Channel, req *ssh.Request, payload string) {
+	s.logInfo("ssh: incoming exec request: %s", s.config.redact(payload))
 
-					if !RepoExists(filepath.Join(s.config.Dir, gitcmd.Repo)) && s.config.AutoCreate == true {
-						err := InitRepo(gitcmd.Repo, s.config)
-						if err != nil {
-							logError("repo-init", err)
-							return
-						}
-					}
+	cmdName := strings.TrimLeft(payload, "'()")
+	s.logInfo("ssh: payload '%v'", s.config.redact(cmdName))
 
-					cmd := exec.Command(gitcmd.Command, gitcmd.Repo)
-					cmd.Dir = s.config.Dir
-					cmd.Env = append(os.Environ(), "GITKIT_KEY="+keyID)
-					// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
+	if strings.HasPrefix(cmdName, "\x00") {
+		cmdName = strings.Replace(cmdName, "\x00", "", -1)
+		if cmdName != "" {
+			cmdName = cmdName[1:]
+		}
+	}
 
-					stdout, err := cmd.StdoutPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stdout pipe: %v", err)
-						return
-					}
+	parse := ParseGitCommand
+	if s.config.StrictCommandForm {
+		parse = ParseGitCommandStrict
+	}
 
-					stderr, err := cmd.StderrPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stderr pipe: %v", err)
-						return
-					}
+	if conn.Permissions != nil && conn.Permissions.Extensions["forced-command"] != "" {
+		cmdName = conn.Permissions.Extensions["forced-command"]
+		parse = ParseGitCommand
+		s.logInfo("ssh: running forced command of key with ID '%s': %s", keyID, s.config.redact(cmdName))
+	}
 
-					input, err := cmd.StdinPipe()
-					if err != nil {
-						log.Printf("ssh: cant open stdin pipe: %v", err)
-						return
-					}
+	start := time.Now()
+	gitcmd, err := parse(cmdName)
+	if err != nil {
+		if lfscmd, operation, ok := parseLFSCommand(cmdName); ok && s.LFSAuthenticateFunc != nil {
+			s.handleLFSAuthenticate(conn, keyID, ch, req, lfscmd, operation)
+			return
+		}
+		if fields := strings.Fields(cmdName); len(fields) > 0 && s.config.CustomCommands[fields[0]] != nil {
+			s.handleCustomCommand(keyID, ch, req, fields)
+			return
+		}
 
-					if err = cmd.Start(); err != nil {
-						log.Printf("ssh: start error: %v", err)
-						return
-					}
+		s.logger().Errorf("ssh: error parsing command: %s", s.config.redact(err.Error()))
+		message := "Invalid command."
+		if cmdErr, ok := err.(*CommandError); ok {
+			message = cmdErr.Message()
+		}
+		ch.Write([]byte(message + "\r\n"))
+		return
+	}
 
-					req.Reply(true, nil)
-					go io.Copy(input, ch)
-					io.Copy(ch, stdout)
-					io.Copy(ch.Stderr(), stderr)
+	outcome := OutcomeRejected
+	defer func() {
+		s.config.operationDone(gitcmd, keyID, start, outcome)
+	}()
 
-					if err = cmd.Wait(); err != nil {
-						log.Printf("ssh: command failed: %v", err)
-						return
-					}
+	if err := s.authorize(conn.Permissions, keyID, gitcmd); err != nil {
+		switch err {
+		case errKeyRestricted:
+			s.logger().Infof("ssh: key with ID '%s' is restricted from %s on repo '%s'", keyID, gitcmd.Verb(), gitcmd.Repo)
+			ch.Stderr().Write([]byte("Access denied. The key is not allowed to run this command.\r\n"))
+		case errNotAuthorized:
+			s.logger().Infof("ssh: key with ID '%s' not authorized for repo '%s'", keyID, gitcmd.Repo)
+		default:
+			s.logger().Errorf("ssh: Authorization failed: %s", err)
+		}
+		outcome = OutcomeAuthDenied
+		return
+	}
 
-					ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
-					return
-				default:
-					ch.Write([]byte("Unsupported request type.\r\n"))
-					log.Println("ssh: unsupported req type:", req.Type)
-					return
+	// The command is unknown during auth, so only pushes need the code
+	if gitcmd.IsReceivePack() && !s.secondFactorPassed(conn.Permissions) {
+		s.logger().Infof("ssh: key with ID '%s' pushed to repo '%s' without second factor", keyID, gitcmd.Repo)
+		ch.Stderr().Write([]byte(secondFactorMessage))
+		outcome = OutcomeAuthDenied
+		return
+	}
+
+	if gitcmd.IsReceivePack() && !s.pushes.allow(keyID, lockoutKey(conn.RemoteAddr())) {
+		s.logger().Infof("ssh: key with ID '%s' reached the push rate limit on repo '%s'", keyID, gitcmd.Repo)
+		ch.Stderr().Write([]byte("Too many pushes, please try again later.\r\n"))
+		return
+	}
+
+	var limiter *rateLimiter
+	if conn.Permissions != nil {
+		tenant := conn.Permissions.Extensions["tenant"]
+		if limit, ok := s.config.TenantLimits[tenant]; ok && tenant != "" {
+			release, tenantLimiter, ok := s.tenants.acquire(tenant, limit)
+			if !ok {
+				s.logger().Infof("ssh: tenant '%s' reached its session limit", tenant)
+				ch.Stderr().Write([]byte("Too many concurrent sessions, please try again later.\r\n"))
+				return
+			}
+			defer release()
+			limiter = tenantLimiter
+		}
+	}
+
+	var pinned string
+	if !gitcmd.IsReceivePack() {
+		pinned, err = s.config.pinnedRef(gitcmd.Repo)
+		if err != nil {
+			s.logger().Errorf("ssh: cant pin repo '%s': %v", gitcmd.Repo, err)
+			ch.Stderr().Write([]byte("Repository not available.\r\n"))
+			s.onError(gitcmd.Repo, err)
+			return
+		}
+		if pinned != "" && gitcmd.Verb() == "upload-archive" {
+			s.logger().Infof("ssh: repo '%s' is pinned to %s, refusing upload-archive", gitcmd.Repo, pinned)
+			ch.Stderr().Write([]byte("Archives are not available for this repository.\r\n"))
+			return
+		}
+	}
+
+	var policy UploadPolicy
+	if gitcmd.Verb() == "upload-pack" {
+		policy, err = s.config.uploadPolicy(gitcmd.Repo, conn.RemoteAddr())
+		if err != nil {
+			s.logger().Errorf("ssh: cant get upload policy of repo '%s': %v", gitcmd.Repo, err)
+			ch.Stderr().Write([]byte("Repository not available.\r\n"))
+			s.onError(gitcmd.Repo, err)
+			return
+		}
+		if policy.Deny {
+			s.logger().Infof("ssh: upload policy denies fetch of repo '%s'", gitcmd.Repo)
+			ch.Stderr().Write([]byte(policy.denyMessage() + "\r\n"))
+			return
+		}
+	}
+
+	// Backends do not enforce the pinned ref and the upload policy
+	if gitcmd.Verb() == "upload-pack" && s.config.UploadPackBackend != nil && pinned == "" && !policy.checksRequest() {
+		backend, err := s.config.UploadPackBackend(strings.TrimSuffix(gitcmd.Repo, ".git"), conn.RemoteAddr())
+		if err != nil {
+			s.logger().Errorf("ssh: cant select upload-pack backend: %v", err)
+		} else if backend != "" {
+			proxied, err := s.proxyCommand(backend, gitcmd, env, ch, req, limiter)
+			if proxied {
+				outcome = OutcomeSuccess
+				if err == context.DeadlineExceeded {
+					s.logger().Errorf("ssh: command %s timed out on %s for repo '%s'", gitcmd.Verb(), backend, gitcmd.Repo)
+					outcome = OutcomeTimeout
+				} else if err != nil {
+					s.logger().Errorf("ssh: proxy to %s failed: %v", backend, err)
+					outcome = OutcomeGitError
 				}
+				return
 			}
-		}(reqs)
+			s.logger().Errorf("ssh: backend %s unavailable, serving '%s' locally: %v", backend, gitcmd.Repo, err)
+		}
+	}
+
+	config, err := s.repoConfig(keyID, gitcmd.Repo)
+	if err != nil {
+		s.logger().Errorf("ssh: cant resolve path of repo '%s': %v", gitcmd.Repo, err)
+		ch.Stderr().Write([]byte("Repository not available.\r\n"))
+		s.onError(gitcmd.Repo, err)
+		return
+	}
+
+	if err := config.checkRepoPath(gitcmd.Repo); err != nil {
+		s.logger().Errorf("ssh: cant use repo '%s': %v", gitcmd.Repo, err)
+		ch.Stderr().Write([]byte("Repository not available.\r\n"))
+		s.onError(gitcmd.Repo, err)
+		return
+	}
+
+	store := config.repoStore()
+	repoPath := store.Path(gitcmd.Repo)
+
+	// Repos are only created by pushes, clones of mistyped names should fail
+	if !store.Exists(gitcmd.Repo) {
+		if !gitcmd.IsReceivePack() || !s.config.autoCreate(gitcmd.Repo) {
+			s.logger().Infof("ssh: repo '%s' does not exist", gitcmd.Repo)
+			ch.Stderr().Write([]byte("Repository not found.\r\n"))
+			return
+		}
+
+		_, err := ensureRepo(gitcmd.Repo, config, InitOptions{KeyID: keyID, Remote: conn.RemoteAddr().String(), Source: "ssh"})
+		if err != nil {
+			s.logger().Errorf("ssh: cant create repo '%s': %v", gitcmd.Repo, err)
+			if isDiskFull(err) {
+				err = fmt.Errorf("init: %w", ErrDiskFull)
+			}
+			s.onError(gitcmd.Repo, err)
+			outcome = OutcomeGitError
+			return
+		}
+	}
+
+	// Archive arguments are read before git runs, so the exec request is
+	// accepted early
+	var clientInput io.Reader = limiter.reader(ch)
+	replied := false
+	if gitcmd.Verb() == "upload-archive" && s.config.UploadArchivePolicy != nil {
+		req.Reply(true, nil)
+		replied = true
+
+		reader := bufio.NewReader(clientInput)
+		args, err := readArchiveArgs(reader)
+		if err != nil {
+			s.logger().Errorf("ssh: cant read archive arguments: %v", err)
+			return
+		}
+
+		args, err = s.config.UploadArchivePolicy(keyID, strings.TrimSuffix(gitcmd.Repo, ".git"), args)
+		if err != nil {
+			s.logger().Infof("ssh: archive of repo '%s' denied: %v", gitcmd.Repo, err)
+			writeArchiveNack(ch, err.Error())
+			sendExitStatus(ch, 1)
+			return
+		}
+		clientInput = io.MultiReader(bytes.NewReader(archiveArgsRequest(args)), reader)
+	}
+
+	var commands *pushCommands
+	if (s.PostReceiveFunc != nil || s.config.RefLogFunc != nil) && gitcmd.IsReceivePack() {
+		commands = &pushCommands{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout := s.config.commandTimeout(gitcmd.Verb()); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	dir, repoArg, err := s.config.resolveRepoDir(gitcmd.Repo, repoPath)
+	if err != nil {
+		s.logger().Errorf("ssh: cant resolve directory of repo '%s': %v", gitcmd.Repo, err)
+		ch.Stderr().Write([]byte("Repository not available.\r\n"))
+		s.onError(gitcmd.Repo, err)
+		return
+	}
+
+	args := s.config.commandArgs(gitcmd.Verb(), repoArg, pinned)
+
+	cmd := exec.CommandContext(ctx, s.config.GitPath, args...)
+	cmd.Dir = dir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(s.config.commandEnv(), KeyIDEnv+"="+keyID)
+	if protocol := gitProtocol(env, pinned); protocol != "" {
+		cmd.Env = append(cmd.Env, GitProtocolEnv+"="+protocol)
+	}
+	// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
+
+	// Failures from here on are failures to run git
+	outcome = OutcomeGitError
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.logger().Errorf("ssh: cant open stdout pipe: %v", err)
+		return
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		s.logger().Errorf("ssh: cant open stderr pipe: %v", err)
+		return
+	}
+
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		s.logger().Errorf("ssh: cant open stdin pipe: %v", err)
+		return
+	}
+
+	if err = cmd.Start(); err != nil {
+		s.logger().Errorf("ssh: start error: %v", err)
+		return
+	}
+
+	done := s.stats.commandStarted(gitcmd.Repo, gitcmd.Verb())
+	defer done()
+
+	// Hooks and pack-objects may hold the output pipes open, so the whole
+	// process group is terminated once the timeout is reached or the
+	// connection is closed at the end of a shutdown.
+	closing := s.conns.closing()
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() != context.DeadlineExceeded {
+				return
+			}
+		case <-closing:
+		}
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}()
+
+	var inspection *packInspection
+	if gitcmd.IsReceivePack() {
+		inspection = s.config.packInspection(gitcmd.Repo)
+	}
+
+	if !replied {
+		req.Reply(true, nil)
+	}
+	go func() {
+		defer input.Close()
+
+		limitRefs := gitcmd.IsReceivePack() && s.config.MaxRefsPerPush > 0
+		checkFetch := gitcmd.Verb() == "upload-pack" && policy.checksRequest()
+		if (s.config.OnNegotiation == nil && !limitRefs && !checkFetch && inspection == nil && commands == nil) || !gitcmd.IsPack() {
+			copyBuffer(input, clientInput, s.config.CopyBufferSize)
+			return
+		}
+
+		maxRefs := 0
+		if limitRefs {
+			maxRefs = s.config.MaxRefsPerPush
+		}
+		err := copyClientInput(input, clientInput, s.config.CopyBufferSize, maxRefs, func(r *clientRequest) error {
+			if s.config.OnNegotiation != nil {
+				s.config.OnNegotiation(gitcmd.Repo, r.Caps)
+			}
+			if checkFetch {
+				if err := policy.checkRequest(r); err != nil {
+					ch.Stderr().Write([]byte("Fetch rejected: " + err.Error() + ".\r\n"))
+					return err
+				}
+			}
+			if !gitcmd.IsReceivePack() {
+				return nil
+			}
+			commands.record(r)
+			if err := s.config.checkRefUpdates(r); err != nil {
+				ch.Stderr().Write([]byte("Push rejected: " + err.Error() + ".\r\n"))
+				return err
+			}
+			return nil
+		}, inspection.wrapper())
+		if rejected := inspection.err(); rejected != nil {
+			// Git must not unpack a truncated pack, it removes the quarantined
+			// objects when terminated.
+			ch.Stderr().Write([]byte("Push rejected: " + rejected.Error() + ".\r\n"))
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+			return
+		}
+		if err == errSectionTooLarge {
+			ch.Stderr().Write([]byte("Request rejected: " + err.Error() + ".\r\n"))
+		}
+		if err != nil {
+			s.logger().Errorf("ssh: cant forward client input: %v", err)
+		}
+	}()
+	// Errors of index-pack are sent to the client through the sideband on
+	// stdout, so both streams are checked for a full disk. Stderr is copied
+	// concurrently, git blocks on a full stderr pipe, e.g. with hook output
+	// of clients without sideband support.
+	output, errDiskFull := &receiveOutput{}, &diskFullWriter{}
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		copyBuffer(ch.Stderr(), io.TeeReader(stderr, errDiskFull), s.config.CopyBufferSize)
+	}()
+	var out io.Reader = stdout
+	if gitcmd.IsReceivePack() {
+		out = io.TeeReader(stdout, output)
+	}
+	_, outErr := copyBuffer(limiter.writer(ch), out, s.config.CopyBufferSize)
+	if outErr != nil {
+		// Git gets EPIPE instead of blocking on the full pipe once the
+		// client is gone, e.g. after the idle timeout
+		stdout.Close()
+	}
+	<-stderrDone
+
+	err = cmd.Wait()
+	if rejected := inspection.err(); rejected != nil {
+		s.logger().Infof("ssh: pack rejected for repo '%s': %v", gitcmd.Repo, rejected)
+		outcome = OutcomeRejected
+		sendExitStatus(ch, 1)
+		return
+	}
+	// Receive-pack reports a failed unpack in its output and still exits with
+	// zero. Git removes the quarantined objects of the push itself.
+	failed := err != nil || output.unpackFailed
+	if failed && (output.diskFull.found || errDiskFull.found) {
+		s.logger().Errorf("ssh: command %s ran out of disk space for repo '%s'", gitcmd.Verb(), gitcmd.Repo)
+		ch.Stderr().Write([]byte("Server out of disk space, please try again later.\r\n"))
+		s.onError(gitcmd.Repo, fmt.Errorf("%s: %w", gitcmd.Verb(), ErrDiskFull))
+		sendExitStatus(ch, DiskFullExitStatus)
+		return
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			s.logger().Errorf("ssh: command %s timed out for repo '%s'", gitcmd.Verb(), gitcmd.Repo)
+			outcome = OutcomeTimeout
+			sendExitStatus(ch, exitStatus(err))
+			return
+		}
+		// Git fails on its own once the client stops reading
+		if outErr != nil {
+			outcome = OutcomeClientDisconnect
+		}
+		s.logger().Errorf("ssh: command failed: %v", err)
+		s.onError(gitcmd.Repo, fmt.Errorf("%s: %w", gitcmd.Verb(), err))
+		sendExitStatus(ch, exitStatus(err))
+		return
+	}
+
+	if commands != nil {
+		s.postReceive(ch, keyID, gitcmd.Repo, repoPath, commands)
+	}
+
+	outcome = OutcomeSuccess
+	if outErr != nil || sendExitStatus(ch, 0) != nil {
+		outcome = OutcomeClientDisconnect
 	}
 }
 
-func storeKey(keyPath string, privateKey interface{}, publicKey interface{}) error {
-	if err := os.MkdirAll(filepath.Dir(keyPath), os.ModePerm); err != nil {
+// handleCustomCommand runs a command of Config.CustomCommands
+func (s *SSH) handleCustomCommand(keyID string, ch ssh.Channel, req *ssh.Request, fields []string) {
+	req.Reply(true, nil)
+
+	status := 0
+	err := callHandler(s.logger(), "custom-command", 0, func() error {
+		var err error
+		status, err = s.config.CustomCommands[fields[0]](keyID, fields[1:], ch)
 		return err
+	})
+	if err != nil {
+		s.logger().Errorf("ssh: command %s failed: %v", fields[0], err)
+		ch.Stderr().Write([]byte("Command failed.\r\n"))
+		if status == 0 {
+			status = 1
+		}
 	}
 
-	privateKeyFile, err := os.Create(keyPath)
+	sendExitStatus(ch, uint32(status))
+}
+
+// exitStatus returns the exit code of a failed command like a shell does,
+// 128 plus the signal number if it was killed
+func exitStatus(err error) uint32 {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + uint32(status.Signal())
+	}
+	if code := exitErr.ExitCode(); code > 0 {
+		return uint32(code)
+	}
+	return 1
+}
+
+// sendExitStatus reports the exit code of the command to the client, it
+// fails if the channel has been closed
+func sendExitStatus(ch ssh.Channel, status uint32) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, status)
+	_, err := ch.SendRequest("exit-status", false, payload)
+	return err
+}
+
+// repoConfig returns the config to locate the repo with, using the path
+// returned by RepoResolverFunc if set
+func (s *SSH) repoConfig(keyID string, repo string) (*Config, error) {
+	if s.RepoResolverFunc == nil {
+		return s.config, nil
+	}
+
+	path, err := s.RepoResolverFunc(keyID, strings.TrimSuffix(repo, ".git"))
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return s.config.withRepoPath(repo, path)
+}
 
-	if err := os.Chmod(keyPath, 0600); err != nil {
+// onError passes failures of git commands to the OnError callback
+func (s *SSH) onError(repo string, err error) {
+	if s.config.OnError != nil {
+		s.config.OnError(repo, err)
+	}
+}
+
+// postReceive logs the refs changed by a push and runs the post-receive callback
+func (s *SSH) postReceive(ch ssh.Channel, keyID string, repo string, repoPath string, commands *pushCommands) {
+	after, err := readRefs(s.config.GitPath, repoPath)
+	if err != nil {
+		s.logger().Errorf("ssh: cant read refs: %v", err)
+		return
+	}
+
+	refs := commands.refs(repo, repoPath, after)
+	for _, ref := range refs {
+		ref.KeyID = keyID
+	}
+	if len(refs) == 0 {
+		return
+	}
+
+	push := &Push{KeyID: keyID, RepoName: repo, RepoPath: repoPath, Refs: refs, Progress: progressFunc(ch.Stderr())}
+	s.config.logRefs(push)
+	if s.PostReceiveFunc == nil {
+		return
+	}
+	err = callHandler(s.logger(), "post-receive", s.config.PostReceiveTimeout, func() error { return s.PostReceiveFunc(push) })
+	if err != nil {
+		s.logger().Errorf("ssh: post-receive failed: %v", err)
+	}
+}
+
+func storeKey(keyPath string, privateKey interface{}, publicKey interface{}, format KeyFormat) error {
+	if err := os.MkdirAll(filepath.Dir(keyPath), os.ModePerm); err != nil {
 		return err
 	}
-	defer privateKeyFile.Close()
+
+	privateKeyPEM, err := marshalPrivateKey(privateKey, format)
 	if err != nil {
 		return err
 	}
 
-	bytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	privateKeyFile, err := os.Create(keyPath)
 	if err != nil {
 		return err
 	}
 
-	privateKeyPEM := &pem.Block{Type: fmt.Sprintf("PRIVATE KEY"), Bytes: bytes}
+	if err := os.Chmod(keyPath, 0600); err != nil {
+		return err
+	}
+	defer privateKeyFile.Close()
+
 	if err := pem.Encode(privateKeyFile, privateKeyPEM); err != nil {
 		return err
 	}
@@ -246,63 +930,195 @@ func storeKey(keyPath string, privateKey interface{}, publicKey interface{}) err
 }
 
 func (s *SSH) setup() error {
+	s.lockout = newAuthLockout(s.config.AuthFailureLockout)
+	s.pushes = newReceiveLimiter(s.config.ReceiveRateLimit)
+
+	return s.loadServerConfig()
+}
+
+// loadServerConfig builds the SSH server config with the host keys in KeyDir
+func (s *SSH) loadServerConfig() error {
+	serverVersion := s.config.ServerVersion
+	if serverVersion == "" {
+		serverVersion = fmt.Sprintf("SSH-2.0-gitkit %s", Version)
+	}
+	if err := validateServerVersion(serverVersion); err != nil {
+		return err
+	}
+
 	config := &ssh.ServerConfig{
-		ServerVersion: fmt.Sprintf("SSH-2.0-gitkit %s", Version),
+		ServerVersion: serverVersion,
+	}
+
+	// Sent as an SSH message, so it never mixes with the git protocol
+	config.BannerCallback = func(conn ssh.ConnMetadata) string {
+		return s.config.banner()
 	}
 
-	if s.config.KeyDir == "" {
-		return fmt.Errorf("key directory is not provided")
+	if s.config.KeyDir == "" && len(s.config.HostKeys) == 0 {
+		return fmt.Errorf("key directory or host keys are not provided")
 	}
 
 	if !s.config.Auth {
 		config.NoClientAuth = true
 	} else {
-		if s.PublicKeyLookupFunc == nil {
+		if s.PublicKeyLookupFunc == nil && len(s.config.TrustedUserCAKeys) == 0 {
 			return fmt.Errorf("public key lookup func is not provided")
 		}
 
-		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			pkey, err := s.PublicKeyLookupFunc(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+		// Wrong usernames are a common mistake, e.g. ssh://github.com/... without
+		// git@, so clients are told which user to connect as
+		config.BannerCallback = func(conn ssh.ConnMetadata) string {
+			if s.config.userAllowed(conn.User()) {
+				return s.config.banner()
+			}
+			return s.config.banner() + fmt.Sprintf("Unknown user '%s'. Connect as %s@<host> instead.\r\n", conn.User(), s.config.GitUser)
+		}
+
+		publicKey := func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !s.config.userAllowed(conn.User()) {
+				return nil, fmt.Errorf("unknown user %q", conn.User())
+			}
+
+			client := lockoutKey(conn.RemoteAddr())
+			if s.lockout.locked(client) {
+				return nil, fmt.Errorf("too many failed attempts from %s", client)
+			}
+
+			if cert, ok := key.(*ssh.Certificate); ok && len(s.config.TrustedUserCAKeys) > 0 {
+				perms, err := s.certPermissions(cert)
+				if err != nil {
+					s.lockout.fail(client)
+					return nil, err
+				}
+				return perms, nil
+			}
+
+			if s.PublicKeyLookupFunc == nil {
+				s.lockout.fail(client)
+				return nil, fmt.Errorf("only certificates are accepted")
+			}
+
+			pkey, err := s.PublicKeyLookupFunc(authorizedKeyString(key))
 			if err != nil {
+				s.lockout.fail(client)
 				return nil, err
 			}
 
 			if pkey == nil {
+				s.lockout.fail(client)
 				return nil, fmt.Errorf("auth handler did not return a key")
 			}
 
-			return &ssh.Permissions{Extensions: map[string]string{"key-id": pkey.Id}}, nil
+			if pkey.ForcedCommand != nil {
+				if _, err := ParseGitCommand(pkey.ForcedCommand.String()); err != nil {
+					return nil, fmt.Errorf("invalid forced command of key %s: %v", pkey.Id, err)
+				}
+			}
+
+			return pkey.permissions(), nil
+		}
+		config.PublicKeyCallback = publicKey
+
+		// Clients enter the code for pushes before the key is offered, e.g.
+		// with ssh -o PreferredAuthentications=keyboard-interactive,publickey
+		if s.config.SecondFactor != nil {
+			config.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				return s.secondFactor(conn, challenge, publicKey)
+			}
 		}
 	}
 
-	if err := genRsaKey(s.config.KeyPath("rsa")); err != nil {
-		return err
+	if len(s.config.HostKeys) > 0 {
+		return s.loadHostKeys(config, s.config.HostKeys)
 	}
 
-	if err := genEd25519Key(s.config.KeyPath("ed25519")); err != nil {
+	keyTypes, err := s.config.hostKeyTypes()
+	if err != nil {
 		return err
 	}
 
-	if err := addHostKeyFromFile(config, s.config.KeyPath("rsa")); err != nil {
-		return err
+	// Encrypted keys are provided by the user, unencrypted keys are never generated for them
+	if s.config.HostKeyPassphrase == "" {
+		for _, keyType := range keyTypes {
+			if err := hostKeyGenerators[keyType](s.config.KeyPath(keyType), s.config.KeyFormat); err != nil {
+				return err
+			}
+		}
 	}
 
-	if err := addHostKeyFromFile(config, s.config.KeyPath("ed25519")); err != nil {
-		return err
+	var keyPaths []string
+	for _, keyType := range keyTypes {
+		keyPath := s.config.KeyPath(keyType)
+		if s.config.HostKeyPassphrase != "" && !fileExists(keyPath) {
+			continue
+		}
+		keyPaths = append(keyPaths, keyPath)
+	}
+
+	if len(keyPaths) == 0 {
+		return fmt.Errorf("no host keys found in %s", s.config.KeyDir)
+	}
+
+	return s.loadHostKeys(config, keyPaths)
+}
+
+// loadHostKeys adds the host keys to the config and makes it the current one
+func (s *SSH) loadHostKeys(config *ssh.ServerConfig, keyPaths []string) error {
+	var hostKeys []ssh.Signer
+	for _, keyPath := range keyPaths {
+		signer, err := addHostKeyFromFile(config, keyPath, s.config.HostKeyPassphrase)
+		if err != nil {
+			return err
+		}
+		hostKeys = append(hostKeys, signer)
 	}
 
+	if s.config.SSHConfig != nil {
+		s.config.SSHConfig(config)
+	}
+
+	s.keysMu.Lock()
 	s.sshconfig = config
+	s.hostKeys = hostKeys
+	s.keysMu.Unlock()
 	return nil
 }
 
-func genRsaKey(path string) error {
+// validateServerVersion checks the identification string against RFC 4253
+func validateServerVersion(version string) error {
+	if !strings.HasPrefix(version, "SSH-2.0-") {
+		return fmt.Errorf("server version must start with SSH-2.0-: %q", version)
+	}
+
+	// The line including CR LF must not exceed 255 characters
+	if len(version) > 253 {
+		return fmt.Errorf("server version is too long: %d characters", len(version))
+	}
+
+	for _, c := range version {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("server version contains invalid characters: %q", version)
+		}
+	}
+
+	return nil
+}
+
+// hostKeyGenerators create the host keys in KeyDir by key type
+var hostKeyGenerators = map[string]func(string, KeyFormat) error{
+	"rsa":     genRsaKey,
+	"ed25519": genEd25519Key,
+}
+
+func genRsaKey(path string, format KeyFormat) error {
 	if !fileExists(path) {
 		rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
 			return err
 		}
 
-		if err := storeKey(path, rsaPrivateKey, &rsaPrivateKey.PublicKey); err != nil {
+		if err := storeKey(path, rsaPrivateKey, &rsaPrivateKey.PublicKey, format); err != nil {
 			return err
 		}
 	}
@@ -310,7 +1126,7 @@ func genRsaKey(path string) error {
 	return nil
 }
 
-func genEd25519Key(path string) error {
+func genEd25519Key(path string, format KeyFormat) error {
 	if fileExists(path) {
 		return nil
 	}
@@ -320,31 +1136,60 @@ func genEd25519Key(path string) error {
 		return err
 	}
 
-	if err := storeKey(path, ed25519PrivateKey, ed25519PublicKey); err != nil {
+	if err := storeKey(path, ed25519PrivateKey, ed25519PublicKey, format); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func addHostKeyFromFile(c *ssh.ServerConfig, keyPath string) error {
+func addHostKeyFromFile(c *ssh.ServerConfig, keyPath string, passphrase string) (ssh.Signer, error) {
+	private, err := readHostKey(keyPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	c.AddHostKey(private)
+	return private, nil
+}
+
+// readHostKey returns the signer of the host private key file
+func readHostKey(keyPath string, passphrase string) (ssh.Signer, error) {
 	privateBytes, err := ioutil.ReadFile(keyPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	key, err := ssh.ParseRawPrivateKey(privateBytes)
+	key, err := parseHostKey(privateBytes, passphrase)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("cant load host key %s: %v", keyPath, err)
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
+
+// parseHostKey parses a private key, decrypting it if a passphrase is given
+func parseHostKey(privateBytes []byte, passphrase string) (interface{}, error) {
+	if passphrase == "" {
+		key, err := ssh.ParseRawPrivateKey(privateBytes)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, errors.New("key is encrypted but no passphrase is provided")
+		}
+		return key, err
 	}
 
-	private, err := ssh.NewSignerFromKey(key)
+	key, err := ssh.ParseRawPrivateKeyWithPassphrase(privateBytes, []byte(passphrase))
 	if err != nil {
-		return err
+		if _, plainErr := ssh.ParseRawPrivateKey(privateBytes); plainErr == nil {
+			return nil, errors.New("key is not encrypted but a passphrase is provided")
+		}
+		if err == x509.IncorrectPasswordError {
+			return nil, errors.New("incorrect passphrase")
+		}
+		return nil, err
 	}
 
-	c.AddHostKey(private)
-	return nil
+	return key, nil
 }
 
 func (s *SSH) Listen(bind string) error {
@@ -359,57 +1204,172 @@ func (s *SSH) Listen(bind string) error {
 	if err := s.config.Setup(); err != nil {
 		return err
 	}
+	s.checkSessionLimit()
 
 	var err error
-	s.listener, err = net.Listen("tcp", bind)
+	s.listener, err = listen(bind, s.config.socketMode())
 	if err != nil {
 		return err
 	}
 
+	// Accept sessions again after a previous Shutdown
+	atomic.StoreInt32(&s.draining, 0)
+
+	if s.config.OnReady != nil {
+		s.config.OnReady(s.listener.Addr().String())
+	}
 	return nil
 }
 
 func (s *SSH) Serve() error {
-	if s.listener == nil {
+	listener := s.listener
+	if listener == nil {
 		return ErrNoListener
 	}
 
+	var tempDelay time.Duration
+
 	for {
 		// wait for connection or Stop()
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			return err
+			if !s.retryAccept(err) {
+				return err
+			}
+
+			// Back off like net/http does for temporary errors, e.g. EMFILE
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if max := 1 * time.Second; tempDelay > max {
+				tempDelay = max
+			}
+			s.logger().Errorf("ssh: accept error: %v; retrying in %v", err, tempDelay)
+			time.Sleep(tempDelay)
+			continue
 		}
+		tempDelay = 0
 
+		if err := setKeepAlive(conn, s.config.KeepAlivePeriod); err != nil {
+			s.logger().Errorf("ssh: cant enable keepalive for %s: %v", conn.RemoteAddr(), err)
+		}
+
+		// Handshakes and further connections wait in the backlog while the
+		// session limit is reached
+		s.stats.waitSessionsBelow(s.config.MaxOpenSessions)
+
+		if !s.config.ProxyProtocol {
+			s.serveConn(conn)
+			continue
+		}
+
+		// Headers are read off the accept loop so slow clients do not block
+		// it. The wait group keeps ServeContext waiting until the connection
+		// is tracked.
+		s.conns.wg.Add(1)
 		go func() {
-			log.Printf("ssh: handshaking for %s", conn.RemoteAddr())
+			defer s.conns.wg.Done()
 
-			sConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshconfig)
+			proxied, err := readProxyHeader(conn, s.config.proxyHeaderTimeout())
 			if err != nil {
-				if err == io.EOF {
-					log.Printf("ssh: handshaking was terminated: %v", err)
-				} else {
-					log.Printf("ssh: error on handshaking: %v", err)
-				}
+				s.logger().Infof("ssh: rejecting connection of %s: cant read PROXY header: %v", conn.RemoteAddr(), err)
+				conn.Close()
 				return
 			}
+			s.serveConn(proxied)
+		}()
+	}
+}
 
-			log.Printf("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+// serveConn checks the accepted connection against the lockout and the
+// connection limits and starts the handshake
+func (s *SSH) serveConn(conn net.Conn) {
+	if s.lockout.locked(lockoutKey(conn.RemoteAddr())) {
+		s.logger().Infof("ssh: rejecting locked out client %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
 
-			if s.config.Auth && s.config.GitUser != "" && sConn.User() != s.config.GitUser {
-				sConn.Close()
-				return
-			}
+	// Connections over the limits are closed before the handshake, which
+	// costs more than accepting them
+	if err := s.conns.add(conn, s.config.MaxConcurrentConnections, s.config.MaxConnectionsPerIP); err != nil {
+		s.logger().Infof("ssh: rejecting connection of %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	go func() {
+		defer s.conns.remove(conn)
+		s.logInfo("ssh: handshaking for %s", conn.RemoteAddr())
+
+		var sshConn net.Conn = conn
+		var idle *idleConn
+		if s.config.IdleTimeout > 0 {
+			idle = &idleConn{Conn: conn, timeout: s.config.IdleTimeout, onIdle: func() {
+				s.logger().Infof("ssh: closing idle connection of %s", conn.RemoteAddr())
+			}}
+			sshConn = idle
+		}
+		if s.config.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+		}
 
-			keyId := ""
-			if sConn.Permissions != nil {
-				keyId = sConn.Permissions.Extensions["key-id"]
+		sConn, chans, reqs, err := ssh.NewServerConn(sshConn, s.serverConfig())
+		if err != nil {
+			if isTimeout(err) {
+				s.logger().Infof("ssh: handshake with %s timed out", conn.RemoteAddr())
+			} else if err == io.EOF {
+				s.logger().Infof("ssh: handshaking was terminated: %v", err)
+			} else {
+				s.logger().Errorf("ssh: error on handshaking: %v", err)
 			}
+			return
+		}
+
+		conn.SetDeadline(time.Time{})
+		if idle != nil {
+			idle.start()
+		}
+
+		s.logInfo("ssh: connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
+
+		s.stats.connOpened()
+		go func() {
+			sConn.Wait()
+			s.stats.connClosed()
+		}()
+
+		if s.config.ClientAliveInterval > 0 {
+			go sendKeepAlives(sConn, s.config.ClientAliveInterval, s.config.clientAliveCountMax(), func() {
+				s.logger().Infof("ssh: closing connection of %s after unanswered keepalives", sConn.RemoteAddr())
+			})
+		}
 
-			go ssh.DiscardRequests(reqs)
-			go s.handleConnection(keyId, chans)
+		go s.handleGlobalRequests(sConn, reqs)
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			s.handleConnection(sConn, chans)
 		}()
+		s.announceHostKeys(sConn)
+		<-handled
+	}()
+}
+
+// retryAccept returns true if Serve should keep accepting after the error.
+// Temporary errors are retried unless OnAcceptError decides otherwise.
+func (s *SSH) retryAccept(err error) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
 	}
+
+	if s.config.OnAcceptError != nil {
+		return s.config.OnAcceptError(err)
+	}
+
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
 }
 
 func (s *SSH) ListenAndServe(bind string) error {
@@ -431,12 +1391,72 @@ func (s *SSH) Stop() error {
 	return s.listener.Close()
 }
 
-// Address returns the network address of the listener. This is in
-// particular useful when binding to :0 to get a free port assigned by
-// the OS.
+// Address returns the network address of the listener, or the socket path
+// for unix:// binds. This is in particular useful when binding to :0 to get
+// a free port assigned by the OS.
 func (s *SSH) Address() string {
 	if s.listener != nil {
 		return s.listener.Addr().String()
 	}
 	return ""
 }
+
+// Stats returns the number of open connections, sessions and running git commands
+func (s *SSH) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// Started returns true if the server is listening for connections
+func (s *SSH) Started() bool {
+	return s.listener != nil
+}
+
+// HealthCheck dials the server's own address and performs an SSH handshake.
+// The check passes once the server has presented its host key, even if the
+// anonymous client is rejected during authentication afterwards.
+func (s *SSH) HealthCheck(timeout time.Duration) error {
+	addr := s.Address()
+	if addr == "" {
+		return ErrNoListener
+	}
+
+	conn, err := net.DialTimeout(s.listener.Addr().Network(), addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	if s.config.ProxyProtocol {
+		if _, err := conn.Write(proxyV2LocalHeader()); err != nil {
+			return err
+		}
+	}
+
+	user := s.config.GitUser
+	if user == "" {
+		user = "git"
+	}
+
+	handshaked := false
+	clientConfig := &ssh.ClientConfig{
+		User: user,
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			handshaked = true
+			return nil
+		},
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		if handshaked {
+			return nil
+		}
+		return fmt.Errorf("ssh handshake failed: %v", err)
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs).Close()
+}
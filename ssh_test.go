@@ -0,0 +1,1090 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func Test_keyAllows(t *testing.T) {
+	deployKey := &PublicKey{Id: "1", AllowedRepos: []string{"org/app", "mirrors/*.git"}, AllowedOps: []string{"upload-pack"}}
+	examples := map[string]bool{
+		"git-upload-pack 'org/app.git'":    true,
+		"git upload-pack 'org/app'":        true,
+		"git-upload-pack 'mirrors/x.git'":  true,
+		"git-upload-pack 'org/other.git'":  false,
+		"git-receive-pack 'org/app.git'":   false,
+		"git-upload-archive 'org/app.git'": false,
+	}
+
+	for command, expected := range examples {
+		cmd, err := ParseGitCommand(command)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, keyAllows(deployKey.permissions(), cmd), command)
+		assert.True(t, keyAllows((&PublicKey{Id: "2"}).permissions(), cmd), command)
+	}
+
+	cmd, _ := ParseGitCommand("git-receive-pack 'org/app.git'")
+	assert.False(t, keyAllows((&PublicKey{Id: "3", AllowedRepos: []string{}}).permissions(), cmd))
+	assert.True(t, keyAllows(nil, cmd))
+}
+
+func TestNormalizeAuthorizedKey(t *testing.T) {
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEBQx7Cd0U/cdKrNKgjI1dHGOqW7sh7RcsDwIhVXHWYr"
+
+	for _, content := range []string{
+		key,
+		key + " alice@laptop\n",
+		`no-pty,command="echo hi" ` + key + " deploy key",
+	} {
+		normalized, err := NormalizeAuthorizedKey(content)
+		assert.NoError(t, err)
+		assert.Equal(t, key, normalized)
+	}
+
+	_, err := NormalizeAuthorizedKey("ssh-ed25519 garbage")
+	assert.Error(t, err)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIEBQx7Cd0U/cdKrNKgjI1dHGOqW7sh7RcsDwIhVXHWYr"
+
+	publicKey, err := ParsePublicKey(`from="10.1.2.3,fd00::/8",command="git-upload-pack 'app.git'" ` + key + " deploy key\n")
+	assert.NoError(t, err)
+	assert.Equal(t, key, publicKey.Content)
+	assert.Equal(t, "deploy key", publicKey.Name)
+	assert.Equal(t, "", publicKey.Id)
+	assert.Equal(t, "git-upload-pack", publicKey.ForcedCommand.Command)
+	assert.Equal(t, "app.git", publicKey.ForcedCommand.Repo)
+	assert.Equal(t, []string{"10.1.2.3", "fd00::/8"}, publicKey.AllowedSources)
+	assert.Equal(t, "10.1.2.3,fd00::/8", publicKey.permissions().CriticalOptions["source-address"])
+
+	publicKey, err = ParsePublicKey(key)
+	assert.NoError(t, err)
+	assert.Nil(t, publicKey.permissions().CriticalOptions)
+
+	for _, options := range []string{
+		"no-pty",
+		"restrict",
+		`environment="A=b"`,
+		`command="echo hi"`,
+		`from="*.example.com"`,
+		`from="!10.0.0.1"`,
+		`command="git-upload-pack 'app'",command="git-receive-pack 'app'"`,
+	} {
+		_, err = ParsePublicKey(options + " " + key)
+		assert.Error(t, err, options)
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	assert.NoError(t, err)
+	assert.Equal(t, ssh.FingerprintSHA256(parsed), publicKey.Fingerprint)
+	assert.True(t, strings.HasPrefix(publicKey.Fingerprint, "SHA256:"))
+
+	_, err = ParsePublicKey("ssh-ed25519 garbage")
+	assert.Error(t, err)
+}
+
+func Test_validateServerVersion(t *testing.T) {
+	assert.NoError(t, validateServerVersion("SSH-2.0-OpenSSH_8.9"))
+	assert.NoError(t, validateServerVersion("SSH-2.0-gitkit 1.0 comment"))
+	assert.Error(t, validateServerVersion("gitkit"))
+	assert.Error(t, validateServerVersion("SSH-1.99-gitkit"))
+	assert.Error(t, validateServerVersion("SSH-2.0-gitkit\r\nSSH-2.0-other"))
+	assert.Error(t, validateServerVersion("SSH-2.0-"+strings.Repeat("x", 250)))
+}
+
+func Test_parseHostKey(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "encrypted")
+	plain := filepath.Join(dir, "plain")
+	assert.NoError(t, exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "secret", "-f", encrypted).Run())
+	assert.NoError(t, exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", plain).Run())
+
+	encryptedBytes, err := ioutil.ReadFile(encrypted)
+	assert.NoError(t, err)
+	plainBytes, err := ioutil.ReadFile(plain)
+	assert.NoError(t, err)
+
+	key, err := parseHostKey(encryptedBytes, "secret")
+	assert.NoError(t, err)
+	assert.NotNil(t, key)
+
+	_, err = parseHostKey(encryptedBytes, "")
+	assert.EqualError(t, err, "key is encrypted but no passphrase is provided")
+
+	_, err = parseHostKey(plainBytes, "secret")
+	assert.EqualError(t, err, "key is not encrypted but a passphrase is provided")
+
+	_, err = parseHostKey(encryptedBytes, "wrong")
+	assert.Error(t, err)
+
+	key, err = parseHostKey(plainBytes, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, key)
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// failingListener returns the given errors from Accept, then net.ErrClosed
+type failingListener struct {
+	net.Listener
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if len(l.errs) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.errs[0]
+	l.errs = l.errs[1:]
+	return nil, err
+}
+
+func TestSSH_ServeAcceptErrors(t *testing.T) {
+	s := NewSSH(Config{})
+	s.listener = &failingListener{errs: []error{tempError{}, tempError{}}}
+	assert.True(t, errors.Is(s.Serve(), net.ErrClosed))
+
+	permanent := errors.New("permanent")
+	s.listener = &failingListener{errs: []error{permanent}}
+	assert.Equal(t, permanent, s.Serve())
+
+	var seen []error
+	s = NewSSH(Config{OnAcceptError: func(err error) bool {
+		seen = append(seen, err)
+		return len(seen) < 2
+	}})
+	s.listener = &failingListener{errs: []error{permanent, tempError{}, tempError{}}}
+	assert.Equal(t, tempError{}, s.Serve())
+	assert.Equal(t, []error{permanent, tempError{}}, seen)
+}
+
+func TestSSH_GitUser(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true, GitUser: "git"})
+	s.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "test"}, nil
+	}
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	dial := func(user string) (string, error) {
+		banner := ""
+		conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			BannerCallback:  func(message string) error { banner = message; return nil },
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return banner, err
+	}
+
+	banner, err := dial("git")
+	assert.NoError(t, err)
+	assert.Equal(t, "", banner)
+
+	banner, err = dial("alice")
+	assert.Error(t, err)
+	assert.Equal(t, "Unknown user 'alice'. Connect as git@<host> instead.\r\n", banner)
+
+	s.config.AllowUserMismatch = true
+	_, err = dial("alice")
+	assert.NoError(t, err)
+}
+
+func TestSSH_AcceptOriginalCommand(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", AcceptOriginalCommand: true})
+	assert.NoError(t, InitRepo("app", s.config))
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", s.config.repoStore().Path("app.git"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:refs/heads/main"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	for _, start := range []func(*ssh.Session) error{
+		func(session *ssh.Session) error { return session.Start("") },
+		func(session *ssh.Session) error { return session.Shell() },
+	} {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+		assert.NoError(t, session.Setenv(OriginalCommandEnv, "git-upload-pack '/app.git'"))
+
+		stdout, err := session.StdoutPipe()
+		assert.NoError(t, err)
+		assert.NoError(t, start(session))
+
+		out, err := ioutil.ReadAll(stdout)
+		assert.NoError(t, err)
+		assert.True(t, strings.Contains(string(out), " refs/heads/main"), string(out))
+		session.Close()
+	}
+}
+
+func TestSSH_MissingRepo(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", AutoCreate: true})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	run := func(command string) string {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+		defer session.Close()
+
+		stderr, err := session.StderrPipe()
+		assert.NoError(t, err)
+		session.Run(command)
+
+		out, _ := ioutil.ReadAll(stderr)
+		return string(out)
+	}
+
+	// Reads never create repos
+	assert.Equal(t, "Repository not found.\r\n", run("git-upload-pack 'typo.git'"))
+	assert.Equal(t, "Repository not found.\r\n", run("git-upload-archive 'typo.git'"))
+	assert.False(t, s.config.repoStore().Exists("typo.git"))
+
+	run("git-receive-pack 'app.git'")
+	assert.True(t, s.config.repoStore().Exists("app.git"))
+}
+
+func TestSSH_CustomCommands(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+		"info": func(keyID string, args []string, ch io.ReadWriter) (int, error) {
+			fmt.Fprintf(ch, "gitkit %s %s\n", Version, strings.Join(args, ","))
+			return 0, nil
+		},
+		"fail": func(keyID string, args []string, ch io.ReadWriter) (int, error) {
+			return 3, errors.New("failed")
+		},
+	}})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	out, err := session.Output("info -v repo")
+	assert.NoError(t, err)
+	assert.Equal(t, "gitkit "+Version+" -v,repo\n", string(out))
+
+	session, err = conn.NewSession()
+	assert.NoError(t, err)
+	err = session.Run("fail")
+	if assert.IsType(t, &ssh.ExitError{}, err) {
+		assert.Equal(t, 3, err.(*ssh.ExitError).ExitStatus())
+	}
+}
+
+func TestSSH_ForcedCommand(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true})
+	s.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "deploy", ForcedCommand: &GitCommand{Command: "git-upload-pack", Repo: "app"}}, nil
+	}
+	assert.NoError(t, InitRepo("app", s.config))
+	assert.NoError(t, InitRepo("other", s.config))
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", s.config.repoStore().Path("app.git"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:refs/heads/deploy-only"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	for _, command := range []string{"git-receive-pack 'other.git'", "git-upload-pack 'other.git'", "info"} {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+
+		// The advertisement of app.git without receive-pack capabilities
+		out, _ := session.Output(command)
+		assert.True(t, strings.Contains(string(out), "refs/heads/deploy-only"), command)
+		assert.False(t, strings.Contains(string(out), "report-status"), command)
+	}
+}
+
+func TestSSH_AllowedSources(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true})
+	var sources []string
+	s.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "ci", AllowedSources: sources}, nil
+	}
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	assert.NoError(t, err)
+	dial := func() error {
+		conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	sources = []string{"10.0.0.0/8"}
+	assert.Error(t, dial())
+
+	sources = []string{"10.0.0.0/8", "127.0.0.1"}
+	assert.NoError(t, dial())
+}
+
+func TestSSH_PinRef(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", AllowPartialClone: true})
+	s.config.PinRef = func(repo string) (string, bool) {
+		return "refs/tags/v1", repo == "app"
+	}
+	assert.NoError(t, InitRepo("app", s.config))
+
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", s.config.repoStore().Path("app.git"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"tag", "v1"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "second"},
+		{"push", "-q", "origin", "HEAD:refs/heads/main", "v1"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	out, _ := session.Output("git-upload-pack 'app.git'")
+	assert.True(t, strings.Contains(string(out), " refs/tags/v1"), string(out))
+	assert.False(t, strings.Contains(string(out), " refs/heads/main"), string(out))
+	assert.False(t, strings.Contains(string(out), " HEAD"), string(out))
+
+	head, err := exec.Command("git", "-C", work, "rev-parse", "HEAD").Output()
+	assert.NoError(t, err)
+	assert.False(t, strings.Contains(string(out), strings.TrimSpace(string(head))), string(out))
+
+	session, err = conn.NewSession()
+	assert.NoError(t, err)
+	stderr, err := session.StderrPipe()
+	assert.NoError(t, err)
+	session.Run("git-upload-archive 'app.git'")
+	message, _ := ioutil.ReadAll(stderr)
+	assert.Equal(t, "Archives are not available for this repository.\r\n", string(message))
+
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	// Objects of hidden refs can not be fetched by their id, even though
+	// partial clones allow any object id in wants
+	_, port, _ := net.SplitHostPort(s.Address())
+	fetch := func(ref string) (string, error) {
+		cmd := exec.Command("git", "fetch", "-q", "ssh://git@127.0.0.1/app.git", ref)
+		cmd.Dir = filepath.Join(dir, "fetch")
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	assert.NoError(t, exec.Command("git", "init", "-q", filepath.Join(dir, "fetch")).Run())
+
+	fetched, err := fetch("refs/tags/v1")
+	assert.NoError(t, err, fetched)
+	fetched, err = fetch(strings.TrimSpace(string(head)))
+	assert.Error(t, err)
+	assert.Contains(t, fetched, "unadvertised object")
+}
+
+func TestSSH_OnOperation(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	operations := make(chan Operation, 10)
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", OnOperation: func(op Operation) {
+		operations <- op
+	}})
+	s.Authorize = func(keyID string, repo string) (bool, error) {
+		return repo != "private", nil
+	}
+	assert.NoError(t, InitRepo("app", s.config))
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	for command, outcome := range map[string]string{
+		"git-upload-pack 'app.git'":     OutcomeSuccess,
+		"git-upload-pack 'typo.git'":    OutcomeRejected,
+		"git-upload-pack 'private.git'": OutcomeAuthDenied,
+	} {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+
+		// Ends the negotiation like ls-remote
+		session.Stdin = strings.NewReader("0000")
+		session.Run(command)
+		session.Close()
+
+		select {
+		case op := <-operations:
+			assert.Equal(t, outcome, op.Outcome, command)
+			assert.Equal(t, "upload-pack", op.Verb, command)
+			assert.True(t, op.Duration > 0, command)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no operation reported for %s", command)
+		}
+	}
+}
+
+func TestSSH_ReceiveRateLimit(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", ReceiveRateLimit: ReceiveRateLimit{PerIP: 1}})
+	assert.NoError(t, InitRepo("app", s.config))
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	run := func(command string) string {
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+		defer session.Close()
+
+		stderr, err := session.StderrPipe()
+		assert.NoError(t, err)
+		session.Stdin = strings.NewReader("0000")
+		session.Run(command)
+
+		out, _ := ioutil.ReadAll(stderr)
+		return string(out)
+	}
+
+	assert.NotContains(t, run("git-receive-pack 'app.git'"), "Too many pushes")
+	assert.Contains(t, run("git-receive-pack 'app.git'"), "Too many pushes, please try again later.")
+
+	// Fetches do not count against the limit
+	assert.NotContains(t, run("git-upload-pack 'app.git'"), "Too many pushes")
+}
+
+func TestSSH_OnReady(t *testing.T) {
+	dir := t.TempDir()
+	ready := make(chan string, 1)
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", OnReady: func(addr string) {
+		ready <- addr
+	}})
+
+	go s.ListenAndServe("127.0.0.1:0")
+	defer s.Stop()
+
+	select {
+	case addr := <-ready:
+		assert.NotEqual(t, "127.0.0.1:0", addr)
+
+		conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+			User:            "git",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		assert.NoError(t, err)
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener not ready")
+	}
+}
+
+func TestSSH_PreReceiveRejection(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	// Enough output to fill the pipe buffers before the reason is printed
+	script := "#!/bin/sh\nfor i in $(seq 1 5000); do echo \"checking commit $i\" >&2; done\necho 'Pushes to main are not allowed' >&2\nexit 1\n"
+
+	dir := t.TempDir()
+	s := NewSSH(Config{
+		Dir:       dir + "/repos",
+		KeyDir:    dir + "/keys",
+		AutoHooks: true,
+		Hooks:     &HookScripts{PreReceive: script},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "-q", work).Run())
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	_, err := git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	out, err := git("push", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "remote: checking commit 5000")
+	assert.Contains(t, out, "remote: Pushes to main are not allowed")
+	assert.Contains(t, out, "pre-receive hook declined")
+
+	// Failures of git are reported with its exit status
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+
+	session.Stdin = strings.NewReader("invalid")
+	err = session.Run("git-upload-pack 'app.git'")
+	exitErr, ok := err.(*ssh.ExitError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, 128, exitErr.ExitStatus())
+	}
+}
+
+func TestSSH_PushKeyID(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	identity := filepath.Join(dir, "id_ed25519")
+	assert.NoError(t, storeKey(identity, priv, pub, KeyFormatOpenSSH))
+
+	pushes := make(chan *Push, 1)
+	s := NewSSH(Config{
+		Dir:       dir + "/repos",
+		KeyDir:    dir + "/keys",
+		Auth:      true,
+		AutoHooks: true,
+		Hooks:     &HookScripts{PostReceive: "#!/bin/sh\necho \"$GITKIT_KEY\" > " + filepath.Join(dir, "pusher") + "\n"},
+	})
+	s.PublicKeyLookupFunc = func(string) (*PublicKey, error) {
+		return &PublicKey{Id: "alice"}, nil
+	}
+	s.PostReceiveFunc = func(push *Push) error {
+		pushes <- push
+		return nil
+	}
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "-q", work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -o IdentitiesOnly=yes -i "+identity+" -p "+port)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+
+	select {
+	case push := <-pushes:
+		assert.Equal(t, "alice", push.KeyID)
+		if assert.Len(t, push.Refs, 1) {
+			assert.Equal(t, "alice", push.Refs[0].KeyID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("push not received")
+	}
+
+	pusher, err := os.ReadFile(filepath.Join(dir, "pusher"))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice\n", string(pusher))
+}
+
+func TestSSH_MaxConnectionsPerIP(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", MaxConnectionsPerIP: 1})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	config := &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	conn, err := ssh.Dial("tcp", s.Address(), config)
+	assert.NoError(t, err)
+
+	_, err = ssh.Dial("tcp", s.Address(), config)
+	assert.Error(t, err)
+
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		if conn, err = ssh.Dial("tcp", s.Address(), config); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+}
+
+func Test_connTracker(t *testing.T) {
+	newConn := func(addr string) net.Conn {
+		server, client := net.Pipe()
+		client.Close()
+		return &addrConn{Conn: server, addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 1234}}
+	}
+
+	tracker := &connTracker{}
+	a1, a2, b := newConn("10.0.0.1"), newConn("10.0.0.1"), newConn("10.0.0.2")
+	assert.NoError(t, tracker.add(a1, 2, 1))
+	assert.EqualError(t, tracker.add(a2, 2, 1), "too many connections from 10.0.0.1")
+	assert.NoError(t, tracker.add(b, 2, 1))
+	assert.Equal(t, errTooManyConnections, tracker.add(a2, 2, 0))
+
+	tracker.remove(a1)
+	assert.NoError(t, tracker.add(a2, 2, 1))
+	assert.Equal(t, map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}, tracker.hosts)
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestSSH_Timeouts(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", HandshakeTimeout: 100 * time.Millisecond, IdleTimeout: 300 * time.Millisecond})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	// Clients that never finish the handshake are disconnected
+	conn, err := net.Dial("tcp", s.Address())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(conn)
+	assert.NoError(t, err)
+
+	client, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// Traffic keeps the connection open beyond the idle timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		assert.NoError(t, err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func Test_gitProtocol(t *testing.T) {
+	assert.Equal(t, "version=2", gitProtocol(map[string]string{GitProtocolEnv: "version=2"}, ""))
+	assert.Equal(t, "version=2:object-format=sha256", gitProtocol(map[string]string{GitProtocolEnv: "version=2:object-format=sha256"}, ""))
+	assert.Equal(t, "", gitProtocol(map[string]string{GitProtocolEnv: "version=2"}, "refs/tags/v1"))
+	assert.Equal(t, "", gitProtocol(map[string]string{GitProtocolEnv: "version=2\nGIT_DIR=/"}, ""))
+	assert.Equal(t, "", gitProtocol(map[string]string{}, ""))
+}
+
+func TestSSH_GitProtocol(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	dir := t.TempDir()
+	s := NewSSH(Config{
+		Dir:    dir + "/repos",
+		KeyDir: dir + "/keys",
+		PinRef: func(repo string) (string, bool) {
+			return "refs/tags/v1", repo == "pinned"
+		},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	assert.NoError(t, InitRepo("pinned", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	lsRemote := func(repo string) string {
+		cmd := exec.Command("git", "-c", "protocol.version=2", "ls-remote", "ssh://git@127.0.0.1/"+repo)
+		cmd.Env = append(os.Environ(), "GIT_TRACE_PACKET=1", "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+		return string(out)
+	}
+
+	assert.Contains(t, lsRemote("app.git"), "< version 2")
+	assert.NotContains(t, lsRemote("pinned.git"), "< version 2")
+}
+
+func Test_exitStatus(t *testing.T) {
+	assert.Equal(t, uint32(3), exitStatus(exec.Command("sh", "-c", "exit 3").Run()))
+	assert.Equal(t, uint32(137), exitStatus(exec.Command("sh", "-c", "kill -9 $$").Run()))
+	assert.Equal(t, uint32(1), exitStatus(errors.New("pipe broken")))
+}
+
+func TestSSH_TimeoutExitStatus(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", UploadPackTimeout: 100 * time.Millisecond})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	defer session.Close()
+
+	// Git waits for the request of the client until it is killed
+	_, err = session.StdinPipe()
+	assert.NoError(t, err)
+	err = session.Run("git-upload-pack 'app.git'")
+	exitErr, ok := err.(*ssh.ExitError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, 128+int(syscall.SIGKILL), exitErr.ExitStatus())
+	}
+}
+
+func TestSSH_RepoResolverFunc(t *testing.T) {
+	requireGit(t)
+
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", AutoCreate: true})
+	s.RepoResolverFunc = func(keyID, repo string) (string, error) {
+		if repo == "blocked" {
+			return "", errors.New("no shard")
+		}
+		return filepath.Join(dir, "shard", repo+".git"), nil
+	}
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Pushes create the repo at the resolved path
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	out, _ := session.Output("git-receive-pack 'org/app.git'")
+	assert.True(t, strings.Contains(string(out), "report-status"), string(out))
+	assert.True(t, RepoExists(filepath.Join(dir, "shard", "org", "app.git")))
+	assert.False(t, s.config.repoStore().Exists("org/app.git"))
+
+	session, err = conn.NewSession()
+	assert.NoError(t, err)
+	stderr, err := session.StderrPipe()
+	assert.NoError(t, err)
+	session.Run("git-upload-pack 'blocked.git'")
+	message, _ := ioutil.ReadAll(stderr)
+	assert.Equal(t, "Repository not available.\r\n", string(message))
+}
+
+func TestSSH_Banner(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Banner: "This server moves to git2.example.com", CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+		"info": func(keyID string, args []string, ch io.ReadWriter) (int, error) {
+			fmt.Fprint(ch, "ok")
+			return 0, nil
+		},
+	}})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	banner := ""
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		BannerCallback:  func(message string) error { banner = message; return nil },
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "This server moves to git2.example.com\r\n", banner)
+
+	// Output of commands does not include the banner
+	session, err := conn.NewSession()
+	assert.NoError(t, err)
+	out, err := session.Output("info")
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", string(out))
+}
+
+func TestSSH_HealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", Auth: true})
+	s.PublicKeyLookupFunc = func(string) (*PublicKey, error) { return nil, nil }
+
+	assert.False(t, s.Started())
+	assert.Error(t, s.HealthCheck(time.Second))
+
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	// Servers requiring authentication are healthy once they answer the handshake
+	assert.NoError(t, s.HealthCheck(2*time.Second))
+	assert.True(t, s.Started())
+}
+
+func TestSSH_ReceivePackTimeout(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	dir := t.TempDir()
+	s := NewSSH(Config{
+		Dir:                dir + "/repos",
+		KeyDir:             dir + "/keys",
+		AutoHooks:          true,
+		Hooks:              &HookScripts{PreReceive: "#!/bin/sh\nsleep 30\n"},
+		ReceivePackTimeout: 500 * time.Millisecond,
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "-q", work).Run())
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+
+	_, err := git("-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial")
+	assert.NoError(t, err)
+
+	// The hook is killed along with receive-pack instead of holding the session open
+	start := time.Now()
+	_, err = git("push", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Second))
+
+	out, err := exec.Command("git", "--git-dir", filepath.Join(dir, "repos", "app.git"), "for-each-ref").Output()
+	assert.NoError(t, err)
+	assert.Empty(t, string(out))
+}
+
+func TestSSH_MaxChannelsPerConnection(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSSH(Config{Dir: dir + "/repos", KeyDir: dir + "/keys", MaxChannelsPerConnection: 2})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Channels other than sessions are never accepted
+	_, _, err = conn.OpenChannel("direct-tcpip", nil)
+	if assert.IsType(t, &ssh.OpenChannelError{}, err) {
+		assert.Equal(t, ssh.UnknownChannelType, err.(*ssh.OpenChannelError).Reason)
+	}
+
+	first, err := conn.NewSession()
+	assert.NoError(t, err)
+	second, err := conn.NewSession()
+	assert.NoError(t, err)
+	defer second.Close()
+
+	_, err = conn.NewSession()
+	if assert.IsType(t, &ssh.OpenChannelError{}, err) {
+		assert.Equal(t, ssh.ResourceShortage, err.(*ssh.OpenChannelError).Reason)
+	}
+
+	// Closed sessions free their slot
+	first.Close()
+	for i := 0; i < 50; i++ {
+		var session *ssh.Session
+		if session, err = conn.NewSession(); err == nil {
+			session.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.NoError(t, err)
+}
@@ -0,0 +1,130 @@
+package gitkit
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the server's runtime gauges
+type Stats struct {
+	Connections int64            // Open SSH connections
+	Sessions    int64            // Sessions running a command
+	Repos       map[string]int64 // Running git commands per repository
+	Operations  map[string]int64 // Running git commands per verb, e.g. upload-pack
+}
+
+// stats keeps the live counters behind Stats. Connections are counted with
+// atomics, session counts are guarded by a mutex as they are keyed by name.
+// The session count is also used to limit and drain sessions.
+type stats struct {
+	connections int64
+
+	mu         sync.Mutex
+	sessions   int64
+	changed    chan struct{} // Closed on the next change of sessions
+	repos      map[string]int64
+	operations map[string]int64
+}
+
+func (s *stats) connOpened() {
+	atomic.AddInt64(&s.connections, 1)
+}
+
+func (s *stats) connClosed() {
+	atomic.AddInt64(&s.connections, -1)
+}
+
+// sessionStarted counts a session unless limit sessions are running, zero
+// means unlimited. It returns a func to call once the session is done.
+func (s *stats) sessionStarted(limit int) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limit > 0 && s.sessions >= int64(limit) {
+		return nil, false
+	}
+	s.sessions++
+	s.notify()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.sessions--
+		s.notify()
+	}, true
+}
+
+// commandStarted records a running git command and returns a func to call once it is done
+func (s *stats) commandStarted(repo string, verb string) func() {
+	s.mu.Lock()
+	if s.repos == nil {
+		s.repos = map[string]int64{}
+		s.operations = map[string]int64{}
+	}
+	s.repos[repo]++
+	s.operations[verb]++
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.repos[repo]--; s.repos[repo] <= 0 {
+			delete(s.repos, repo)
+		}
+		if s.operations[verb]--; s.operations[verb] <= 0 {
+			delete(s.operations, verb)
+		}
+	}
+}
+
+func (s *stats) notify() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// watchSessions returns the number of running sessions and a channel closed once it changes
+func (s *stats) watchSessions() (int, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+	return int(s.sessions), s.changed
+}
+
+// waitSessionsBelow blocks until fewer than limit sessions are running
+func (s *stats) waitSessionsBelow(limit int) {
+	for limit > 0 {
+		active, changed := s.watchSessions()
+		if active < limit {
+			return
+		}
+		<-changed
+	}
+}
+
+func (s *stats) snapshot() Stats {
+	result := Stats{
+		Connections: atomic.LoadInt64(&s.connections),
+		Repos:       map[string]int64{},
+		Operations:  map[string]int64{},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result.Sessions = s.sessions
+	for repo, n := range s.repos {
+		result.Repos[repo] = n
+	}
+	for verb, n := range s.operations {
+		result.Operations[verb] = n
+	}
+
+	return result
+}
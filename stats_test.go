@@ -0,0 +1,49 @@
+package gitkit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_stats(t *testing.T) {
+	s := &stats{}
+	s.connOpened()
+	s.connOpened()
+	s.connClosed()
+
+	endA, _ := s.sessionStarted(0)
+	endB, _ := s.sessionStarted(0)
+	doneA := s.commandStarted("a.git", "upload-pack")
+	doneB := s.commandStarted("a.git", "receive-pack")
+	doneC := s.commandStarted("b.git", "upload-pack")
+
+	snapshot := s.snapshot()
+	assert.Equal(t, int64(1), snapshot.Connections)
+	assert.Equal(t, int64(2), snapshot.Sessions)
+	assert.Equal(t, map[string]int64{"a.git": 2, "b.git": 1}, snapshot.Repos)
+	assert.Equal(t, map[string]int64{"upload-pack": 2, "receive-pack": 1}, snapshot.Operations)
+
+	// Sessions above the limit are not counted
+	_, ok := s.sessionStarted(2)
+	assert.False(t, ok)
+	active, changed := s.watchSessions()
+	assert.Equal(t, 2, active)
+
+	endA()
+	endB()
+	doneA()
+	doneB()
+	doneC()
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("watchers are not notified")
+	}
+
+	snapshot = s.snapshot()
+	assert.Equal(t, int64(0), snapshot.Sessions)
+	assert.Empty(t, snapshot.Repos)
+	assert.Empty(t, snapshot.Operations)
+}
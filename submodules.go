@@ -0,0 +1,158 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// submodule is a gitlink of a pushed tree
+type submodule struct {
+	Path string
+	URL  string
+	SHA  string
+
+	// Name of the repo next to the pushed one a relative url resolves to,
+	// e.g. org/lib.git, URL is then its path
+	Repo string
+}
+
+// Protocols submodules are fetched with. Local repos are only reachable with
+// relative urls, so absolute urls can't read arbitrary paths on the server.
+var (
+	remoteSubmoduleProtocols = []string{"https", "ssh"}
+	localSubmoduleProtocols  = []string{"file"}
+)
+
+// readSubmodules returns the submodules of the revision from its gitlinks
+// and .gitmodules file
+func readSubmodules(repoPath string, repoName string, rev string) ([]submodule, error) {
+	cmd := exec.Command("git", "ls-tree", "-r", "-z", rev)
+	cmd.Dir = repoPath
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cant list tree: %v", err)
+	}
+
+	// Entries are "<mode> <type> <sha>\t<path>"
+	submodules := []submodule{}
+	for _, entry := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		chunks := strings.SplitN(entry, "\t", 2)
+		fields := strings.Fields(chunks[0])
+		if len(chunks) != 2 || len(fields) != 3 || fields[0] != "160000" {
+			continue
+		}
+		submodules = append(submodules, submodule{Path: chunks[1], SHA: fields[2]})
+	}
+
+	if len(submodules) == 0 {
+		return submodules, nil
+	}
+
+	cmd = exec.Command("git", "config", "--blob", rev+":.gitmodules", "-z", "--get-regexp", `^submodule\..*\.(path|url)$`)
+	cmd.Dir = repoPath
+	out, err = cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cant read .gitmodules: %v", err)
+	}
+
+	// Entries are "submodule.<name>.<key>\n<value>"
+	paths := map[string]string{}
+	urls := map[string]string{}
+	for _, entry := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		chunks := strings.SplitN(entry, "\n", 2)
+		if len(chunks) != 2 {
+			continue
+		}
+		key := chunks[0]
+		name := key[len("submodule."):strings.LastIndex(key, ".")]
+		if strings.HasSuffix(key, ".path") {
+			paths[chunks[1]] = name
+		} else {
+			urls[name] = chunks[1]
+		}
+	}
+
+	for i, sub := range submodules {
+		url := urls[paths[sub.Path]]
+		if url == "" {
+			return nil, fmt.Errorf("submodule %s has no url in .gitmodules", sub.Path)
+		}
+
+		// Relative urls are resolved against the pushed repository
+		if strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../") {
+			repo := path.Join(repoName, url)
+			if repo == ".." || strings.HasPrefix(repo, "../") {
+				return nil, fmt.Errorf("submodule %s is outside of the repo directory", sub.Path)
+			}
+			submodules[i].Repo = repo
+			url = filepath.Join(repoPath, filepath.FromSlash(url))
+		}
+		submodules[i].URL = url
+	}
+
+	return submodules, nil
+}
+
+// checkoutSubmodules fetches the submodules of the revision into the
+// extracted tree in dir if allowed decides so. Only the gitlinked commit is
+// fetched, and nested submodules are not checked out.
+func checkoutSubmodules(hook *HookInfo, dir string, allowed func(*HookInfo, string) (bool, error)) error {
+	submodules, err := readSubmodules(hook.RepoPath, hook.RepoName, hook.NewRev)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range submodules {
+		subDir := filepath.Join(dir, filepath.FromSlash(sub.Path))
+		// Like the extracted files, submodules must not be written through symlinks
+		if subDir == filepath.Clean(dir) || checkExtractPath(filepath.Clean(dir), filepath.Join(subDir, ".git")) != nil {
+			return fmt.Errorf("invalid submodule path: %s", sub.Path)
+		}
+
+		url, protocols := sub.URL, remoteSubmoduleProtocols
+		if sub.Repo != "" {
+			url, protocols = sub.Repo, localSubmoduleProtocols
+		}
+		ok := false
+		if allowed != nil {
+			if ok, err = allowed(hook, url); err != nil {
+				return fmt.Errorf("cant check submodule %s: %v", sub.Path, err)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("submodule %s from %s is not allowed", sub.Path, url)
+		}
+
+		fetch := []string{"-C", subDir, "-c", "protocol.allow=never"}
+		for _, protocol := range protocols {
+			fetch = append(fetch, "-c", "protocol."+protocol+".allow=always")
+		}
+		fetch = append(fetch, "fetch", "-q", "--depth", "1", "--", sub.URL, sub.SHA)
+
+		// The hook's repository variables must not leak into the clones
+		for _, args := range [][]string{
+			{"init", "-q", subDir},
+			fetch,
+			{"-C", subDir, "checkout", "-q", "--detach", "FETCH_HEAD"},
+		} {
+			stderr := &bytes.Buffer{}
+			cmd := exec.Command("git", args...)
+			cmd.Env = withoutRepoEnv(os.Environ())
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("cant check out submodule %s: %s", sub.Path, strings.TrimSpace(stderr.String()))
+			}
+		}
+
+		if err := os.RemoveAll(filepath.Join(subDir, ".git")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package gitkit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// TenantLimit is the quota shared by all sessions of a tenant, see PublicKey.Tenant
+type TenantLimit struct {
+	MaxSessions    int   // Max concurrent git commands, zero means unlimited
+	BytesPerSecond int64 // Bandwidth of client input and git output combined, zero means unlimited
+}
+
+// tenants tracks the running sessions and bandwidth of every tenant
+type tenants struct {
+	mu     sync.Mutex
+	states map[string]*tenantState
+}
+
+type tenantState struct {
+	sessions int
+	limiter  *rateLimiter
+}
+
+// acquire starts a session of the tenant. It returns false if the tenant
+// reached its session limit, otherwise the func to end the session and the
+// tenant's bandwidth limiter, which is nil if the bandwidth is unlimited.
+func (t *tenants) acquire(tenant string, limit TenantLimit) (func(), *rateLimiter, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.states == nil {
+		t.states = map[string]*tenantState{}
+	}
+
+	state, ok := t.states[tenant]
+	if !ok {
+		state = &tenantState{}
+		if limit.BytesPerSecond > 0 {
+			state.limiter = &rateLimiter{rate: limit.BytesPerSecond}
+		}
+		t.states[tenant] = state
+	}
+
+	if limit.MaxSessions > 0 && state.sessions >= limit.MaxSessions {
+		return nil, nil, false
+	}
+	state.sessions++
+
+	release := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if state.sessions--; state.sessions == 0 {
+			delete(t.states, tenant)
+		}
+	}
+	return release, state.limiter, true
+}
+
+// Max bytes passed through a rate limited stream at once, so that slow
+// tenants do not wait long for a single large chunk
+const rateLimitChunk = 16 * 1024
+
+// rateLimiter spaces transfers to stay below the rate, shared between streams
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64 // bytes per second
+	next time.Time
+}
+
+// wait blocks until n bytes may be transferred
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// writer returns w limited to the rate, or w itself if the limiter is nil
+func (l *rateLimiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &rateWriter{w: w, limiter: l}
+}
+
+// reader returns r limited to the rate, or r itself if the limiter is nil
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateReader{r: r, limiter: l}
+}
+
+type rateWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (w *rateWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateLimitChunk {
+			chunk = chunk[:rateLimitChunk]
+		}
+
+		w.limiter.wait(len(chunk))
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+type rateReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,58 @@
+package gitkit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_tenants(t *testing.T) {
+	tenants := &tenants{}
+	limit := TenantLimit{MaxSessions: 2}
+
+	release1, limiter, ok := tenants.acquire("acme", limit)
+	assert.True(t, ok)
+	assert.Nil(t, limiter)
+	release2, _, ok := tenants.acquire("acme", limit)
+	assert.True(t, ok)
+
+	_, _, ok = tenants.acquire("acme", limit)
+	assert.False(t, ok)
+	_, _, ok = tenants.acquire("other", limit)
+	assert.True(t, ok)
+
+	release1()
+	_, _, ok = tenants.acquire("acme", limit)
+	assert.True(t, ok)
+
+	release2()
+	assert.Len(t, tenants.states, 2)
+
+	// Sessions of a tenant share the limiter
+	_, limiter1, _ := tenants.acquire("limited", TenantLimit{BytesPerSecond: 1000})
+	_, limiter2, _ := tenants.acquire("limited", TenantLimit{BytesPerSecond: 1000})
+	assert.NotNil(t, limiter1)
+	assert.True(t, limiter1 == limiter2)
+}
+
+func Test_rateLimiter(t *testing.T) {
+	var limiter *rateLimiter
+	buf := &bytes.Buffer{}
+	assert.True(t, limiter.writer(buf) == buf)
+
+	limiter = &rateLimiter{rate: 100000}
+	data := bytes.Repeat([]byte("x"), 50000)
+
+	start := time.Now()
+	out := &bytes.Buffer{}
+	n, err := io.Copy(limiter.writer(out), limiter.reader(bytes.NewReader(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, data, out.Bytes())
+
+	// Reading and writing both count, 100KB at 100KB/s
+	assert.True(t, time.Since(start) >= 900*time.Millisecond, time.Since(start).String())
+}
@@ -0,0 +1,183 @@
+package gitkit
+
+import (
+	"bufio"
+	"compress/zlib"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// ErrThinPack rejects pushes of thin packs if Config.AllowThinPack is false
+var ErrThinPack = errors.New("thin packs are not allowed, push with --no-thin")
+
+// Types of pack objects, deltas refer to their base by offset or by id
+const (
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packObjectTypes = map[byte]string{1: "commit", 2: "tree", 3: "blob", 4: "tag"}
+
+// objectHash returns the hash of object ids negotiated by the client
+func objectHash(req *clientRequest) func() hash.Hash {
+	if req != nil {
+		for _, c := range req.Caps {
+			if c == "object-format=sha256" {
+				return sha256.New
+			}
+		}
+	}
+	return sha1.New
+}
+
+// isThinPack reads a pack until it finds a delta against an object that is
+// not part of the pack. Git refers to bases in the same pack by offset if the
+// client supports ofs-delta, so only deltas by id are checked, against the ids
+// of the whole objects read so far. Packs of clients without ofs-delta may be
+// reported as thin.
+func isThinPack(r io.Reader, newHash func() hash.Hash) (bool, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return false, err
+	}
+	if string(header[:4]) != "PACK" {
+		return false, fmt.Errorf("invalid pack signature %q", header[:4])
+	}
+
+	count := binary.BigEndian.Uint32(header[8:])
+	objects := map[string]struct{}{}
+
+	for i := uint32(0); i < count; i++ {
+		kind, size, err := readPackObjectHeader(br)
+		if err != nil {
+			return false, err
+		}
+
+		switch kind {
+		case packOfsDelta:
+			// Offset of the base, its last byte has no continuation bit
+			for {
+				c, err := br.ReadByte()
+				if err != nil {
+					return false, err
+				}
+				if c&0x80 == 0 {
+					break
+				}
+			}
+		case packRefDelta:
+			base := make([]byte, newHash().Size())
+			if _, err := io.ReadFull(br, base); err != nil {
+				return false, err
+			}
+			if _, ok := objects[string(base)]; !ok {
+				return true, nil
+			}
+		}
+
+		// Reads exactly the compressed data, bufio.Reader is a flate.Reader
+		data, err := zlib.NewReader(br)
+		if err != nil {
+			return false, err
+		}
+
+		if name, ok := packObjectTypes[kind]; ok {
+			h := newHash()
+			fmt.Fprintf(h, "%s %d\x00", name, size)
+			if _, err := io.Copy(h, data); err != nil {
+				return false, err
+			}
+			objects[string(h.Sum(nil))] = struct{}{}
+		} else if _, err := io.Copy(ioutil.Discard, data); err != nil {
+			return false, err
+		}
+		data.Close()
+	}
+
+	return false, nil
+}
+
+// readPackObjectHeader reads the type and inflated size of a pack object
+func readPackObjectHeader(r io.ByteReader) (byte, uint64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	kind := (c >> 4) & 7
+	size := uint64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 57 {
+			return 0, 0, errors.New("invalid pack object size")
+		}
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= uint64(c&0x7f) << shift
+	}
+	return kind, size, nil
+}
+
+// thinPackReader passes the pack through and checks it for thin deltas in the
+// background. The check reads in step with the reader and the end of the pack
+// is only returned once the check is done, so a rejection by onThin fails the
+// reads before git receives the complete pack.
+type thinPackReader struct {
+	pack io.Reader
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error // Rejection of onThin, set before done is closed
+}
+
+// newThinPackReader calls onThin if the pack is thin, a returned error
+// rejects the pack
+func newThinPackReader(pack io.Reader, newHash func() hash.Hash, onThin func() error) *thinPackReader {
+	pr, pw := io.Pipe()
+	r := &thinPackReader{pack: pack, pw: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(r.done)
+
+		thin, _ := isThinPack(pr, newHash)
+		if thin {
+			if r.err = onThin(); r.err != nil {
+				pr.CloseWithError(r.err)
+				return
+			}
+		}
+		// Packs git does not accept either are left to git
+		io.Copy(ioutil.Discard, pr)
+	}()
+
+	return r
+}
+
+func (r *thinPackReader) Read(p []byte) (int, error) {
+	n, err := r.pack.Read(p)
+	if n > 0 {
+		if _, werr := r.pw.Write(p[:n]); werr != nil {
+			return 0, werr
+		}
+	}
+	if err != nil {
+		r.pw.CloseWithError(err)
+		<-r.done
+		if r.err != nil {
+			return 0, r.err
+		}
+	}
+	return n, err
+}
+
+// Close stops the check if the pack is not read to the end
+func (r *thinPackReader) Close() error {
+	return r.pw.Close()
+}
@@ -0,0 +1,128 @@
+package gitkit
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_isThinPack(t *testing.T) {
+	requireGit(t)
+
+	work := t.TempDir()
+	git := func(stdin string, args ...string) []byte {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = work
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		assert.NoError(t, err)
+		return out
+	}
+
+	git("", "init", "-q")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "numbers"), []byte(strings.Repeat("line\n", 5000)), 0644))
+	git("", "add", "numbers")
+	git("", "commit", "-q", "-m", "first")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "numbers"), []byte(strings.Repeat("line\n", 5001)), 0644))
+	git("", "commit", "-q", "-a", "-m", "second")
+
+	thinPack := git("HEAD\n^HEAD~1\n", "pack-objects", "--stdout", "--revs", "--thin", "--delta-base-offset")
+	thin, err := isThinPack(bytes.NewReader(thinPack), sha1.New)
+	assert.NoError(t, err)
+	assert.True(t, thin)
+
+	thin, err = isThinPack(bytes.NewReader(git("HEAD\n^HEAD~1\n", "pack-objects", "--stdout", "--revs", "--delta-base-offset")), sha1.New)
+	assert.NoError(t, err)
+	assert.False(t, thin)
+
+	thin, err = isThinPack(bytes.NewReader(git("HEAD\n", "pack-objects", "--stdout", "--revs", "--thin", "--delta-base-offset")), sha1.New)
+	assert.NoError(t, err)
+	assert.False(t, thin)
+
+	_, err = isThinPack(strings.NewReader("PACK"), sha1.New)
+	assert.Error(t, err)
+
+	// Thin packs are passed to git unchanged if they are allowed
+	reported := ""
+	inspection := (&Config{OnThinPack: func(repo string) { reported = repo }}).packInspection("app.git")
+	commands := pktStream(ZeroSHA+" "+strings.Repeat("a", 40)+" refs/heads/main\x00report-status ofs-delta\n", "0000")
+	out := &bytes.Buffer{}
+	err = copyClientInput(out, bytes.NewReader(append([]byte(commands), thinPack...)), 0, 0, func(r *clientRequest) error {
+		return nil
+	}, inspection.wrapper())
+	assert.NoError(t, err)
+	assert.NoError(t, inspection.err())
+	assert.Equal(t, commands+string(thinPack), out.String())
+	assert.Equal(t, "app", reported)
+}
+
+func TestSSH_AllowThinPack(t *testing.T) {
+	requireGit(t)
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh is not installed")
+	}
+
+	var mu sync.Mutex
+	thinPushes := []string{}
+
+	dir := t.TempDir()
+	s := NewSSH(Config{
+		Dir:           dir + "/repos",
+		KeyDir:        dir + "/keys",
+		AllowThinPack: new(bool),
+		OnThinPack: func(repo string) {
+			mu.Lock()
+			defer mu.Unlock()
+			thinPushes = append(thinPushes, repo)
+		},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	assert.NoError(t, InitRepo("app", s.config))
+	go s.Serve()
+	defer s.Stop()
+
+	_, port, _ := net.SplitHostPort(s.Address())
+	work := filepath.Join(dir, "work")
+	assert.NoError(t, exec.Command("git", "init", "-q", work).Run())
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o BatchMode=yes -p "+port)
+		out, err := cmd.CombinedOutput()
+		return string(out), err
+	}
+	commit := func(lines int) {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(work, "numbers"), []byte(strings.Repeat("line\n", lines)), 0644))
+		_, err := git("add", "numbers")
+		assert.NoError(t, err)
+		_, err = git("commit", "-q", "-m", "update")
+		assert.NoError(t, err)
+	}
+
+	// The first push has no objects to refer to
+	commit(5000)
+	out, err := git("push", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.NoError(t, err, out)
+
+	commit(5001)
+	out, err = git("push", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.Error(t, err)
+	assert.Contains(t, out, "Push rejected: thin packs are not allowed, push with --no-thin.")
+
+	out, err = git("push", "--no-thin", "ssh://git@127.0.0.1/app.git", "HEAD:refs/heads/main")
+	assert.NoError(t, err, out)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"app"}, thinPushes)
+}
@@ -0,0 +1,76 @@
+package gitkit
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// UploadPolicy restricts fetches and clones of a repository, see
+// Config.UploadPackPolicy. The zero value allows everything.
+type UploadPolicy struct {
+	Deny           bool   // Refuse all fetches, e.g. of huge repos during peak hours
+	Message        string // Shown to clients whose fetch is denied, defaults to a generic message
+	RequireShallow bool   // Refuse fetches without --depth, --shallow-since or --shallow-exclude, fetches into shallow clones are allowed
+	MaxDepth       int    // Max --depth of shallow fetches, zero means unlimited. Refuses --unshallow.
+}
+
+// denyMessage returns the message shown to clients if the fetch is denied
+func (p UploadPolicy) denyMessage() string {
+	if p.Message != "" {
+		return p.Message
+	}
+	return "Fetching this repository is not allowed right now."
+}
+
+// checksRequest returns true if the policy depends on the fetch request
+func (p UploadPolicy) checksRequest() bool {
+	return p.RequireShallow || p.MaxDepth > 0
+}
+
+// checkRequest returns an error if the fetch request of a client violates
+// the policy. Requests without wants, e.g. of ls-remote, are always allowed.
+func (p UploadPolicy) checkRequest(req *clientRequest) error {
+	wants := 0
+	depth := 0
+	shallow := false
+
+	for _, line := range req.Lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "want":
+			wants++
+		case "shallow", "deepen-since", "deepen-not":
+			shallow = true
+		case "deepen":
+			shallow = true
+			if len(fields) > 1 {
+				depth, _ = strconv.Atoi(fields[1])
+			}
+		}
+	}
+
+	if wants == 0 {
+		return nil
+	}
+	if p.MaxDepth > 0 && depth > p.MaxDepth {
+		return fmt.Errorf("fetch depth %d exceeds the limit of %d", depth, p.MaxDepth)
+	}
+	if p.RequireShallow && !shallow {
+		return fmt.Errorf("repository can only be fetched shallow, e.g. with --depth=1")
+	}
+	return nil
+}
+
+// uploadPolicy returns the policy for fetches of a repo by a client
+func (c *Config) uploadPolicy(repo string, remote net.Addr) (UploadPolicy, error) {
+	if c.UploadPackPolicy == nil {
+		return UploadPolicy{}, nil
+	}
+	return c.UploadPackPolicy(strings.TrimSuffix(repo, ".git"), remote)
+}
@@ -0,0 +1,44 @@
+package gitkit
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadPolicy_checkRequest(t *testing.T) {
+	oid := "e285100b636ac67fa28d85685072158edaa01685"
+	request := func(lines ...string) *clientRequest {
+		var req *clientRequest
+		err := copyClientInput(&bytes.Buffer{}, bytes.NewBufferString(pktStream(append(lines, "0000")...)), 0, 0, func(r *clientRequest) error {
+			req = r
+			return nil
+		}, nil)
+		assert.NoError(t, err)
+		return req
+	}
+
+	full := request("want " + oid + " thin-pack\n")
+	shallow := request("want "+oid+" thin-pack\n", "deepen 1\n")
+	deep := request("want "+oid+" thin-pack\n", "deepen 50\n")
+	since := request("want "+oid+" thin-pack\n", "deepen-since 1700000000\n")
+	fetchShallow := request("want "+oid+" thin-pack\n", "shallow "+oid+"\n")
+	listRefs := request()
+
+	policy := UploadPolicy{RequireShallow: true, MaxDepth: 10}
+	assert.True(t, policy.checksRequest())
+	assert.EqualError(t, policy.checkRequest(full), "repository can only be fetched shallow, e.g. with --depth=1")
+	assert.NoError(t, policy.checkRequest(shallow))
+	assert.EqualError(t, policy.checkRequest(deep), "fetch depth 50 exceeds the limit of 10")
+	assert.NoError(t, policy.checkRequest(since))
+	assert.NoError(t, policy.checkRequest(fetchShallow))
+	assert.NoError(t, policy.checkRequest(listRefs))
+
+	policy = UploadPolicy{MaxDepth: 10}
+	assert.NoError(t, policy.checkRequest(full))
+	assert.EqualError(t, policy.checkRequest(deep), "fetch depth 50 exceeds the limit of 10")
+
+	assert.False(t, UploadPolicy{Deny: true}.checksRequest())
+	assert.Equal(t, "Fetching this repository is not allowed right now.", UploadPolicy{Deny: true}.denyMessage())
+}
@@ -0,0 +1,61 @@
+package gitkit
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Critical option of OpenSSH certificates restricting them to one command
+const forceCommandOption = "force-command"
+
+// trustedUserCA returns true if the key is one of Config.TrustedUserCAKeys
+func (c *Config) trustedUserCA(key ssh.PublicKey) bool {
+	for _, ca := range c.TrustedUserCAKeys {
+		if bytes.Equal(ca.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// certPermissions checks a user certificate signed by a trusted CA and returns
+// the permissions of its first principal, which becomes the key ID
+func (s *SSH) certPermissions(cert *ssh.Certificate) (*ssh.Permissions, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate %q is not a user certificate", cert.KeyId)
+	}
+	if !s.config.trustedUserCA(cert.SignatureKey) {
+		return nil, fmt.Errorf("certificate %q is signed by an unknown authority", cert.KeyId)
+	}
+	// Certificates without principals would be valid for every user
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate %q has no principals", cert.KeyId)
+	}
+
+	principal := cert.ValidPrincipals[0]
+	checker := &ssh.CertChecker{SupportedCriticalOptions: []string{forceCommandOption}}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return nil, err
+	}
+
+	key := &PublicKey{
+		Id:          principal,
+		Name:        cert.KeyId,
+		Fingerprint: ssh.FingerprintSHA256(cert.Key),
+		Content:     authorizedKeyString(cert.Key),
+	}
+	if command, ok := cert.CriticalOptions[forceCommandOption]; ok {
+		forced, err := ParseGitCommand(command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forced command of certificate %q: %v", cert.KeyId, err)
+		}
+		key.ForcedCommand = forced
+	}
+
+	// The server enforces the source-address option of the certificate
+	perms := key.permissions()
+	perms.CriticalOptions = cert.CriticalOptions
+	return perms, nil
+}
@@ -0,0 +1,132 @@
+package gitkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSH_TrustedUserCAKeys(t *testing.T) {
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		signer, err := ssh.NewSignerFromKey(priv)
+		assert.NoError(t, err)
+		return signer
+	}
+	ca, otherCA, user := newSigner(), newSigner(), newSigner()
+
+	dir := t.TempDir()
+	s := NewSSH(Config{
+		Dir:               dir + "/repos",
+		KeyDir:            dir + "/keys",
+		Auth:              true,
+		TrustedUserCAKeys: []ssh.PublicKey{ca.PublicKey()},
+		CustomCommands: map[string]func(string, []string, io.ReadWriter) (int, error){
+			"whoami": func(keyID string, _ []string, ch io.ReadWriter) (int, error) {
+				_, err := io.WriteString(ch, keyID)
+				return 0, err
+			},
+		},
+	})
+	assert.NoError(t, s.Listen("127.0.0.1:0"))
+	go s.Serve()
+	defer s.Stop()
+
+	// Returns the key ID of the session authenticated with the certificate
+	whoami := func(cert *ssh.Certificate, authority ssh.Signer) (string, error) {
+		assert.NoError(t, cert.SignCert(rand.Reader, authority))
+		signer, err := ssh.NewCertSigner(cert, user)
+		assert.NoError(t, err)
+
+		conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+			User:            "git",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+
+		session, err := conn.NewSession()
+		assert.NoError(t, err)
+		out, err := session.Output("whoami")
+		return string(out), err
+	}
+	newCert := func(principals ...string) *ssh.Certificate {
+		return &ssh.Certificate{
+			Key:             user.PublicKey(),
+			KeyId:           "alice@laptop",
+			CertType:        ssh.UserCert,
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+	}
+
+	id, err := whoami(newCert("alice", "admins"), ca)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", id)
+
+	_, err = whoami(newCert("alice"), otherCA)
+	assert.Error(t, err)
+
+	_, err = whoami(newCert(), ca)
+	assert.Error(t, err)
+
+	expired := newCert("alice")
+	expired.ValidBefore = uint64(time.Now().Add(-time.Second).Unix())
+	_, err = whoami(expired, ca)
+	assert.Error(t, err)
+
+	restricted := newCert("alice")
+	restricted.CriticalOptions = map[string]string{"source-address": "10.0.0.1/32"}
+	_, err = whoami(restricted, ca)
+	assert.Error(t, err)
+
+	// Plain keys need a PublicKeyLookupFunc
+	conn, err := ssh.Dial("tcp", s.Address(), &ssh.ClientConfig{
+		User:            "git",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(user)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		conn.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestSSH_certPermissions(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(priv)
+	_, priv, _ = ed25519.GenerateKey(rand.Reader)
+	user, _ := ssh.NewSignerFromKey(priv)
+
+	s := NewSSH(Config{TrustedUserCAKeys: []ssh.PublicKey{ca.PublicKey()}})
+	cert := &ssh.Certificate{
+		Key:             user.PublicKey(),
+		KeyId:           "deploy",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"ci"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	cert.CriticalOptions = map[string]string{"force-command": "git-upload-pack 'app.git'"}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	perms, err := s.certPermissions(cert)
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", perms.Extensions["key-id"])
+	assert.Equal(t, "git-upload-pack 'app.git'", perms.Extensions["forced-command"])
+	assert.Equal(t, cert.CriticalOptions, perms.CriticalOptions)
+
+	cert.CriticalOptions = map[string]string{"force-command": "rm -rf /"}
+	assert.NoError(t, cert.SignCert(rand.Reader, ca))
+	_, err = s.certPermissions(cert)
+	assert.Error(t, err)
+}
@@ -3,8 +3,6 @@ package gitkit
 import (
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os/exec"
 	"regexp"
 	"strings"
@@ -13,19 +11,6 @@ import (
 
 var reSlashDedup = regexp.MustCompile(`\/{2,}`)
 
-func fail500(w http.ResponseWriter, context string, err error) {
-	http.Error(w, "Internal server error", 500)
-	logError(context, err)
-}
-
-func logError(context string, err error) {
-	log.Printf("%s: %v\n", context, err)
-}
-
-func logInfo(context string, message string) {
-	log.Printf("%s: %s\n", context, message)
-}
-
 func cleanUpProcessGroup(cmd *exec.Cmd) {
 	if cmd == nil {
 		return
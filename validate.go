@@ -0,0 +1,65 @@
+package gitkit
+
+import (
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// validateRepos checks that every *.git directory in Dir is a bare repository
+// with all objects reachable from its refs present
+func (c *Config) validateRepos() error {
+	problems := []string{}
+
+	walk := func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || !strings.HasSuffix(d.Name(), ".git") {
+			return nil
+		}
+
+		name, err := filepath.Rel(c.Dir, p)
+		if err != nil {
+			return err
+		}
+		if err := c.validateRepo(p); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", filepath.ToSlash(name), err))
+		}
+		return fs.SkipDir
+	}
+
+	if err := filepath.WalkDir(c.Dir, walk); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid repositories in %s:\n%s", c.Dir, strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+func (c *Config) validateRepo(repoPath string) error {
+	gitPath := c.GitPath
+	if gitPath == "" {
+		gitPath = "git"
+	}
+
+	kind, err := repoKind(gitPath, repoPath)
+	if err != nil {
+		return err
+	}
+	if kind != Bare {
+		return fmt.Errorf("%s", kind)
+	}
+
+	cmd := exec.Command(gitPath, "fsck", "--connectivity-only", "--no-dangling", "--no-progress")
+	cmd.Dir = repoPath
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("fsck failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package gitkit
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_validateRepos(t *testing.T) {
+	requireGit(t)
+
+	config := &Config{Dir: t.TempDir(), ValidateReposOnStart: true}
+	store := config.repoStore()
+	assert.NoError(t, store.Create("empty"))
+	assert.NoError(t, store.Create("org/app"))
+	assert.NoError(t, config.Setup())
+
+	// Commit to a clone and push it, then remove the commit object
+	work := filepath.Join(t.TempDir(), "work")
+	assert.NoError(t, exec.Command("git", "clone", "-q", store.Path("org/app"), work).Run())
+	for _, args := range [][]string{
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+		{"push", "-q", "origin", "HEAD:main"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = work
+		assert.NoError(t, cmd.Run())
+	}
+	assert.NoError(t, config.Setup())
+
+	objects, err := filepath.Glob(filepath.Join(store.Path("org/app"), "objects", "??", "*"))
+	assert.NoError(t, err)
+	for _, object := range objects {
+		assert.NoError(t, os.Remove(object))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(config.Dir, "broken.git"), 0755))
+
+	err = config.Setup()
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "broken.git: not a repository"), err.Error())
+		assert.True(t, strings.Contains(err.Error(), "org/app.git: fsck failed"), err.Error())
+		assert.False(t, strings.Contains(err.Error(), "empty.git"), err.Error())
+	}
+}